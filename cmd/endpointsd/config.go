@@ -0,0 +1,310 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/rwl/endpoints/server"
+	"sigs.k8s.io/yaml"
+)
+
+// Config is the configuration of the proxy, read from a JSON or YAML file.
+type Config struct {
+	// Address to listen on, ":8080" by default.
+	Listen string `json:"listen"`
+
+	// Certificate and key files to serve HTTPS with. HTTP is served if
+	// they aren't given. They are reloaded when they change.
+	TLS *TLSConfig `json:"tls"`
+
+	// Path the APIs are served under, "/_ah/api/" by default.
+	Root string `json:"root"`
+
+	// URL of the default SPI backend and of any other backends whose API
+	// configurations are served.
+	Backend  string   `json:"backend"`
+	Backends []string `json:"backends"`
+
+	// TLS of the connections to https backends.
+	BackendTLS *BackendTLSConfig `json:"backend_tls"`
+
+	// Switch https URLs in API configurations to http, for backends
+	// that report https URLs but serve plain HTTP, as in development.
+	ConvertHttpsToHttp bool `json:"convert_https_to_http"`
+
+	// Source of the API configurations. They are fetched from the
+	// backends if none is given.
+	ConfigSource *ConfigSourceConfig `json:"config_source"`
+
+	// Interval at which the backends are asked for their API
+	// configurations again, when no config source is given. They are
+	// only asked again on SIGHUP if it is zero.
+	ConfigRefreshInterval Duration `json:"config_refresh_interval"`
+
+	// Reject API configurations with problems, whether read by the config
+	// source or fetched from the backends, rather than logging them.
+	Strict bool `json:"strict"`
+
+	CORS    *CORSConfig    `json:"cors"`
+	Auth    *AuthConfig    `json:"auth"`
+	Limits  *LimitsConfig  `json:"limits"`
+	Logging *LoggingConfig `json:"logging"`
+
+	// Path to serve Prometheus metrics at, if any.
+	MetricsPath string `json:"metrics_path"`
+
+	// Address to serve the admin endpoints on, if any, and their path
+	// prefix, "/_admin" by default. Admin endpoints should not be
+	// reachable by clients.
+	AdminListen string `json:"admin_listen"`
+	AdminPrefix string `json:"admin_prefix"`
+
+	// Time allowed for requests in progress to finish on shutdown, 30s by
+	// default.
+	ShutdownTimeout Duration `json:"shutdown_timeout"`
+}
+
+// TLSConfig configures HTTPS.
+type TLSConfig struct {
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+}
+
+// BackendTLSConfig configures TLS for connections to backends. See
+// server.BackendTLSOptions.
+type BackendTLSConfig struct {
+	// CA bundle that backend certificates are verified with, if not the
+	// system's.
+	CAFile string `json:"ca_file"`
+
+	// Client certificate and key for backends that require mutual TLS.
+	CertFile string `json:"cert_file"`
+	KeyFile  string `json:"key_file"`
+
+	ServerName         string `json:"server_name"`
+	InsecureSkipVerify bool   `json:"insecure_skip_verify"`
+}
+
+// Returns the options of the server's backend TLS.
+func (c *BackendTLSConfig) options() server.BackendTLSOptions {
+	return server.BackendTLSOptions{
+		CAFile:             c.CAFile,
+		CertFile:           c.CertFile,
+		KeyFile:            c.KeyFile,
+		ServerName:         c.ServerName,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}
+}
+
+// ConfigSourceConfig configures where API configurations are read from.
+// Either Files or Dir must be given.
+type ConfigSourceConfig struct {
+	// .api files, or a directory of them.
+	Files []string `json:"files"`
+	Dir   string   `json:"dir"`
+
+	// Interval at which files are checked for changes. They aren't
+	// watched if it is zero. SIGHUP reloads the configurations either way.
+	WatchInterval Duration `json:"watch_interval"`
+}
+
+// CORSConfig restricts the origins allowed to make cross-origin requests.
+type CORSConfig struct {
+	// Origins allowed, such as "https://example.com". All origins are
+	// allowed if none are given.
+	AllowedOrigins []string `json:"allowed_origins"`
+}
+
+// AuthConfig requires API calls to give one of a set of API keys.
+type AuthConfig struct {
+	// Keys accepted in the header, or in the "key" query parameter.
+	ApiKeys []string `json:"api_keys"`
+
+	// Header giving the key, "X-Api-Key" by default.
+	Header string `json:"header"`
+}
+
+// LimitsConfig limits the resources used by requests.
+type LimitsConfig struct {
+	// Largest request body accepted, in bytes. Unlimited if zero.
+	MaxBodyBytes int64 `json:"max_body_bytes"`
+
+	// Time allowed for a request, including SPI calls and retries.
+	// Unlimited if zero.
+	RequestTimeout Duration `json:"request_timeout"`
+
+	// Time allowed to read a request's headers and body, and to write the
+	// response. Unlimited if zero.
+	ReadTimeout  Duration `json:"read_timeout"`
+	WriteTimeout Duration `json:"write_timeout"`
+}
+
+// LoggingConfig configures the structured log.
+type LoggingConfig struct {
+	// "text", the default, or "json".
+	Format string `json:"format"`
+
+	// "debug", "info", the default, "warn" or "error".
+	Level string `json:"level"`
+
+	// Path parameters whose values are redacted in the access log.
+	RedactParams []string `json:"redact_params"`
+}
+
+// Duration is a time.Duration given in JSON or YAML as a string such as
+// "30s".
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("Duration must be a string such as \"30s\": %s", string(b))
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Reads the configuration in the given file, which is YAML if its name
+// ends in .yaml or .yml and JSON otherwise. YAML is converted to JSON, so
+// that both are decoded alike. Unknown fields are rejected, to catch
+// misspellings.
+func loadConfig(name string) (*Config, error) {
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		return nil, err
+	}
+	if ext := strings.ToLower(filepath.Ext(name)); ext == ".yaml" || ext == ".yml" {
+		if b, err = yaml.YAMLToJSONStrict(b); err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+	config := &Config{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	if err = dec.Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	if err = config.validate(); err != nil {
+		return nil, fmt.Errorf("%s: %s", name, err.Error())
+	}
+	return config, nil
+}
+
+// Checks the configuration and fills in defaults.
+func (c *Config) validate() error {
+	if c.Listen == "" {
+		c.Listen = ":8080"
+	}
+	if c.Root != "" && !strings.HasPrefix(c.Root, "/") {
+		return fmt.Errorf("root must start with /: %s", c.Root)
+	}
+	if c.Backend == "" {
+		return errors.New("No backend given")
+	}
+	for _, backend := range append([]string{c.Backend}, c.Backends...) {
+		if err := validateURL(backend); err != nil {
+			return err
+		}
+	}
+	if c.TLS != nil && (c.TLS.CertFile == "" || c.TLS.KeyFile == "") {
+		return errors.New("tls needs both cert_file and key_file")
+	}
+	if b := c.BackendTLS; b != nil && (b.CertFile == "") != (b.KeyFile == "") {
+		return errors.New("backend_tls needs both cert_file and key_file, or neither")
+	}
+	if src := c.ConfigSource; src != nil && (len(src.Files) > 0) == (src.Dir != "") {
+		return errors.New("config_source must give one of files or dir")
+	}
+	if c.ConfigSource != nil && c.ConfigRefreshInterval != 0 {
+		return errors.New("config_refresh_interval is for backends, use the watch_interval of config_source")
+	}
+	if c.Auth != nil && len(c.Auth.ApiKeys) == 0 {
+		return errors.New("auth needs at least one of api_keys")
+	}
+	if c.Logging != nil {
+		switch c.Logging.Format {
+		case "", "text", "json":
+		default:
+			return fmt.Errorf("Unknown logging format: %s", c.Logging.Format)
+		}
+		switch strings.ToLower(c.Logging.Level) {
+		case "", "debug", "info", "warn", "error":
+		default:
+			return fmt.Errorf("Unknown logging level: %s", c.Logging.Level)
+		}
+	}
+	if c.AdminListen != "" && c.AdminListen == c.Listen {
+		return errors.New("admin_listen must differ from listen")
+	}
+	if c.AdminPrefix == "" {
+		c.AdminPrefix = "/_admin"
+	}
+	if c.ShutdownTimeout == 0 {
+		c.ShutdownTimeout = Duration(30 * time.Second)
+	}
+	return nil
+}
+
+// Checks that a backend URL is absolute.
+func validateURL(s string) error {
+	u, err := url.Parse(s)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return fmt.Errorf("Backend must be an http or https URL: %s", s)
+	}
+	return nil
+}
+
+// Returns the interval at which the API configurations are checked for
+// changes.
+func (c *Config) watchInterval() time.Duration {
+	if c.ConfigSource != nil {
+		return time.Duration(c.ConfigSource.WatchInterval)
+	}
+	return time.Duration(c.ConfigRefreshInterval)
+}
+
+// Returns the .api files of the configured file or directory source, or
+// nil if the configurations are fetched from the backends.
+func (c *Config) apiConfigFiles() ([]string, error) {
+	src := c.ConfigSource
+	switch {
+	case src == nil:
+		return nil, nil
+	case src.Dir != "":
+		return filepath.Glob(filepath.Join(src.Dir, "*.api"))
+	default:
+		return src.Files, nil
+	}
+}
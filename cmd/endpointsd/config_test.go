@@ -0,0 +1,128 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a configuration file to a new temporary directory.
+func writeConfig(t *testing.T, name, content string) (path string, dir string) {
+	dir, err := ioutil.TempDir("", "endpointsd")
+	assert.NoError(t, err)
+	path = filepath.Join(dir, name)
+	assert.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+	return path, dir
+}
+
+func TestLoadConfig(t *testing.T) {
+	path, dir := writeConfig(t, "endpointsd.json", `{
+		"backend": "http://localhost:8081",
+		"backends": ["https://other.example.com"],
+		"config_source": {"dir": "/etc/endpoints", "watch_interval": "5s"},
+		"limits": {"max_body_bytes": 1024, "request_timeout": "1m30s"},
+		"logging": {"format": "json", "level": "DEBUG"}
+	}`)
+	defer os.RemoveAll(dir)
+
+	config, err := loadConfig(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ":8080", config.Listen)
+		assert.Equal(t, "/_admin", config.AdminPrefix)
+		assert.Equal(t, Duration(30*time.Second), config.ShutdownTimeout)
+		assert.Equal(t, Duration(5*time.Second), config.ConfigSource.WatchInterval)
+		assert.Equal(t, Duration(90*time.Second), config.Limits.RequestTimeout)
+		assert.Equal(t, int64(1024), config.Limits.MaxBodyBytes)
+	}
+}
+
+func TestLoadYAMLConfig(t *testing.T) {
+	path, dir := writeConfig(t, "endpointsd.yaml", `
+backend: http://localhost:8081
+backends:
+  - https://other.example.com
+config_source:
+  dir: /etc/endpoints
+  watch_interval: 5s
+limits:
+  max_body_bytes: 1024
+  request_timeout: 1m30s
+`)
+	defer os.RemoveAll(dir)
+
+	config, err := loadConfig(path)
+	if assert.NoError(t, err) {
+		assert.Equal(t, ":8080", config.Listen)
+		assert.Equal(t, []string{"https://other.example.com"}, config.Backends)
+		assert.Equal(t, "/etc/endpoints", config.ConfigSource.Dir)
+		assert.Equal(t, Duration(5*time.Second), config.ConfigSource.WatchInterval)
+		assert.Equal(t, Duration(90*time.Second), config.Limits.RequestTimeout)
+		assert.Equal(t, int64(1024), config.Limits.MaxBodyBytes)
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	for _, test := range []struct{ name, content, expected string }{
+		{"c.json", `{"backend": "http://localhost:8081", "listne": ":80"}`, `unknown field "listne"`},
+		{"c.json", `{"backend": "http://localhost:8081", "shutdown_timeout": 30}`, "Duration must be a string"},
+		{"c.json", `{"listen": ":80"}`, "No backend given"},
+		{"c.json", `{"backend": "localhost:8081"}`, "Backend must be an http or https URL"},
+		{"c.json", `{"backend": "http://localhost:8081", "root": "api"}`, "root must start with /"},
+		{"c.json", `{"backend": "http://localhost:8081", "tls": {"cert_file": "cert.pem"}}`, "tls needs both"},
+		{"c.json", `{"backend": "https://localhost:8081", "backend_tls": {"key_file": "key.pem"}}`, "backend_tls needs both"},
+		{"c.json", `{"backend": "http://localhost:8081", "config_source": {"watch_interval": "5s"}}`, "config_source must give one of"},
+		{"c.json", `{"backend": "http://localhost:8081", "config_source": {"dir": "api", "strict": true}}`, `unknown field "strict"`},
+		{"c.json", `{"backend": "http://localhost:8081", "config_source": {"dir": "api"}, "config_refresh_interval": "1m"}`, "config_refresh_interval is for backends"},
+		{"c.json", `{"backend": "http://localhost:8081", "auth": {}}`, "auth needs at least one"},
+		{"c.json", `{"backend": "http://localhost:8081", "logging": {"level": "loud"}}`, "Unknown logging level"},
+		{"c.json", `{"backend": "http://localhost:8081", "admin_listen": ":8080"}`, "admin_listen must differ"},
+		{"c.yaml", "backend: http://localhost:8081\nlistne: \":80\"", `unknown field "listne"`},
+		{"c.yml", "backend: http://localhost:8081\nbackend: http://localhost:8082", "already set"},
+		{"c.yaml", "backend: [", "yaml"},
+	} {
+		path, dir := writeConfig(t, test.name, test.content)
+		_, err := loadConfig(path)
+		if assert.Error(t, err, test.content) {
+			assert.Contains(t, err.Error(), test.expected)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func TestApiConfigFiles(t *testing.T) {
+	_, dir := writeConfig(t, "a.api", "{}")
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "notes.txt"), nil, 0644))
+
+	config := &Config{ConfigSource: &ConfigSourceConfig{Dir: dir}}
+	files, err := config.apiConfigFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{filepath.Join(dir, "a.api")}, files)
+
+	config.ConfigSource = &ConfigSourceConfig{Files: []string{"b.api"}}
+	files, err = config.apiConfigFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b.api"}, files)
+
+	config.ConfigSource = nil
+	files, err = config.apiConfigFiles()
+	assert.NoError(t, err)
+	assert.Nil(t, files)
+}
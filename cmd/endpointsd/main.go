@@ -0,0 +1,355 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+// Command endpointsd runs an Endpoints proxy in front of SPI backends, as
+// configured by a JSON or YAML file.
+//
+//	endpointsd -config endpointsd.json
+//	endpointsd -config endpointsd.yaml
+//
+// With -check it only validates the configuration and the API
+// configurations it refers to, and exits with a non-zero status if there
+// are problems.
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/rwl/endpoints/server"
+)
+
+var (
+	configFile = flag.String("config", "endpointsd.json", "JSON or YAML configuration file")
+	checkOnly  = flag.Bool("check", false, "validate the configuration and API configurations, then exit")
+)
+
+func main() {
+	flag.Parse()
+	config, err := loadConfig(*configFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if *checkOnly {
+		if !check(config, os.Stdout) {
+			os.Exit(1)
+		}
+		return
+	}
+	if err = run(config); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+// Checks the API configurations of the given configuration, writing any
+// problems to w. Returns true if there were none.
+func check(config *Config, w io.Writer) bool {
+	transport, err := checkTLS(config)
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return false
+	}
+	var errs server.ConfigErrors
+	files, err := config.apiConfigFiles()
+	if err == nil && config.ConfigSource != nil {
+		if len(files) == 0 {
+			fmt.Fprintln(w, "No API config files found")
+			return false
+		}
+		errs, err = server.LintApiConfigFiles(files...)
+	} else if err == nil {
+		errs, err = lintBackends(config, transport)
+	}
+	if err != nil {
+		fmt.Fprintln(w, err)
+		return false
+	}
+	for _, configErr := range errs {
+		fmt.Fprintln(w, configErr)
+	}
+	if len(errs) > 0 {
+		return false
+	}
+	fmt.Fprintln(w, "OK")
+	return true
+}
+
+// Checks that the certificates and keys of the configuration can be read.
+// Returns the transport that the backends are called with, or nil for the
+// default.
+func checkTLS(config *Config) (server.SpiTransport, error) {
+	if config.TLS != nil {
+		if _, err := server.NewCertificateReloader(config.TLS.CertFile, config.TLS.KeyFile); err != nil {
+			return nil, err
+		}
+	}
+	if config.BackendTLS == nil {
+		return nil, nil
+	}
+	tlsConfig, err := server.NewBackendTLSConfig(config.BackendTLS.options())
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	return server.NewHttpSpiTransport(&http.Client{Transport: transport}), nil
+}
+
+// Fetches the API configurations from each of the backends with the given
+// transport and checks them.
+func lintBackends(config *Config, transport server.SpiTransport) (server.ConfigErrors, error) {
+	var errs server.ConfigErrors
+	for _, backend := range append([]string{config.Backend}, config.Backends...) {
+		u, _ := url.Parse(backend)
+		configs, err := server.NewBackendConfigSourceTransport(u, transport).ApiConfigs()
+		if parseErrs, ok := err.(server.ConfigErrors); ok {
+			errs = append(errs, parseErrs...)
+		} else if err != nil {
+			return nil, fmt.Errorf("%s: %s", backend, err.Error())
+		}
+		errs = append(errs, server.LintApiConfigs(configs)...)
+	}
+	return errs, nil
+}
+
+// Returns the logger configured.
+func newLogger(config *LoggingConfig) *slog.Logger {
+	level := slog.LevelInfo
+	format := "text"
+	if config != nil {
+		level.UnmarshalText([]byte(config.Level))
+		format = config.Format
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if format == "json" {
+		return slog.New(slog.NewJSONHandler(os.Stderr, opts))
+	}
+	return slog.New(slog.NewTextHandler(os.Stderr, opts))
+}
+
+// Returns an Endpoints server set up as configured.
+func newServer(config *Config, logger *slog.Logger) (*server.EndpointsServer, error) {
+	u, _ := url.Parse(config.Backend)
+	var ed *server.EndpointsServer
+	if config.Root != "" {
+		ed = server.NewEndpointsServerRoot(config.Root, u, server.WithLogger(logger))
+	} else {
+		ed = server.NewEndpointsServer(u, server.WithLogger(logger))
+	}
+	for _, backend := range config.Backends {
+		u, _ = url.Parse(backend)
+		ed.AddBackend(u)
+	}
+	if config.BackendTLS != nil {
+		opts := config.BackendTLS.options()
+		opts.Logger = logger
+		tlsConfig, err := server.NewBackendTLSConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+		ed.SetBackendTLS(tlsConfig)
+	}
+	ed.SetConvertHttpsToHttp(config.ConvertHttpsToHttp)
+	if src := config.ConfigSource; src != nil {
+		if src.Dir != "" {
+			ed.SetConfigSource(server.NewDirConfigSource(src.Dir))
+		} else {
+			ed.SetConfigSource(server.NewFileConfigSource(src.Files...))
+		}
+	}
+	ed.SetStrictApiConfigs(config.Strict)
+	ed.SetConfigWatchInterval(config.watchInterval())
+	if config.MetricsPath != "" {
+		ed.SetMetricsPath(config.MetricsPath)
+	}
+	if config.Logging != nil {
+		ed.SetRedactedParams(config.Logging.RedactParams...)
+	}
+	if config.Auth != nil {
+		ed.AddInterceptor(apiKeyInterceptor(config.Auth))
+	}
+	return ed, nil
+}
+
+// Returns an interceptor that fails calls that don't give one of the
+// configured API keys.
+func apiKeyInterceptor(config *AuthConfig) server.Interceptor {
+	header := config.Header
+	if header == "" {
+		header = "X-Api-Key"
+	}
+	return func(call *server.Call, next server.CallHandler) (*server.CallResponse, error) {
+		key := call.OrigRequest.Header.Get(header)
+		if key == "" {
+			key = call.OrigRequest.URL.Query().Get("key")
+		}
+		for _, valid := range config.ApiKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(valid)) == 1 {
+				return next(call)
+			}
+		}
+		return nil, server.NewRequestError(http.StatusUnauthorized, "API key missing or invalid")
+	}
+}
+
+// Wraps the handler of the API server with the configured limits and
+// CORS restrictions.
+func newHandler(config *Config, h http.Handler) http.Handler {
+	if config.CORS != nil && len(config.CORS.AllowedOrigins) > 0 {
+		h = corsFilter(config.CORS.AllowedOrigins, h)
+	}
+	if limits := config.Limits; limits != nil && (limits.MaxBodyBytes > 0 || limits.RequestTimeout > 0) {
+		next := h
+		h = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if limits.MaxBodyBytes > 0 {
+				r.Body = http.MaxBytesReader(w, r.Body, limits.MaxBodyBytes)
+			}
+			if limits.RequestTimeout > 0 {
+				ctx, cancel := context.WithTimeout(r.Context(), time.Duration(limits.RequestTimeout))
+				defer cancel()
+				r = r.WithContext(ctx)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+	return h
+}
+
+// Returns a handler that removes the Origin header from requests from
+// origins that aren't allowed, so that the server doesn't allow them
+// cross-origin access.
+func corsFilter(allowed []string, h http.Handler) http.Handler {
+	origins := make(map[string]bool, len(allowed))
+	for _, origin := range allowed {
+		origins[strings.ToLower(strings.TrimSuffix(origin, "/"))] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if origin := r.Header.Get("Origin"); origin != "" && !origins[strings.ToLower(origin)] {
+			r.Header.Del("Origin")
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// Runs the proxy until it receives SIGINT or SIGTERM, then shuts it down
+// gracefully.
+func run(config *Config) error {
+	logger := newLogger(config.Logging)
+	ed, err := newServer(config, logger)
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	ed.HandleHttp(mux)
+	httpServer := &http.Server{
+		Addr:    config.Listen,
+		Handler: newHandler(config, mux),
+	}
+	if config.TLS != nil {
+		reloader, err := server.NewCertificateReloader(config.TLS.CertFile, config.TLS.KeyFile)
+		if err != nil {
+			return err
+		}
+		reloader.SetLogger(logger)
+		httpServer.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: reloader.GetCertificate,
+		}
+	}
+	if limits := config.Limits; limits != nil {
+		httpServer.ReadTimeout = time.Duration(limits.ReadTimeout)
+		httpServer.WriteTimeout = time.Duration(limits.WriteTimeout)
+	}
+	servers := []*http.Server{httpServer}
+	if config.AdminListen != "" {
+		adminMux := http.NewServeMux()
+		ed.HandleAdmin(adminMux, config.AdminPrefix)
+		servers = append(servers, &http.Server{Addr: config.AdminListen, Handler: adminMux})
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := ed.Start(ctx); err != nil {
+		return err
+	}
+	if config.watchInterval() == 0 {
+		// The config watcher reloads on SIGHUP by itself.
+		go reloadOnHangup(ctx, ed)
+	}
+
+	errs := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func(srv *http.Server) {
+			logger.Info("Listening", "addr", srv.Addr)
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ListenAndServeTLS("", "")
+			} else {
+				err = srv.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				errs <- err
+			}
+		}(srv)
+	}
+
+	select {
+	case <-ctx.Done():
+		logger.Info("Shutting down")
+	case err = <-errs:
+		logger.Error("Server failed", "error", err)
+	}
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(config.ShutdownTimeout))
+	defer cancel()
+	for _, srv := range servers {
+		if shutdownErr := srv.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+			err = shutdownErr
+		}
+	}
+	if shutdownErr := ed.Shutdown(shutdownCtx); shutdownErr != nil && err == nil {
+		err = shutdownErr
+	}
+	return err
+}
+
+// Reloads the API configurations whenever the process receives SIGHUP,
+// until ctx is done.
+func reloadOnHangup(ctx context.Context, ed *server.EndpointsServer) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			ed.ReloadApiConfigs()
+		}
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/rwl/endpoints/server"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testApiConfig = `{
+	"name": "a_api",
+	"version": "v1",
+	"methods": {
+		"a_api.get": {"httpMethod": "GET", "path": "items/{id}", "rosyMethod": "MyApi.get"}
+	}
+}`
+
+func TestCheck(t *testing.T) {
+	good, dir := writeConfig(t, "good.api", testApiConfig)
+	defer os.RemoveAll(dir)
+	dup := filepath.Join(dir, "dup.api")
+	assert.NoError(t, ioutil.WriteFile(dup, []byte(testApiConfig), 0644))
+
+	config := &Config{ConfigSource: &ConfigSourceConfig{Files: []string{good}}}
+	var out bytes.Buffer
+	assert.True(t, check(config, &out))
+	assert.Equal(t, "OK\n", out.String())
+
+	config.ConfigSource = &ConfigSourceConfig{Dir: dir}
+	out.Reset()
+	assert.False(t, check(config, &out))
+	assert.Contains(t, out.String(), "a_api v1")
+
+	config.ConfigSource = &ConfigSourceConfig{Dir: filepath.Join(dir, "missing")}
+	out.Reset()
+	assert.False(t, check(config, &out))
+	assert.Equal(t, "No API config files found\n", out.String())
+
+	config.TLS = &TLSConfig{CertFile: filepath.Join(dir, "missing.pem"), KeyFile: good}
+	out.Reset()
+	assert.False(t, check(config, &out))
+	assert.Contains(t, out.String(), "missing.pem")
+}
+
+func TestCheckBackend(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write([]byte(`{"items": ["{"]}`))
+	}))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	assert.False(t, check(&Config{Backend: ts.URL}, &out))
+	assert.True(t, strings.HasPrefix(out.String(), "item 0: "), out.String())
+
+	ts.Close()
+	out.Reset()
+	assert.False(t, check(&Config{Backend: ts.URL}, &out))
+	assert.True(t, strings.HasPrefix(out.String(), ts.URL+": "), out.String())
+}
+
+func TestCheckBackendTLS(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := json.Marshal(map[string]interface{}{"items": []string{testApiConfig}})
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	var out bytes.Buffer
+	assert.False(t, check(&Config{Backend: ts.URL}, &out))
+	out.Reset()
+	config := &Config{Backend: ts.URL, BackendTLS: &BackendTLSConfig{InsecureSkipVerify: true}}
+	assert.True(t, check(config, &out), out.String())
+
+	// The backend TLS is only used by the check.
+	assert.Nil(t, http.DefaultClient.Transport)
+}
+
+func TestStrictBackendConfigs(t *testing.T) {
+	// The backend reports the same API twice.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		body, _ := json.Marshal(map[string]interface{}{"items": []string{testApiConfig, testApiConfig}})
+		w.Write(body)
+	}))
+	defer ts.Close()
+
+	logger := newLogger(&LoggingConfig{Level: "ERROR"})
+	ed, err := newServer(&Config{Backend: ts.URL}, logger)
+	assert.NoError(t, err)
+	assert.NoError(t, ed.ReloadApiConfigs())
+
+	ed, err = newServer(&Config{Backend: ts.URL, Strict: true}, logger)
+	assert.NoError(t, err)
+	assert.Error(t, ed.ReloadApiConfigs())
+}
+
+func TestApiKeyInterceptor(t *testing.T) {
+	interceptor := apiKeyInterceptor(&AuthConfig{ApiKeys: []string{"secret"}})
+	next := func(call *server.Call) (*server.CallResponse, error) {
+		return &server.CallResponse{StatusCode: 200}, nil
+	}
+	call := func(header, query string) error {
+		r, _ := http.NewRequest("GET", "http://localhost/_ah/api/a_api/v1/items/1"+query, nil)
+		if header != "" {
+			r.Header.Set("X-Api-Key", header)
+		}
+		_, err := interceptor(&server.Call{OrigRequest: &server.ApiRequest{Request: r}}, next)
+		return err
+	}
+
+	assert.NoError(t, call("secret", ""))
+	assert.NoError(t, call("", "?key=secret"))
+	assert.Error(t, call("wrong", ""))
+	assert.Error(t, call("", ""))
+}
+
+func TestCorsFilter(t *testing.T) {
+	var origin string
+	h := corsFilter([]string{"https://example.com/"}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin = r.Header.Get("Origin")
+	}))
+	serve := func(o string) string {
+		r, _ := http.NewRequest("GET", "http://localhost/_ah/api/a_api/v1/items/1", nil)
+		r.Header.Set("Origin", o)
+		h.ServeHTTP(httptest.NewRecorder(), r)
+		return origin
+	}
+
+	assert.Equal(t, "https://example.com", serve("https://example.com"))
+	assert.Equal(t, "", serve("https://evil.example.com"))
+}
+
+func TestLimits(t *testing.T) {
+	limits := &LimitsConfig{MaxBodyBytes: 4, RequestTimeout: Duration(time.Second)}
+	var readErr error
+	var hasDeadline bool
+	h := newHandler(&Config{Limits: limits}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, readErr = ioutil.ReadAll(r.Body)
+		_, hasDeadline = r.Context().Deadline()
+	}))
+
+	r, _ := http.NewRequest("POST", "http://localhost/_ah/api/a_api/v1/items", strings.NewReader("12345"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Error(t, readErr)
+	assert.True(t, hasDeadline)
+
+	r, _ = http.NewRequest("POST", "http://localhost/_ah/api/a_api/v1/items", strings.NewReader("1234"))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.NoError(t, readErr)
+}
@@ -0,0 +1,311 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"net/http"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// HandleAdmin registers handlers for the server's admin endpoints under
+// the given path prefix (e.g. "/_admin") with the given mux, or with
+// http.DefaultServeMux if mux is nil. The admin endpoints aren't
+// registered by HandleHttp, so that they can be served on a private
+// listener.
+//
+//	<prefix>/breakers   State of the circuit breakers of the SPI methods.
+//	<prefix>/apis       Names and versions of the APIs loaded.
+//	<prefix>/routes     REST routing table, in the order paths are matched.
+//	<prefix>/rpc        Keys of the JSON-RPC methods.
+//	<prefix>/route      The method that serves ?method=GET&path=... and
+//	                    the parameters taken from the path.
+//	<prefix>/config     Status of the API config source.
+//	<prefix>/readyz     Whether the server is ready and, if not, why not.
+//	<prefix>/reload     Reloads the API configurations when POSTed to.
+func (ed *EndpointsServer) HandleAdmin(mux *http.ServeMux, prefix string) {
+	if mux == nil {
+		mux = http.DefaultServeMux
+	}
+	prefix = path.Join("/", prefix)
+	mux.HandleFunc(path.Join(prefix, "breakers"), ed.HandleCircuitBreakersRequest)
+	mux.HandleFunc(path.Join(prefix, "apis"), ed.HandleApisRequest)
+	mux.HandleFunc(path.Join(prefix, "routes"), ed.HandleRoutesRequest)
+	mux.HandleFunc(path.Join(prefix, "rpc"), ed.HandleRpcMethodsRequest)
+	mux.HandleFunc(path.Join(prefix, "route"), ed.HandleRouteTestRequest)
+	mux.HandleFunc(path.Join(prefix, "config"), ed.HandleConfigStatusRequest)
+	mux.HandleFunc(path.Join(prefix, "readyz"), ed.HandleAdminReadyzRequest)
+	mux.HandleFunc(path.Join(prefix, "reload"), ed.HandleReloadRequest)
+}
+
+// Writes a JSON response to an admin request.
+func writeAdminResponse(w http.ResponseWriter, status int, v interface{}) {
+	body, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// Writes a JSON error response to an admin request.
+func writeAdminError(w http.ResponseWriter, status int, message string) {
+	writeAdminResponse(w, status, map[string]string{"error": message})
+}
+
+// An API loaded by the server.
+type adminApi struct {
+	Name    string
+	Version string
+	Methods int
+	Backend string `json:",omitempty"`
+}
+
+// Handler for requests for the APIs loaded. Responds with a JSON list of
+// the APIs, sorted by name and version.
+func (ed *EndpointsServer) HandleApisRequest(w http.ResponseWriter, r *http.Request) {
+	apis := make([]adminApi, 0)
+	for key, config := range ed.configManager.configs() {
+		apis = append(apis, adminApi{
+			Name:    key.methodName,
+			Version: key.version,
+			Methods: len(config.Methods),
+			Backend: ed.configManager.apiBackend(key),
+		})
+	}
+	sort.Slice(apis, func(i, j int) bool {
+		if apis[i].Name != apis[j].Name {
+			return apis[i].Name < apis[j].Name
+		}
+		return apis[i].Version < apis[j].Version
+	})
+	writeAdminResponse(w, http.StatusOK, apis)
+}
+
+// A path of the REST routing table.
+type adminRoute struct {
+	Path    string
+	Pattern string
+	Score   int
+	Methods map[string]string // Method names by HTTP method.
+}
+
+// Returns the REST routing table, in the order paths are matched.
+func (m *apiConfigManager) routes() []adminRoute {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+	routes := make([]adminRoute, len(m.restMethods))
+	for i, rm := range m.restMethods {
+		methods := make(map[string]string, len(rm.methods))
+		for httpMethod, info := range rm.methods {
+			methods[strings.ToUpper(httpMethod)] = info.methodName
+		}
+		routes[i] = adminRoute{
+			Path:    rm.path,
+			Pattern: rm.compiledPathPattern.String(),
+			Score:   scorePath(rm.path),
+			Methods: methods,
+		}
+	}
+	return routes
+}
+
+// Handler for requests for the REST routing table. Responds with a JSON
+// list of paths in the order they are matched, with their scores.
+func (ed *EndpointsServer) HandleRoutesRequest(w http.ResponseWriter, r *http.Request) {
+	writeAdminResponse(w, http.StatusOK, ed.configManager.routes())
+}
+
+// The key of a JSON-RPC method.
+type adminRpcMethod struct {
+	Method     string
+	Version    string
+	RosyMethod string
+}
+
+// Returns the keys of the JSON-RPC methods, sorted by name and version.
+func (m *apiConfigManager) rpcKeys() []adminRpcMethod {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+	keys := make([]adminRpcMethod, 0, len(m.rpcMethods))
+	for key, method := range m.rpcMethods {
+		keys = append(keys, adminRpcMethod{key.methodName, key.version, method.RosyMethod})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Method != keys[j].Method {
+			return keys[i].Method < keys[j].Method
+		}
+		return keys[i].Version < keys[j].Version
+	})
+	return keys
+}
+
+// Handler for requests for the JSON-RPC method keys. Responds with a JSON
+// list of the methods, sorted by name and version.
+func (ed *EndpointsServer) HandleRpcMethodsRequest(w http.ResponseWriter, r *http.Request) {
+	writeAdminResponse(w, http.StatusOK, ed.configManager.rpcKeys())
+}
+
+// The method matched by a route test.
+type adminRouteMatch struct {
+	Name   string
+	Method *endpoints.ApiMethod
+	Params map[string]string
+}
+
+// Handler for route tests. The "method" query parameter gives the HTTP
+// method, GET by default, and "path" the path of a REST request, with or
+// without the server's root. Responds with the name and configuration of
+// the API method that would serve the request and the parameters taken
+// from its path, or with 404 if none matches.
+func (ed *EndpointsServer) HandleRouteTestRequest(w http.ResponseWriter, r *http.Request) {
+	httpMethod := r.FormValue("method")
+	if httpMethod == "" {
+		httpMethod = "GET"
+	}
+	p := r.FormValue("path")
+	if p == "" {
+		writeAdminError(w, http.StatusBadRequest, "No path given")
+		return
+	}
+	p = strings.TrimPrefix(p, ed.root)
+	p = strings.TrimPrefix(p, "/")
+	name, method, params := ed.configManager.lookupRestMethod(p, httpMethod)
+	if method == nil {
+		writeAdminError(w, http.StatusNotFound,
+			fmt.Sprintf("No method matches %s %s", strings.ToUpper(httpMethod), p))
+		return
+	}
+	writeAdminResponse(w, http.StatusOK, adminRouteMatch{name, method, params})
+}
+
+// ConfigSourceStatus is the status of the source of the server's API
+// configurations.
+type ConfigSourceStatus struct {
+	// Kind of the source: "backend", "backends", "static", "files" or the
+	// type of a custom source.
+	Source string
+
+	// Times the configurations were last loaded, and last failed to load
+	// with the error given.
+	LastSuccessTime time.Time
+	LastErrorTime   time.Time
+	LastError       string `json:",omitempty"`
+
+	// APIs loaded, not counting the discovery API.
+	Apis int
+
+	// Health of the backends, for a source that gathers the
+	// configurations from them.
+	Backends []BackendStatus `json:",omitempty"`
+}
+
+// Outcomes of loading the API configurations.
+type configStatus struct {
+	lastSuccess time.Time
+	lastErrTime time.Time
+	lastErr     string
+	lock        sync.Mutex
+}
+
+// Records the outcome of loading the API configurations.
+func (ed *EndpointsServer) configRefreshed(err error) {
+	ed.metrics.configRefreshed(err)
+	s := &ed.configStatus
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		s.lastErr, s.lastErrTime = err.Error(), time.Now()
+	} else {
+		s.lastSuccess = time.Now()
+	}
+}
+
+// ConfigSourceStatus returns the status of the source of the server's API
+// configurations.
+func (ed *EndpointsServer) ConfigSourceStatus() ConfigSourceStatus {
+	var status ConfigSourceStatus
+	switch src := ed.apiConfigSource().(type) {
+	case *backendConfigSource:
+		status.Source = "backend"
+	case *backendsConfigSource:
+		status.Source = "backends"
+		status.Backends = ed.BackendStatus()
+	case *staticConfigSource:
+		status.Source = "static"
+	case *fileConfigSource:
+		status.Source = "files"
+	default:
+		status.Source = fmt.Sprintf("%T", src)
+	}
+	s := &ed.configStatus
+	s.lock.Lock()
+	status.LastSuccessTime, status.LastErrorTime, status.LastError = s.lastSuccess, s.lastErrTime, s.lastErr
+	s.lock.Unlock()
+	for key := range ed.configManager.configs() {
+		if key.methodName != discoveryApiConfig.Name || key.version != discoveryApiConfig.Version {
+			status.Apis++
+		}
+	}
+	return status
+}
+
+// Handler for requests for the status of the config source. Responds
+// with a JSON ConfigSourceStatus.
+func (ed *EndpointsServer) HandleConfigStatusRequest(w http.ResponseWriter, r *http.Request) {
+	writeAdminResponse(w, http.StatusOK, ed.ConfigSourceStatus())
+}
+
+// Readiness of the server, with the reasons it isn't ready.
+type adminReadiness struct {
+	Ready    bool
+	Problems []string `json:",omitempty"`
+}
+
+// Handler for admin readiness checks. Responds as the public readiness
+// endpoint does, with 200 or 503, but with a JSON body that gives the
+// reasons the server isn't ready.
+func (ed *EndpointsServer) HandleAdminReadyzRequest(w http.ResponseWriter, r *http.Request) {
+	problems := ed.readinessProblems()
+	status := http.StatusOK
+	if len(problems) > 0 {
+		status = http.StatusServiceUnavailable
+	}
+	writeAdminResponse(w, status, adminReadiness{len(problems) == 0, problems})
+}
+
+// Handler for requests to reload the API configurations, which must be
+// POSTed. Responds with the new ConfigSourceStatus, or with 500 and the
+// error if the configurations weren't reloaded.
+func (ed *EndpointsServer) HandleReloadRequest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		writeAdminError(w, http.StatusMethodNotAllowed, "Reloads must be POSTed")
+		return
+	}
+	if err := ed.ReloadApiConfigs(); err != nil {
+		writeAdminError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+	writeAdminResponse(w, http.StatusOK, ed.ConfigSourceStatus())
+}
@@ -0,0 +1,142 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Returns a mux serving the admin endpoints of a server with a static
+// guestbook API.
+func newAdminMux() (*EndpointsServer, *http.ServeMux) {
+	config := &endpoints.ApiDescriptor{
+		Name:    "guestbook",
+		Version: "v1",
+		Methods: map[string]*endpoints.ApiMethod{
+			"guestbook.greetings.get": &endpoints.ApiMethod{
+				HttpMethod: "GET",
+				Path:       "greetings/{gid}",
+				RosyMethod: "MyApi.greetings_get",
+			},
+			"guestbook.greetings.list": &endpoints.ApiMethod{
+				HttpMethod: "GET",
+				Path:       "greetings",
+				RosyMethod: "MyApi.greetings_list",
+			},
+			"guestbook.greetings.authed": &endpoints.ApiMethod{
+				HttpMethod: "POST",
+				Path:       "greetings/authed",
+				RosyMethod: "MyApi.greetings_authed",
+			},
+		},
+	}
+	u, _ := url.Parse("http://localhost:8080")
+	server := NewEndpointsServer(u)
+	server.SetConfigSource(NewStaticConfigSource(config))
+	mux := http.NewServeMux()
+	server.HandleAdmin(mux, "_admin")
+	return server, mux
+}
+
+// Serves an admin request and decodes its JSON response into v.
+func adminRequest(t *testing.T, mux *http.ServeMux, method, target string, v interface{}) int {
+	r, _ := http.NewRequest(method, target, nil)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), v))
+	return w.Code
+}
+
+func TestAdminReload(t *testing.T) {
+	_, mux := newAdminMux()
+
+	var status ConfigSourceStatus
+	assert.Equal(t, 200, adminRequest(t, mux, "GET", "/_admin/config", &status))
+	assert.Equal(t, "static", status.Source)
+	assert.Equal(t, 0, status.Apis)
+	assert.True(t, status.LastSuccessTime.IsZero())
+
+	var result map[string]string
+	assert.Equal(t, 405, adminRequest(t, mux, "GET", "/_admin/reload", &result))
+
+	assert.Equal(t, 200, adminRequest(t, mux, "POST", "/_admin/reload", &status))
+	assert.Equal(t, 1, status.Apis)
+	assert.False(t, status.LastSuccessTime.IsZero())
+	assert.Equal(t, "", status.LastError)
+}
+
+func TestAdminTables(t *testing.T) {
+	server, mux := newAdminMux()
+	assert.NoError(t, server.ReloadApiConfigs())
+
+	var apis []adminApi
+	assert.Equal(t, 200, adminRequest(t, mux, "GET", "/_admin/apis", &apis))
+	assert.Equal(t, []adminApi{
+		{Name: "discovery", Version: "v1", Methods: len(discoveryApiConfig.Methods)},
+		{Name: "guestbook", Version: "v1", Methods: 3},
+	}, apis)
+
+	var routes []adminRoute
+	assert.Equal(t, 200, adminRequest(t, mux, "GET", "/_admin/routes", &routes))
+	var paths []string
+	for _, route := range routes {
+		if route.Path == "guestbook/v1/greetings/authed" {
+			assert.Equal(t, map[string]string{"POST": "guestbook.greetings.authed"}, route.Methods)
+			assert.Equal(t, scorePath(route.Path), route.Score)
+		}
+		if len(route.Path) > 9 && route.Path[:9] == "guestbook" {
+			paths = append(paths, route.Path)
+		}
+	}
+	assert.Equal(t, []string{"guestbook/v1/greetings/authed", "guestbook/v1/greetings",
+		"guestbook/v1/greetings/{gid}"}, paths)
+
+	var rpc []adminRpcMethod
+	assert.Equal(t, 200, adminRequest(t, mux, "GET", "/_admin/rpc", &rpc))
+	found := false
+	for _, key := range rpc {
+		found = found || key == adminRpcMethod{"guestbook.greetings.get", "v1", "MyApi.greetings_get"}
+	}
+	assert.True(t, found)
+}
+
+func TestAdminRouteTest(t *testing.T) {
+	server, mux := newAdminMux()
+	assert.NoError(t, server.ReloadApiConfigs())
+
+	var match adminRouteMatch
+	assert.Equal(t, 200, adminRequest(t, mux, "GET",
+		"/_admin/route?path=/_ah/api/guestbook/v1/greetings/42", &match))
+	assert.Equal(t, "guestbook.greetings.get", match.Name)
+	assert.Equal(t, "MyApi.greetings_get", match.Method.RosyMethod)
+	assert.Equal(t, map[string]string{"gid": "42"}, match.Params)
+
+	assert.Equal(t, 200, adminRequest(t, mux, "GET",
+		"/_admin/route?method=post&path=guestbook/v1/greetings/authed", &match))
+	assert.Equal(t, "guestbook.greetings.authed", match.Name)
+
+	var result map[string]string
+	assert.Equal(t, 404, adminRequest(t, mux, "GET",
+		"/_admin/route?method=DELETE&path=guestbook/v1/greetings/42", &result))
+	assert.Equal(t, "No method matches DELETE guestbook/v1/greetings/42", result["error"])
+	assert.Equal(t, 400, adminRequest(t, mux, "GET", "/_admin/route", &result))
+}
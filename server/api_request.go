@@ -20,7 +20,6 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"strings"
@@ -30,24 +29,47 @@ import (
 
 const apiPrefix = "/_ah/api/"
 
-// Simple data type representing an API request.
-type apiRequest struct {
+// ApiRequest is an API request that has been parsed by the server, or
+// the request transformed from it that is sent to the SPI.
+type ApiRequest struct {
 	*http.Request
 
 	relativeUrl string
 	// Only single-element batch requests are handled (RPC and JS calls
 	// typically show up as batch requests). Pull the request out of the
 	// list and record the fact that we're processing a batch.
-	isBatch   bool
-	bodyJson  map[string]interface{}
-	requestId string
+	isBatch  bool
+	bodyJson map[string]interface{}
+	// Number of elements in the batch, of which only the first is handled.
+	batchSize int
+	// The JSON-RPC request id, which may be of any JSON type, or nil if
+	// the request didn't have one.
+	requestId interface{}
+	// The JSON-RPC protocol version given in the request, if any.
+	jsonrpcVersion string
+	// URL of the SPI backend serving the request's method, if it isn't
+	// the server's default backend.
+	backend string
+	// URL the request is sent to, if it is a replica of the backend.
+	target string
+	// Headers added to the request sent to the SPI.
+	spiHeader http.Header
+	// Name and version of the API called, once the method is resolved.
+	api lookupKey
+	// Timings of the request.
+	stats *requestStats
+	// Trace context and spans of the request.
+	trace *requestTrace
+	// Parameters matched in the path of a REST request.
+	params map[string]string
 }
 
-func newApiRequest(r *http.Request) (*apiRequest, error) {
-	ar := &apiRequest{
+func newApiRequest(r *http.Request) (*ApiRequest, error) {
+	ar := &ApiRequest{
 		Request:     r,
 		isBatch:     false,
 		relativeUrl: r.URL.Path,
+		stats:       &requestStats{},
 	}
 
 	if !strings.HasPrefix(ar.URL.Path, apiPrefix) {
@@ -64,10 +86,14 @@ func newApiRequest(r *http.Request) (*apiRequest, error) {
 	var bodyJson map[string]interface{}
 	var bodyJsonArray []map[string]interface{}
 	if len(body) > 0 {
-		err := json.Unmarshal(body, &bodyJson)
+		err := ar.unmarshalBody(body, &bodyJson)
 		if err != nil {
-			err = json.Unmarshal(body, &bodyJsonArray)
+			err = ar.unmarshalBody(body, &bodyJsonArray)
 			if err != nil {
+				if ar.isRpc() {
+					return nil, newJsonRpcError(jsonrpcParseError,
+						fmt.Sprintf("Parse error: %s", body))
+				}
 				return nil, fmt.Errorf("Problem unmarshalling request body: %s", body)
 			}
 			ar.isBatch = true
@@ -75,21 +101,21 @@ func newApiRequest(r *http.Request) (*apiRequest, error) {
 	} else {
 		bodyJson = make(map[string]interface{})
 	}
-	ar.requestId = ""
 
 	// Check if it's a batch request.  We'll only handle single-element batch
 	// requests on the dev server (and we need to handle them because that's
 	// what RPC and JS calls typically show up as). Pulls the request out of
-	// the list and logs the fact that we're processing a batch.
+	// the list and records the size of the batch, which is logged when the
+	// request is served.
 	if ar.isBatch {
-		switch n := len(bodyJsonArray); n {
-		case 0:
+		if len(bodyJsonArray) == 0 {
+			if ar.isRpc() {
+				return nil, newJsonRpcError(jsonrpcInvalidRequest,
+					"Batch request has zero parts")
+			}
 			return nil, errors.New("Batch request has zero parts")
-		case 1:
-		default:
-			log.Printf(`Batch requests with more than 1 element aren't supported. Only the first element will be handled. Found %d elements.`, n)
 		}
-		log.Println("Converting batch request to single request.")
+		ar.batchSize = len(bodyJsonArray)
 		ar.bodyJson = bodyJsonArray[0]
 		bodyBytes, err := json.Marshal(ar.bodyJson)
 		ar.Body = ioutil.NopCloser(bytes.NewBuffer(bodyBytes))
@@ -103,7 +129,24 @@ func newApiRequest(r *http.Request) (*apiRequest, error) {
 	return ar, nil
 }
 
-func (ar *apiRequest) copy() (*apiRequest, error) {
+// Unmarshals a request body. Numbers in JSON-RPC requests are kept as
+// json.Number so that ids and parameters are passed on exactly.
+func (ar *ApiRequest) unmarshalBody(body []byte, v interface{}) error {
+	if !ar.isRpc() {
+		return json.Unmarshal(body, v)
+	}
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(v); err != nil {
+		return err
+	}
+	if dec.More() {
+		return errors.New("Unexpected data after JSON value")
+	}
+	return nil
+}
+
+func (ar *ApiRequest) copy() (*ApiRequest, error) {
 	body, err := ioutil.ReadAll(ar.Body)
 	if err != nil {
 		return nil, err
@@ -150,13 +193,19 @@ func (ar *apiRequest) copy() (*apiRequest, error) {
 		RequestURI:       ar.RequestURI,
 		TLS:              ar.TLS,
 	}
-
-	return &apiRequest{
-		Request:     request,
-		isBatch:     ar.isBatch,
-		bodyJson:    ar.bodyJson,
-		requestId:   ar.requestId,
-		relativeUrl: ar.relativeUrl,
+	request = request.WithContext(ar.Context())
+
+	return &ApiRequest{
+		Request:        request,
+		isBatch:        ar.isBatch,
+		bodyJson:       ar.bodyJson,
+		requestId:      ar.requestId,
+		jsonrpcVersion: ar.jsonrpcVersion,
+		backend:        ar.backend,
+		relativeUrl:    ar.relativeUrl,
+		api:            ar.api,
+		stats:          ar.stats,
+		trace:          ar.trace,
 	}, nil
 }
 
@@ -167,6 +216,16 @@ func (ar *apiRequest) copy() (*apiRequest, error) {
 // If the request is sent to /rpc, we will treat it as JsonRPC.
 // The client libraries for iOS's Objective C use RPC and not the REST
 // versions of the API.
-func (ar *apiRequest) isRpc() bool {
+func (ar *ApiRequest) isRpc() bool {
 	return ar.URL.Path == "rpc"
 }
+
+// Returns true if this is a JSON-RPC 2.0 notification, a request without
+// an id to which no response is expected.
+func (ar *ApiRequest) isNotification() bool {
+	if !ar.isRpc() || ar.bodyJson == nil {
+		return false
+	}
+	_, hasId := ar.bodyJson["id"]
+	return !hasId && ar.bodyJson["jsonrpc"] == jsonrpcVersion
+}
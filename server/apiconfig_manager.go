@@ -21,7 +21,7 @@ import (
 	"errors"
 	"fmt"
 	"github.com/rwl/go-endpoints/endpoints"
-	"log"
+	"reflect"
 	"regexp"
 	"strings"
 	"sync"
@@ -39,6 +39,24 @@ type apiConfigManager struct {
 	restMethods []*restMethod
 	_configs    map[lookupKey]*endpoints.ApiDescriptor
 	configLock  sync.Mutex
+
+	// The configurations the tables were last built from, as given before
+	// any conversion to HTTP, and the backends that reported them.
+	lastConfigs []*endpoints.ApiDescriptor
+	lastSources map[lookupKey]string
+
+	// URL of the SPI backend serving each API: the backend that reported
+	// its configuration or else the one named by its Adapter.Bns.
+	apiBackends map[lookupKey]string
+
+	// Name and version of the API of each method.
+	methodApis map[*endpoints.ApiMethod]lookupKey
+
+	// Logger of problems with the configurations, or nil for the default.
+	logger Logger
+
+	// Whether https URLs in the configurations are switched to http.
+	convertHttps bool
 }
 
 func newApiConfigManager() *apiConfigManager {
@@ -47,6 +65,9 @@ func newApiConfigManager() *apiConfigManager {
 		restMethods: make([]*restMethod, 0),
 		_configs:    make(map[lookupKey]*endpoints.ApiDescriptor),
 		configLock:  sync.Mutex{},
+
+		apiBackends: make(map[lookupKey]string),
+		methodApis:  make(map[*endpoints.ApiMethod]lookupKey),
 	}
 }
 
@@ -81,6 +102,42 @@ func convertHttpsToHttp(config *endpoints.ApiDescriptor) {
 	}
 }
 
+// Returns the given configurations with their URLs switched to HTTP, if
+// that is enabled. The configurations that are switched are copied, so
+// that those of the config source aren't modified. It must be called with
+// the lock held.
+func (m *apiConfigManager) convertedConfigs(configs []*endpoints.ApiDescriptor) []*endpoints.ApiDescriptor {
+	if !m.convertHttps {
+		return configs
+	}
+	converted := make([]*endpoints.ApiDescriptor, len(configs))
+	for i, config := range configs {
+		if config != nil {
+			copied := *config
+			convertHttpsToHttp(&copied)
+			config = &copied
+		}
+		converted[i] = config
+	}
+	return converted
+}
+
+// Returns the given backends of the APIs with their URLs switched to
+// HTTP, if that is enabled. It must be called with the lock held.
+func (m *apiConfigManager) convertedSources(sources map[lookupKey]string) map[lookupKey]string {
+	if !m.convertHttps || sources == nil {
+		return sources
+	}
+	converted := make(map[lookupKey]string, len(sources))
+	for key, backend := range sources {
+		if strings.HasPrefix(backend, "https://") {
+			backend = strings.Replace(backend, "https://", "http://", 1)
+		}
+		converted[key] = backend
+	}
+	return converted
+}
+
 // Returns a map with the current configuration mappings.
 func (m *apiConfigManager) configs() map[lookupKey]*endpoints.ApiDescriptor {
 	cfg := make(map[lookupKey]*endpoints.ApiDescriptor)
@@ -100,52 +157,148 @@ func (m *apiConfigManager) configs() map[lookupKey]*endpoints.ApiDescriptor {
 // Parses method name, etc for all methods and updates the indexing
 // datastructures with the information.
 func (m *apiConfigManager) parseApiConfigResponse(body string) error {
+	configs, err := parseApiConfigResponse(body)
+	if errs, ok := configErrors(err); ok {
+		for _, configErr := range errs {
+			m.log().Warn("Can not parse API config", "error", configErr)
+		}
+	} else if err != nil {
+		return err
+	}
+	m.saveApiConfigs(configs, nil)
+	return nil
+}
+
+// Parses the JSON body of the getApiConfigs response into API
+// configurations. If some of the configurations can't be parsed, those
+// that can are returned with a ConfigErrors error describing the others.
+func parseApiConfigResponse(body string) ([]*endpoints.ApiDescriptor, error) {
 	var responseObj map[string]interface{}
 	err := json.Unmarshal([]byte(body), &responseObj)
 	if err != nil {
-		return fmt.Errorf("Cannot parse BackendService.getApiConfigs response: %s", body)
+		return nil, fmt.Errorf("Cannot parse BackendService.getApiConfigs response: %s", body)
 	}
 
-	m.configLock.Lock()
-	defer m.configLock.Unlock()
-	m.addDiscoveryConfig()
-
 	items, ok := responseObj["items"]
 	if !ok {
-		return errors.New(`BackendService.getApiConfigs response missing "items" key.`)
+		return nil, errors.New(`BackendService.getApiConfigs response missing "items" key.`)
 	}
 	itemArray, ok := items.([]interface{})
 	if !ok {
-		return fmt.Errorf(`Invalid type for "items" value in response: %#v`, items)
+		return nil, fmt.Errorf(`Invalid type for "items" value in response: %#v`, items)
 	}
 
-	for _, apiConfigJson := range itemArray {
+	configs := make([]*endpoints.ApiDescriptor, 0, len(itemArray))
+	var errs ConfigErrors
+	for i, apiConfigJson := range itemArray {
+		source := fmt.Sprintf("item %d", i)
 		apiConfigJsonStr, ok := apiConfigJson.(string)
 		if !ok {
-			return fmt.Errorf(`Invalid type for "items" value in response: %#v`, apiConfigJson)
+			errs = append(errs, &ConfigError{Kind: ConfigErrorParse, Source: source,
+				Message: fmt.Sprintf("Invalid type for item: %#v", apiConfigJson)})
+			continue
 		}
 		var config *endpoints.ApiDescriptor
 		err := json.Unmarshal([]byte(apiConfigJsonStr), &config)
-		if err != nil {
-			log.Printf("Can not parse API config: %s", apiConfigJsonStr)
+		if err != nil || config == nil {
+			errs = append(errs, &ConfigError{Kind: ConfigErrorParse, Source: source,
+				Message: apiConfigJsonStr})
 		} else {
-			lookupKey := lookupKey{config.Name, config.Version}
-			convertHttpsToHttp(config)
-			m._configs[lookupKey] = config
+			configs = append(configs, config)
+		}
+	}
+	if errs != nil {
+		return configs, errs
+	}
+	return configs, nil
+}
+
+// Replaces the stored API configurations with the given ones and rebuilds
+// the method tables from them, so that methods no longer configured can't
+// be dispatched. The backend that reported each API, if any, is given by
+// sources. Methods that can't be registered are logged and skipped.
+// Nothing is rebuilt if the configurations haven't changed. They are only
+// compared in full if they aren't those the tables were last built from.
+func (m *apiConfigManager) saveApiConfigs(configs []*endpoints.ApiDescriptor, sources map[lookupKey]string) {
+	m.configLock.Lock()
+	if m.lastConfigs != nil && reflect.DeepEqual(m.lastSources, sources) &&
+		(sameConfigs(m.lastConfigs, configs) || reflect.DeepEqual(m.lastConfigs, configs)) {
+		m.configLock.Unlock()
+		return
+	}
+	converted := m.convertedConfigs(configs)
+	convertedSources := m.convertedSources(sources)
+	m.configLock.Unlock()
+
+	next := newApiConfigManager()
+	for _, err := range next.registerApiConfigs(converted, convertedSources) {
+		m.log().Warn("Can not register API method", "error", err)
+	}
+	m.swapTables(next, configs, sources)
+}
+
+// Registers the discovery API and the given API configurations, which
+// must already have had any conversion to HTTP applied, in a new
+// configuration manager. Returns an error for each method that can't be
+// registered.
+func (m *apiConfigManager) registerApiConfigs(configs []*endpoints.ApiDescriptor, sources map[lookupKey]string) []error {
+	var errs []error
+	m.addDiscoveryConfig()
+	for _, config := range configs {
+		if config == nil {
+			errs = append(errs, errors.New("Empty API config"))
+			continue
 		}
+		m._configs[lookupKey{config.Name, config.Version}] = config
 	}
 
 	for _, config := range m._configs {
 		name := config.Name
 		version := config.Version
-		sortedMethods := sortMethods(config.Methods)
+		methods, empty := configuredMethods(config.Methods)
+		for _, methodName := range empty {
+			errs = append(errs, fmt.Errorf("Empty method %s in API config %s %s",
+				methodName, name, version))
+		}
+		sortedMethods := sortMethods(methods)
+
+		key := lookupKey{name, version}
+		backend, ok := sources[key]
+		if !ok {
+			backend = bnsBackend(config.Adapter.Bns)
+		}
+		if backend != "" {
+			m.apiBackends[key] = backend
+		}
 
 		for _, methodInfo := range sortedMethods {
+			m.methodApis[methodInfo.apiMethod] = lookupKey{name, version}
 			m.saveRpcMethod(methodInfo.methodName, version, methodInfo.apiMethod)
-			m.saveRestMethod(methodInfo.methodName, name, version, methodInfo.apiMethod)
+			err := m.saveRestMethod(methodInfo.methodName, name, version, methodInfo.apiMethod)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Invalid path for method %s in API config %s %s: %s",
+					methodInfo.methodName, name, version, err.Error()))
+			}
 		}
 	}
-	return nil
+	return errs
+}
+
+// Atomically replaces the configurations and method tables with those of
+// next, built from configs after any conversion to HTTP. Returns the
+// changes made to the methods.
+func (m *apiConfigManager) swapTables(next *apiConfigManager, configs []*endpoints.ApiDescriptor, sources map[lookupKey]string) *configDiff {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+	diff := diffMethods(m.rpcMethods, next.rpcMethods)
+	m.rpcMethods = next.rpcMethods
+	m.restMethods = next.restMethods
+	m._configs = next._configs
+	m.apiBackends = next.apiBackends
+	m.methodApis = next.methodApis
+	m.lastConfigs = configs
+	m.lastSources = sources
+	return diff
 }
 
 // Gets path parameters from a regular expression match.
@@ -178,10 +331,38 @@ func pathParams(names []string, match []string) (map[string]string, error) {
 //
 // Returns a method descriptor as specified in the API configuration.
 func (m *apiConfigManager) lookupRpcMethod(methodName, version string) *endpoints.ApiMethod {
+	method, _, _ := m.lookupRpcTarget(methodName, version)
+	return method
+}
+
+// Looks up the JsonRPC method as lookupRpcMethod does. Returns the method
+// descriptor together with the name and version of its API and the URL of
+// the SPI backend serving it, all taken from the same method tables.
+func (m *apiConfigManager) lookupRpcTarget(methodName, version string) (*endpoints.ApiMethod, lookupKey, string) {
 	m.configLock.Lock()
 	defer m.configLock.Unlock()
 	method, _ := m.rpcMethods[lookupKey{methodName, version}]
-	return method
+	api, backend := m.methodTarget(method)
+	return method, api, backend
+}
+
+// Returns the name and version of the API of a method and the URL of the
+// SPI backend serving it, or "" if its API configuration doesn't name
+// one. It must be called with the lock held.
+func (m *apiConfigManager) methodTarget(method *endpoints.ApiMethod) (lookupKey, string) {
+	if method == nil {
+		return lookupKey{}, ""
+	}
+	api := m.methodApis[method]
+	return api, m.apiBackends[api]
+}
+
+// Returns the URL of the SPI backend serving an API, or "" if there isn't
+// one.
+func (m *apiConfigManager) apiBackend(key lookupKey) string {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+	return m.apiBackends[key]
 }
 
 // Looks up the REST method at call time.
@@ -199,6 +380,24 @@ func (m *apiConfigManager) lookupRpcMethod(methodName, version string) *endpoint
 func (m *apiConfigManager) lookupRestMethod(path, httpMethod string) (string, *endpoints.ApiMethod, map[string]string) {
 	m.configLock.Lock()
 	defer m.configLock.Unlock()
+	return m.findRestMethod(path, httpMethod)
+}
+
+// Looks up the REST method as lookupRestMethod does. Returns the method
+// name, descriptor and path parameters together with the name and version
+// of its API and the URL of the SPI backend serving it, all taken from the
+// same method tables.
+func (m *apiConfigManager) lookupRestTarget(path, httpMethod string) (string, *endpoints.ApiMethod, map[string]string, lookupKey, string) {
+	m.configLock.Lock()
+	defer m.configLock.Unlock()
+	methodName, method, params := m.findRestMethod(path, httpMethod)
+	api, backend := m.methodTarget(method)
+	return methodName, method, params, api, backend
+}
+
+// Finds the REST method for lookupRestMethod. It must be called with the
+// lock held.
+func (m *apiConfigManager) findRestMethod(path, httpMethod string) (string, *endpoints.ApiMethod, map[string]string) {
 	for _, rm := range m.restMethods {
 		match := rm.compiledPathPattern.MatchString(path)
 		if match {
@@ -207,8 +406,8 @@ func (m *apiConfigManager) lookupRestMethod(path, httpMethod string) (string, *e
 				rm.compiledPathPattern.FindStringSubmatch(path),
 			)
 			if err != nil {
-				log.Printf("Error extracting path [%s] parameters: %s",
-					path, err.Error())
+				m.log().Warn("Error extracting path parameters", "path", path,
+					"error", err)
 				continue
 			}
 			methodKey := strings.ToLower(httpMethod)
@@ -216,11 +415,12 @@ func (m *apiConfigManager) lookupRestMethod(path, httpMethod string) (string, *e
 			if ok {
 				return method.methodName, method.apiMethod, params
 			} else {
-				log.Printf("No %s method found for path: %s", httpMethod, path)
+				m.log().Debug("No method found for path", "http_method", httpMethod,
+					"path", path)
 			}
 		}
 	}
-	log.Printf("No endpoint found for path: %s", path)
+	m.log().Debug("No endpoint found for path", "path", path)
 	return "", nil, nil
 }
 
@@ -358,21 +558,18 @@ func (m *apiConfigManager) saveRpcMethod(methodName, version string, method *end
 // - When a path is matched, look up the API method from the request
 //   and get the method name and method config for the matching
 //   API method and method name.
-func (m *apiConfigManager) saveRestMethod(methodName, apiName, version string, method *endpoints.ApiMethod) {
-	var compiledPattern *regexp.Regexp
-	var err error
+func (m *apiConfigManager) saveRestMethod(methodName, apiName, version string, method *endpoints.ApiMethod) error {
 	pathPattern := apiName + "/" + version + "/" + method.Path
 	httpMethod := strings.ToLower(method.HttpMethod)
 	for _, rm := range m.restMethods {
 		if rm.path == pathPattern {
 			rm.methods[httpMethod] = &methodInfo{methodName, method}
-			goto R
+			return nil
 		}
 	}
-	compiledPattern, err = compilePathPattern(pathPattern)
+	compiledPattern, err := compilePathPattern(pathPattern)
 	if err != nil {
-		log.Printf(err.Error()) // fixme: handle error
-		return
+		return err
 	}
 	//log.Printf("Registering REST method: %s %s %s %s", apiName, version, methodName, pathPattern)
 	m.restMethods = append(m.restMethods,
@@ -384,6 +581,5 @@ func (m *apiConfigManager) saveRestMethod(methodName, apiName, version string, m
 			},
 		},
 	)
-R:
-	return
+	return nil
 }
@@ -313,9 +313,56 @@ func TestParseApiConfigInvalidApiConfig(t *testing.T) {
 	assert.Equal(t, fakeMethod, actualMethod)
 }
 
-// Test that the parsed API config has switched HTTPS to HTTP.
+// Test that APIs and methods missing from a later response are removed.
+func TestParseApiConfigRemovesMethods(t *testing.T) {
+	configManager := newApiConfigManager()
+	buildItems := func(configs ...*endpoints.ApiDescriptor) string {
+		itemStrs := make([]string, len(configs))
+		for i, config := range configs {
+			b, _ := json.Marshal(config)
+			itemStrs[i] = string(b)
+		}
+		items, _ := json.Marshal(map[string]interface{}{"items": itemStrs})
+		return string(items)
+	}
+	guestbook := &endpoints.ApiDescriptor{
+		Name:    "guestbook_api",
+		Version: "X",
+		Methods: map[string]*endpoints.ApiMethod{
+			"guestbook_api.get":  &endpoints.ApiMethod{HttpMethod: "GET", Path: "greetings/{gid}"},
+			"guestbook_api.list": &endpoints.ApiMethod{HttpMethod: "GET", Path: "greetings"},
+		},
+	}
+	other := &endpoints.ApiDescriptor{
+		Name:    "other_api",
+		Version: "X",
+		Methods: map[string]*endpoints.ApiMethod{
+			"other_api.get": &endpoints.ApiMethod{HttpMethod: "GET", Path: "things/{id}"},
+		},
+	}
+	assert.NoError(t, configManager.parseApiConfigResponse(buildItems(guestbook, other)))
+	restCount := len(configManager.restMethods)
+
+	delete(guestbook.Methods, "guestbook_api.get")
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, configManager.parseApiConfigResponse(buildItems(guestbook)))
+	}
+	assert.Nil(t, configManager.lookupRpcMethod("guestbook_api.get", "X"))
+	assert.Nil(t, configManager.lookupRpcMethod("other_api.get", "X"))
+	assert.NotNil(t, configManager.lookupRpcMethod("guestbook_api.list", "X"))
+	mn, _, _ := configManager.lookupRestMethod("guestbook_api/X/greetings/1", "GET")
+	assert.Equal(t, "", mn)
+	mn, _, _ = configManager.lookupRestMethod("other_api/X/things/1", "GET")
+	assert.Equal(t, "", mn)
+	_, ok := configManager.configs()[lookupKey{"other_api", "X"}]
+	assert.False(t, ok)
+	assert.Equal(t, restCount-2, len(configManager.restMethods))
+}
+
+// Test that the parsed API config has switched HTTPS to HTTP, if enabled.
 func TestParseApiConfigConvertHttps(t *testing.T) {
 	configManager := newApiConfigManager()
+	configManager.convertHttps = true
 
 	descriptor := &endpoints.ApiDescriptor{
 		Name:    "guestbook_api",
@@ -337,6 +384,55 @@ func TestParseApiConfigConvertHttps(t *testing.T) {
 	assert.Equal(t, "http://localhost/_ah/api", configManager.configs()[key].Root)
 }
 
+// Test that switching HTTPS to HTTP leaves the configs saved unmodified.
+func TestSaveApiConfigsConvertsCopies(t *testing.T) {
+	configManager := newApiConfigManager()
+	configManager.convertHttps = true
+
+	descriptor := &endpoints.ApiDescriptor{
+		Name:    "guestbook_api",
+		Version: "X",
+		Root:    "https://localhost/_ah/api",
+		Methods: make(map[string]*endpoints.ApiMethod),
+	}
+	descriptor.Adapter.Bns = "https://localhost/_ah/spi"
+	configs := []*endpoints.ApiDescriptor{descriptor}
+	configManager.saveApiConfigs(configs, nil)
+
+	key := lookupKey{"guestbook_api", "X"}
+	saved := configManager.configs()[key]
+	assert.Equal(t, "http://localhost/_ah/spi", saved.Adapter.Bns)
+	assert.Equal(t, "https://localhost/_ah/spi", descriptor.Adapter.Bns)
+	assert.Equal(t, "https://localhost/_ah/api", descriptor.Root)
+
+	// The tables aren't rebuilt from the same configs.
+	configManager.saveApiConfigs(configs, nil)
+	assert.True(t, saved == configManager.configs()[key])
+}
+
+// Test that HTTPS URLs are kept by default.
+func TestParseApiConfigKeepsHttps(t *testing.T) {
+	configManager := newApiConfigManager()
+
+	descriptor := &endpoints.ApiDescriptor{
+		Name:    "guestbook_api",
+		Version: "X",
+		Root:    "https://localhost/_ah/api",
+		Methods: make(map[string]*endpoints.ApiMethod),
+	}
+	descriptor.Adapter.Bns = "https://localhost/_ah/spi"
+
+	config, _ := json.Marshal(descriptor)
+	items, _ := json.Marshal(map[string]interface{}{
+		"items": []string{string(config)},
+	})
+	configManager.parseApiConfigResponse(string(items))
+
+	key := lookupKey{"guestbook_api", "X"}
+	assert.Equal(t, "https://localhost/_ah/spi", configManager.configs()[key].Adapter.Bns)
+	assert.Equal(t, "https://localhost/_ah/api", configManager.configs()[key].Root)
+}
+
 // Test that the convertHttpsToHttp function works.
 func TestConvertHttpsToHttp(t *testing.T) {
 	config := &endpoints.ApiDescriptor{
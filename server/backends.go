@@ -0,0 +1,283 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rwl/go-endpoints/endpoints"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Support for fronting several SPI backends.
+//
+// The API configurations are gathered from every backend and each API's
+// methods are dispatched to the backend that reported its configuration,
+// or to the backend named by the Adapter.Bns of configurations from other
+// config sources.
+
+// Path of the SPI root in Adapter.Bns URLs.
+const spiRoot = "/_ah/spi"
+
+// Number of consecutive failures after which a backend is unhealthy.
+const backendUnhealthyThreshold = 3
+
+// BackendStatus describes the health of an SPI backend.
+type BackendStatus struct {
+	URL                 string
+	Healthy             bool
+	ConsecutiveFailures int
+	LastError           string
+	LastErrorTime       time.Time
+	LastSuccessTime     time.Time
+}
+
+// Health of each of the SPI backends called, by URL.
+type backendHealth struct {
+	status map[string]*BackendStatus
+	lock   sync.Mutex
+
+	// Logger of changes in health, or nil for the default.
+	logger Logger
+}
+
+// Records the outcome of a call to a backend. Connection errors and 5xx
+// responses count as failures.
+func (h *backendHealth) record(backend string, resp *http.Response, err error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.status == nil {
+		h.status = make(map[string]*BackendStatus)
+	}
+	status, ok := h.status[backend]
+	if !ok {
+		status = &BackendStatus{URL: backend, Healthy: true}
+		h.status[backend] = status
+	}
+	if err == nil && resp != nil && resp.StatusCode >= 500 {
+		err = &backendStatusError{resp.Status}
+	}
+	if err != nil {
+		status.ConsecutiveFailures++
+		status.LastError = err.Error()
+		status.LastErrorTime = time.Now()
+		if status.Healthy && status.ConsecutiveFailures >= backendUnhealthyThreshold {
+			loggerOrDefault(h.logger).Warn("SPI backend is unhealthy",
+				"backend", backend, "error", status.LastError)
+			status.Healthy = false
+		}
+		return
+	}
+	if !status.Healthy {
+		loggerOrDefault(h.logger).Info("SPI backend is healthy", "backend", backend)
+	}
+	status.ConsecutiveFailures = 0
+	status.Healthy = true
+	status.LastSuccessTime = time.Now()
+}
+
+// Returns the status of each backend called, in URL order.
+func (h *backendHealth) statuses() []BackendStatus {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	result := make([]BackendStatus, 0, len(h.status))
+	for _, status := range h.status {
+		result = append(result, *status)
+	}
+	sort.Sort(backendStatusByURL(result))
+	return result
+}
+
+type backendStatusByURL []BackendStatus
+
+func (s backendStatusByURL) Len() int           { return len(s) }
+func (s backendStatusByURL) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s backendStatusByURL) Less(i, j int) bool { return s[i].URL < s[j].URL }
+
+// Error for a backend response with a 5xx status.
+type backendStatusError struct {
+	status string
+}
+
+func (e *backendStatusError) Error() string {
+	return "Backend returned " + e.status
+}
+
+// Returns the backend URL, of the form http://ipaddr:port, named by an
+// Adapter.Bns value, or "" if there isn't one.
+func bnsBackend(bns string) string {
+	return strings.TrimSuffix(strings.TrimSuffix(bns, "/"), spiRoot)
+}
+
+// AddBackend adds an SPI backend that is fronted in addition to the one
+// the server was created with. API configurations are gathered from all
+// of the backends.
+func (ed *EndpointsServer) AddBackend(u *url.URL) {
+	ed.backendsLock.Lock()
+	defer ed.backendsLock.Unlock()
+	ed.backends = append(ed.backends, formatBackendURL(u))
+}
+
+// Returns the URLs of all of the backends fronted.
+func (ed *EndpointsServer) backendURLs() []string {
+	ed.backendsLock.Lock()
+	defer ed.backendsLock.Unlock()
+	return append([]string{ed.url}, ed.backends...)
+}
+
+// BackendStatus returns the health of each of the SPI backends that have
+// been called.
+func (ed *EndpointsServer) BackendStatus() []BackendStatus {
+	return ed.backendHealth.statuses()
+}
+
+// Config source that gathers the API configurations from all of the
+// server's backends.
+//
+// The configurations reported by each backend are kept, so that backends
+// are only asked for them again when they are refreshed, on reload or at
+// the config watch interval, and not on every request. Backends that
+// haven't reported any configurations yet are asked whenever they are
+// requested. The backend that reported each API is kept alongside its
+// configuration, so that its methods are dispatched there whatever the
+// Adapter.Bns of the configuration names. If a backend can't be reached,
+// the configurations it last reported are used.
+type backendsConfigSource struct {
+	ed *EndpointsServer
+
+	configs   map[string][]*endpoints.ApiDescriptor // By backend URL.
+	parseErrs map[string]ConfigErrors               // By backend URL.
+	lock      sync.Mutex
+}
+
+func (s *backendsConfigSource) ApiConfigs() ([]*endpoints.ApiDescriptor, error) {
+	configs, _, err := s.apiConfigs()
+	return configs, err
+}
+
+// Returns the configurations as ApiConfigs does, together with the
+// backend that reported each API, by name and version.
+func (s *backendsConfigSource) apiConfigs() ([]*endpoints.ApiDescriptor, map[lookupKey]string, error) {
+	backends := s.ed.backendURLs()
+	var missing []string
+	s.lock.Lock()
+	for _, backend := range backends {
+		if _, ok := s.configs[backend]; !ok {
+			missing = append(missing, backend)
+		}
+	}
+	s.lock.Unlock()
+	fetchErrs, _ := s.fetch(missing)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	var result []*endpoints.ApiDescriptor
+	sources := make(map[lookupKey]string)
+	var parseErrs ConfigErrors
+	var firstErr error
+	for _, backend := range backends {
+		configs, ok := s.configs[backend]
+		if !ok {
+			if firstErr == nil {
+				firstErr = fetchErrs[backend]
+			}
+			continue
+		}
+		result = append(result, configs...)
+		for _, config := range configs {
+			if config != nil {
+				sources[lookupKey{config.Name, config.Version}] = backend
+			}
+		}
+		parseErrs = append(parseErrs, s.parseErrs[backend]...)
+	}
+	if result == nil && firstErr != nil {
+		return nil, nil, firstErr
+	}
+	if parseErrs != nil {
+		return result, sources, parseErrs
+	}
+	return result, sources, nil
+}
+
+// Returns the API configurations of a config source and, if they were
+// gathered from the backends, the backend that reported each API.
+func readApiConfigs(src ConfigSource) ([]*endpoints.ApiDescriptor, map[lookupKey]string, error) {
+	if backendSrc, ok := src.(*backendsConfigSource); ok {
+		return backendSrc.apiConfigs()
+	}
+	configs, err := src.ApiConfigs()
+	return configs, nil, err
+}
+
+// Asks every backend for its configurations again. Returns true if any
+// of them changed.
+func (s *backendsConfigSource) refresh() bool {
+	_, changed := s.fetch(s.ed.backendURLs())
+	return changed
+}
+
+// Asks the given backends for their configurations in parallel and keeps
+// those reported. Returns the error of each backend that couldn't be
+// reached, and true if any of the configurations kept changed.
+func (s *backendsConfigSource) fetch(backends []string) (map[string]error, bool) {
+	if len(backends) == 0 {
+		return nil, false
+	}
+	transport := s.ed.spiTransport()
+	configs := make([][]*endpoints.ApiDescriptor, len(backends))
+	errs := make([]error, len(backends))
+	var wg sync.WaitGroup
+	for i, backend := range backends {
+		wg.Add(1)
+		go func(i int, backend string) {
+			defer wg.Done()
+			configs[i], errs[i] = (&backendConfigSource{backend, transport}).ApiConfigs()
+		}(i, backend)
+	}
+	wg.Wait()
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.configs == nil {
+		s.configs = make(map[string][]*endpoints.ApiDescriptor)
+		s.parseErrs = make(map[string]ConfigErrors)
+	}
+	fetchErrs := make(map[string]error)
+	changed := false
+	for i, backend := range backends {
+		backendErrs, ok := configErrors(errs[i])
+		if errs[i] != nil && !ok {
+			s.ed.backendHealth.record(backend, nil, errs[i])
+			fetchErrs[backend] = errs[i]
+			if _, ok := s.configs[backend]; ok {
+				s.ed.log().Warn("Using last API configs", "backend", backend, "error", errs[i])
+			}
+			continue
+		}
+		s.ed.backendHealth.record(backend, nil, nil)
+		last, ok := s.configs[backend]
+		if !ok || !reflect.DeepEqual(last, configs[i]) {
+			s.configs[backend] = configs[i]
+			changed = true
+		}
+		s.parseErrs[backend] = backendErrs
+	}
+	return fetchErrs, changed
+}
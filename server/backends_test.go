@@ -0,0 +1,191 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestBnsBackend(t *testing.T) {
+	assert.Equal(t, "http://localhost:8080", bnsBackend("http://localhost:8080/_ah/spi"))
+	assert.Equal(t, "http://localhost:8080", bnsBackend("http://localhost:8080/_ah/spi/"))
+	assert.Equal(t, "", bnsBackend(""))
+}
+
+func TestBackendHealth(t *testing.T) {
+	var h backendHealth
+	h.record("http://a", &http.Response{StatusCode: 200}, nil)
+	for i := 0; i < backendUnhealthyThreshold; i++ {
+		h.record("http://b", nil, errors.New("refused"))
+	}
+	h.record("http://c", &http.Response{StatusCode: 503, Status: "503 Service Unavailable"}, nil)
+
+	statuses := h.statuses()
+	if assert.Equal(t, 3, len(statuses)) {
+		assert.True(t, statuses[0].Healthy)
+		assert.False(t, statuses[1].Healthy)
+		assert.Equal(t, "refused", statuses[1].LastError)
+		assert.True(t, statuses[2].Healthy)
+		assert.Equal(t, 1, statuses[2].ConsecutiveFailures)
+	}
+
+	h.record("http://b", &http.Response{StatusCode: 404}, nil)
+	assert.True(t, h.statuses()[1].Healthy)
+}
+
+// Starts a backend serving the API config for the named API, whose
+// methods respond with the backend's name.
+func startNamedBackend(t *testing.T, name string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/_ah/spi/BackendService.getApiConfigs" {
+			config := buildSourceConfig(name)
+			config.Adapter.Bns = "https://example.com/_ah/spi"
+			configBytes, _ := json.Marshal(config)
+			body, _ := json.Marshal(map[string]interface{}{"items": []string{string(configBytes)}})
+			w.Write(body)
+			return
+		}
+		fmt.Fprintf(w, `{"backend": %q}`, name)
+	}))
+}
+
+func TestMultipleBackends(t *testing.T) {
+	a := startNamedBackend(t, "a_api")
+	defer a.Close()
+	b := startNamedBackend(t, "b_api")
+	u, _ := url.Parse(a.URL)
+	server := NewEndpointsServer(u)
+	u, _ = url.Parse(b.URL)
+	server.AddBackend(u)
+
+	get := func(path string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, buildRequest(path, "", nil))
+		return w
+	}
+	w := get("/_ah/api/a_api/v1/items/1")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"backend": "a_api"`)
+	w = get("/_ah/api/b_api/v1/items/1")
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"backend": "b_api"`)
+
+	// The Adapter.Bns reported by the backends is kept.
+	for _, config := range server.configManager.configs() {
+		if config.Name != "discovery" {
+			assert.Equal(t, "https://example.com/_ah/spi", config.Adapter.Bns)
+		}
+	}
+
+	// With a backend down, its last configs are kept on reload and the
+	// other backend is still served.
+	b.Close()
+	for i := 0; i < backendUnhealthyThreshold-1; i++ {
+		assert.NoError(t, server.ReloadApiConfigs())
+	}
+	w = get("/_ah/api/a_api/v1/items/1")
+	assert.Equal(t, 200, w.Code)
+	w = get("/_ah/api/b_api/v1/items/1")
+	assert.Equal(t, 500, w.Code)
+
+	statuses := server.BackendStatus()
+	if assert.Equal(t, 2, len(statuses)) {
+		for _, status := range statuses {
+			if status.URL == a.URL {
+				assert.Equal(t, 0, status.ConsecutiveFailures)
+			} else {
+				assert.Equal(t, b.URL, status.URL)
+				assert.Equal(t, backendUnhealthyThreshold, status.ConsecutiveFailures)
+				assert.False(t, status.Healthy)
+			}
+		}
+	}
+}
+
+func TestBackendConfigsKept(t *testing.T) {
+	fetches := 0
+	version := "v1"
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/_ah/spi/BackendService.getApiConfigs" {
+			fetches++
+			config := buildSourceConfig("a_api")
+			config.Version = version
+			configBytes, _ := json.Marshal(config)
+			body, _ := json.Marshal(map[string]interface{}{"items": []string{string(configBytes)}})
+			w.Write(body)
+			return
+		}
+		w.Write([]byte("{}"))
+	}))
+	defer backend.Close()
+	u, _ := url.Parse(backend.URL)
+	server := NewEndpointsServer(u)
+
+	get := func(path string) int {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, buildRequest(path, "", nil))
+		return w.Code
+	}
+	assert.Equal(t, 200, get("/_ah/api/a_api/v1/items/1"))
+	assert.Equal(t, 200, get("/_ah/api/a_api/v1/items/1"))
+	assert.Equal(t, 1, fetches)
+
+	// The backend is only asked again when the configs are refreshed.
+	version = "v2"
+	assert.Equal(t, 404, get("/_ah/api/a_api/v2/items/1"))
+	assert.True(t, server.backendSource.refresh())
+	assert.Equal(t, 2, fetches)
+	assert.Equal(t, 200, get("/_ah/api/a_api/v2/items/1"))
+	assert.False(t, server.backendSource.refresh())
+	assert.Equal(t, 3, fetches)
+}
+
+func TestLookupTarget(t *testing.T) {
+	reported := buildSourceConfig("a_api")
+	reported.Adapter.Bns = "https://example.com/_ah/spi"
+	named := buildSourceConfig("b_api")
+	named.Adapter.Bns = "http://b:8080/_ah/spi"
+	m := newApiConfigManager()
+	m.saveApiConfigs([]*endpoints.ApiDescriptor{reported, named},
+		map[lookupKey]string{{"a_api", "v1"}: "http://a:8080"})
+
+	// The backend that reported a configuration wins over its Adapter.Bns.
+	name, method, params, api, backend := m.lookupRestTarget("a_api/v1/items/1", "GET")
+	assert.Equal(t, "a_api.get", name)
+	assert.NotNil(t, method)
+	assert.Equal(t, "1", params["id"])
+	assert.Equal(t, lookupKey{"a_api", "v1"}, api)
+	assert.Equal(t, "http://a:8080", backend)
+
+	method, api, backend = m.lookupRpcTarget("b_api.get", "v1")
+	assert.NotNil(t, method)
+	assert.Equal(t, lookupKey{"b_api", "v1"}, api)
+	assert.Equal(t, "http://b:8080", backend)
+
+	method, api, backend = m.lookupRpcTarget("c_api.get", "v1")
+	assert.Nil(t, method)
+	assert.Equal(t, lookupKey{}, api)
+	assert.Equal(t, "", backend)
+}
@@ -0,0 +1,300 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Circuit breaking of failing SPI methods.
+//
+// Each method of each backend has its own breaker. After a number of
+// consecutive failed calls the breaker opens and calls to the method fail
+// immediately, rather than each waiting for the backend to time out.
+// Once the breaker has been open for a while it lets a few trial calls
+// through (half-open), closing again if they succeed.
+
+const (
+	defaultBreakerFailureThreshold = 5
+	defaultBreakerOpenFor          = 30 * time.Second
+	defaultBreakerHalfOpenCalls    = 1
+)
+
+// CircuitBreakerState is the state of a circuit breaker.
+type CircuitBreakerState int
+
+const (
+	// BreakerClosed lets all calls through.
+	BreakerClosed CircuitBreakerState = iota
+	// BreakerOpen fails calls without making them.
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of trial calls through.
+	BreakerHalfOpen
+)
+
+func (s CircuitBreakerState) String() string {
+	switch s {
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "closed"
+}
+
+func (s CircuitBreakerState) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// CircuitBreakerOptions configures the circuit breakers of SPI methods.
+// Zero fields take their default values.
+type CircuitBreakerOptions struct {
+	// Number of consecutive connection errors or 5xx responses after
+	// which a breaker opens. Defaults to 5.
+	FailureThreshold int
+
+	// Time a breaker stays open before letting trial calls through.
+	// Defaults to 30 seconds.
+	OpenFor time.Duration
+
+	// Number of trial calls let through while half-open. The breaker
+	// closes once they all succeed. Defaults to 1.
+	HalfOpenCalls int
+}
+
+// CircuitBreakerStatus describes the state of the circuit breaker of an
+// SPI method.
+type CircuitBreakerStatus struct {
+	Backend             string
+	Method              string // The RosyMethod called.
+	State               CircuitBreakerState
+	ConsecutiveFailures int
+	OpenedAt            time.Time // Zero while closed.
+}
+
+type breakerKey struct {
+	backend, method string
+}
+
+// The breaker of a single SPI method.
+type circuitBreaker struct {
+	state     CircuitBreakerState
+	failures  int
+	openedAt  time.Time
+	trials    int // Trial calls made while half-open.
+	successes int // Trial calls that succeeded.
+}
+
+// The circuit breakers of all SPI methods called.
+type circuitBreakers struct {
+	opts     *CircuitBreakerOptions // Breaking is disabled if nil.
+	breakers map[breakerKey]*circuitBreaker
+	lock     sync.Mutex
+	now      func() time.Time
+
+	// Logger of changes in state, or nil for the default.
+	logger Logger
+}
+
+func (b *circuitBreakers) timeNow() time.Time {
+	if b.now == nil {
+		return time.Now()
+	}
+	return b.now()
+}
+
+// Returns true if a call to the given method may be made. Every call
+// allowed must have its outcome passed to record.
+func (b *circuitBreakers) allow(key breakerKey) bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.opts == nil {
+		return true
+	}
+	cb, ok := b.breakers[key]
+	if !ok {
+		return true
+	}
+	switch cb.state {
+	case BreakerOpen:
+		if b.timeNow().Sub(cb.openedAt) < b.openFor() {
+			return false
+		}
+		loggerOrDefault(b.logger).Info("Circuit breaker is half-open",
+			"backend", key.backend, "method", key.method)
+		cb.state = BreakerHalfOpen
+		cb.trials = 0
+		cb.successes = 0
+		fallthrough
+	case BreakerHalfOpen:
+		if cb.trials >= b.halfOpenCalls() {
+			return false
+		}
+		cb.trials++
+	}
+	return true
+}
+
+// Records the outcome of a call allowed by allow. Connection errors and
+// 5xx responses count as failures. Abandoned calls, such as those whose
+// client went away, are not counted.
+func (b *circuitBreakers) record(key breakerKey, resp *http.Response, err error, abandoned bool) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	if b.opts == nil {
+		return
+	}
+	if b.breakers == nil {
+		b.breakers = make(map[breakerKey]*circuitBreaker)
+	}
+	cb, ok := b.breakers[key]
+	if !ok {
+		cb = &circuitBreaker{}
+		b.breakers[key] = cb
+	}
+	if abandoned {
+		if cb.state == BreakerHalfOpen && cb.trials > 0 {
+			cb.trials--
+		}
+		return
+	}
+	failed := err != nil || resp == nil || resp.StatusCode >= 500
+	switch cb.state {
+	case BreakerClosed:
+		if !failed {
+			cb.failures = 0
+			return
+		}
+		cb.failures++
+		if cb.failures >= b.failureThreshold() {
+			b.open(key, cb)
+		}
+	case BreakerHalfOpen:
+		if failed {
+			cb.failures++
+			b.open(key, cb)
+			return
+		}
+		cb.successes++
+		if cb.successes >= b.halfOpenCalls() {
+			loggerOrDefault(b.logger).Info("Circuit breaker is closed",
+				"backend", key.backend, "method", key.method)
+			cb.state = BreakerClosed
+			cb.failures = 0
+		}
+	case BreakerOpen:
+		// The call was made before the breaker opened.
+	}
+}
+
+// Opens a breaker. Must be called with the lock held.
+func (b *circuitBreakers) open(key breakerKey, cb *circuitBreaker) {
+	loggerOrDefault(b.logger).Warn("Circuit breaker is open",
+		"backend", key.backend, "method", key.method, "failures", cb.failures)
+	cb.state = BreakerOpen
+	cb.openedAt = b.timeNow()
+}
+
+func (b *circuitBreakers) failureThreshold() int {
+	if b.opts.FailureThreshold > 0 {
+		return b.opts.FailureThreshold
+	}
+	return defaultBreakerFailureThreshold
+}
+
+func (b *circuitBreakers) openFor() time.Duration {
+	if b.opts.OpenFor > 0 {
+		return b.opts.OpenFor
+	}
+	return defaultBreakerOpenFor
+}
+
+func (b *circuitBreakers) halfOpenCalls() int {
+	if b.opts.HalfOpenCalls > 0 {
+		return b.opts.HalfOpenCalls
+	}
+	return defaultBreakerHalfOpenCalls
+}
+
+// Returns the state of each breaker, ordered by backend and method.
+func (b *circuitBreakers) statuses() []CircuitBreakerStatus {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	result := make([]CircuitBreakerStatus, 0, len(b.breakers))
+	for key, cb := range b.breakers {
+		status := CircuitBreakerStatus{
+			Backend:             key.backend,
+			Method:              key.method,
+			State:               cb.state,
+			ConsecutiveFailures: cb.failures,
+		}
+		if cb.state != BreakerClosed {
+			status.OpenedAt = cb.openedAt
+		}
+		result = append(result, status)
+	}
+	sort.Sort(breakerStatusByKey(result))
+	return result
+}
+
+type breakerStatusByKey []CircuitBreakerStatus
+
+func (s breakerStatusByKey) Len() int      { return len(s) }
+func (s breakerStatusByKey) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s breakerStatusByKey) Less(i, j int) bool {
+	if s[i].Backend != s[j].Backend {
+		return s[i].Backend < s[j].Backend
+	}
+	return s[i].Method < s[j].Method
+}
+
+// Error returned for calls to a method whose circuit breaker is open.
+// It is reported to the client as a 503 backendError.
+type circuitOpenError struct {
+	backendError
+}
+
+func newCircuitOpenError(key breakerKey) *circuitOpenError {
+	return &circuitOpenError{backendError{
+		baseRequestError: newStatusError(http.StatusServiceUnavailable,
+			"Circuit breaker open for "+key.method),
+		errorInfo: backendErrorInfo,
+	}}
+}
+
+// SetCircuitBreaker enables circuit breaking of SPI methods with the
+// given options. Passing nil disables it, which is the default. The state
+// of any existing breakers is discarded.
+func (ed *EndpointsServer) SetCircuitBreaker(opts *CircuitBreakerOptions) {
+	ed.breakers.lock.Lock()
+	defer ed.breakers.lock.Unlock()
+	ed.breakers.opts = opts
+	ed.breakers.breakers = nil
+}
+
+// CircuitBreakerStatus returns the state of the circuit breaker of each
+// SPI method called since circuit breaking was enabled.
+func (ed *EndpointsServer) CircuitBreakerStatus() []CircuitBreakerStatus {
+	return ed.breakers.statuses()
+}
+
+// Handler for requests for the state of the circuit breakers. Responds
+// with a JSON list of CircuitBreakerStatus.
+func (ed *EndpointsServer) HandleCircuitBreakersRequest(w http.ResponseWriter, r *http.Request) {
+	writeAdminResponse(w, http.StatusOK, ed.CircuitBreakerStatus())
+}
@@ -0,0 +1,104 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakerStates(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := &circuitBreakers{
+		opts: &CircuitBreakerOptions{FailureThreshold: 2, OpenFor: time.Minute, HalfOpenCalls: 2},
+		now:  func() time.Time { return now },
+	}
+	key := breakerKey{"http://a", "MyApi.get"}
+	failed := errors.New("timeout")
+	ok := &http.Response{StatusCode: 200}
+
+	assert.True(t, b.allow(key))
+	b.record(key, nil, failed, false)
+	assert.True(t, b.allow(key))
+	b.record(key, nil, failed, false)
+	assert.False(t, b.allow(key))
+	assert.Equal(t, BreakerOpen, b.statuses()[0].State)
+
+	// Half-open lets two trial calls through; a failure reopens it.
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow(key))
+	assert.True(t, b.allow(key))
+	assert.False(t, b.allow(key))
+	assert.Equal(t, BreakerHalfOpen, b.statuses()[0].State)
+	b.record(key, ok, nil, false)
+	b.record(key, &http.Response{StatusCode: 500}, nil, false)
+	assert.False(t, b.allow(key))
+
+	// Abandoned trial calls don't count.
+	now = now.Add(time.Minute)
+	assert.True(t, b.allow(key))
+	assert.True(t, b.allow(key))
+	b.record(key, nil, failed, true)
+	b.record(key, ok, nil, false)
+	assert.Equal(t, BreakerHalfOpen, b.statuses()[0].State)
+	assert.True(t, b.allow(key))
+	b.record(key, ok, nil, false)
+	assert.Equal(t, BreakerClosed, b.statuses()[0].State)
+	assert.Equal(t, 0, b.statuses()[0].ConsecutiveFailures)
+}
+
+func TestCircuitBreakerDisabled(t *testing.T) {
+	var b circuitBreakers
+	key := breakerKey{"http://a", "MyApi.get"}
+	for i := 0; i < 2*defaultBreakerFailureThreshold; i++ {
+		assert.True(t, b.allow(key))
+		b.record(key, nil, errors.New("timeout"), false)
+	}
+	assert.Equal(t, 0, len(b.statuses()))
+}
+
+func TestCircuitBreakerFailsFast(t *testing.T) {
+	ts, calls := startFlakyBackend(100)
+	defer ts.Close()
+	server := newRetryServer(ts)
+	server.SetCircuitBreaker(&CircuitBreakerOptions{FailureThreshold: 2})
+
+	get := func() *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+		return w
+	}
+	// The retries of the first call open the breaker.
+	assert.Equal(t, 503, get().Code)
+	assert.Equal(t, 2, *calls)
+
+	w := get()
+	assert.Equal(t, 503, w.Code)
+	assert.Contains(t, w.Body.String(), "backendError")
+	assert.Contains(t, w.Body.String(), "Circuit breaker open for MyApi.get")
+	assert.Equal(t, 2, *calls)
+
+	mux := http.NewServeMux()
+	server.HandleAdmin(mux, "/_admin")
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, buildRequest("/_admin/breakers", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"Method": "MyApi.get"`)
+	assert.Contains(t, w.Body.String(), `"State": "open"`)
+}
@@ -0,0 +1,224 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Linting of API configurations.
+
+// Kinds of problem found in API configurations.
+const (
+	ConfigErrorParse          = "parse"           // The configuration can't be parsed.
+	ConfigErrorInvalidMethod  = "invalid_method"  // A method has no configuration.
+	ConfigErrorInvalidPath    = "invalid_path"    // A method's path can't be compiled.
+	ConfigErrorDuplicateApi   = "duplicate_api"   // An API name and version is configured more than once.
+	ConfigErrorDuplicateRoute = "duplicate_route" // Methods share a path and HTTP method.
+	ConfigErrorDuplicateRpc   = "duplicate_rpc"   // Methods in different APIs share a name and version.
+)
+
+// ConfigError describes a problem found in an API configuration.
+type ConfigError struct {
+	Kind    string // One of the ConfigError* kinds.
+	Source  string // The file or response item the configuration came from, if known.
+	Api     string // Name and version of the API, if known.
+	Method  string // Name of the method, for problems with a method.
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	parts := make([]string, 0, 4)
+	if e.Source != "" {
+		parts = append(parts, e.Source)
+	}
+	if e.Api != "" {
+		parts = append(parts, e.Api)
+	}
+	if e.Method != "" {
+		parts = append(parts, e.Method)
+	}
+	parts = append(parts, e.Message)
+	return strings.Join(parts, ": ")
+}
+
+// ConfigErrors is a list of the problems found in a set of API
+// configurations.
+type ConfigErrors []*ConfigError
+
+func (e ConfigErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d API config error(s): %s", len(e), strings.Join(messages, "; "))
+}
+
+// Returns the API configuration problems in err, if it is a ConfigErrors.
+func configErrors(err error) (ConfigErrors, bool) {
+	errs, ok := err.(ConfigErrors)
+	return errs, ok
+}
+
+// Matches the {variable} parts of a path pattern.
+var pathVariableRegexp = regexp.MustCompile(`{[^{}]*}`)
+
+// LintApiConfigs checks a set of API configurations for problems that
+// would stop their methods being served as configured. These are methods
+// without configurations, paths that can't be compiled, duplicated APIs,
+// methods that share a path and HTTP method, and methods in different
+// APIs that share a name and version. It returns nil if no problems are
+// found.
+func LintApiConfigs(configs []*endpoints.ApiDescriptor) ConfigErrors {
+	var errs ConfigErrors
+	apis := make(map[lookupKey]bool)
+	routes := make(map[string]string)      // "METHOD path" => "api: method"
+	rpcNames := make(map[lookupKey]string) // (method name, version) => API name
+	for i, config := range configs {
+		if config == nil {
+			errs = append(errs, &ConfigError{Kind: ConfigErrorParse,
+				Source: fmt.Sprintf("config %d", i), Message: "Empty API config"})
+			continue
+		}
+		api := config.Name + " " + config.Version
+		if apis[lookupKey{config.Name, config.Version}] {
+			errs = append(errs, &ConfigError{Kind: ConfigErrorDuplicateApi, Api: api,
+				Message: "API is configured more than once"})
+			continue
+		}
+		apis[lookupKey{config.Name, config.Version}] = true
+
+		methods, empty := configuredMethods(config.Methods)
+		for _, methodName := range empty {
+			errs = append(errs, &ConfigError{Kind: ConfigErrorInvalidMethod, Api: api,
+				Method: methodName, Message: "Method has no configuration"})
+		}
+		for _, methodInfo := range sortMethods(methods) {
+			methodName := methodInfo.methodName
+			method := methodInfo.apiMethod
+			if otherApi, ok := rpcNames[lookupKey{methodName, config.Version}]; ok {
+				errs = append(errs, &ConfigError{Kind: ConfigErrorDuplicateRpc, Api: api,
+					Method: methodName, Message: fmt.Sprintf("RPC method is also defined by %s %s",
+						otherApi, config.Version)})
+			} else {
+				rpcNames[lookupKey{methodName, config.Version}] = config.Name
+			}
+
+			pathPattern := config.Name + "/" + config.Version + "/" + method.Path
+			if _, err := compilePathPattern(pathPattern); err != nil {
+				errs = append(errs, &ConfigError{Kind: ConfigErrorInvalidPath, Api: api,
+					Method: methodName, Message: fmt.Sprintf("Invalid path %q: %s", method.Path, err.Error())})
+				continue
+			}
+			// Paths that differ only in their variable names match the
+			// same requests.
+			route := strings.ToUpper(method.HttpMethod) + " " +
+				pathVariableRegexp.ReplaceAllString(pathPattern, "{}")
+			if other, ok := routes[route]; ok {
+				errs = append(errs, &ConfigError{Kind: ConfigErrorDuplicateRoute, Api: api,
+					Method: methodName, Message: fmt.Sprintf("%s %s is also routed to %s",
+						strings.ToUpper(method.HttpMethod), pathPattern, other)})
+			} else {
+				routes[route] = api + ": " + methodName
+			}
+		}
+	}
+	return errs
+}
+
+// Separates the methods that have configurations from those that don't.
+// Returns the configured methods and the sorted names of the others.
+func configuredMethods(methods map[string]*endpoints.ApiMethod) (map[string]*endpoints.ApiMethod, []string) {
+	configured := make(map[string]*endpoints.ApiMethod, len(methods))
+	var empty []string
+	for name, method := range methods {
+		if method == nil {
+			empty = append(empty, name)
+		} else {
+			configured[name] = method
+		}
+	}
+	sort.Strings(empty)
+	return configured, empty
+}
+
+// Checks API configurations read from the config source, given the error
+// returned reading them. If the server is strict the configurations are
+// linted and an error is returned if any problems are found. Otherwise
+// configurations that couldn't be parsed are logged and ignored.
+func (ed *EndpointsServer) checkApiConfigs(configs []*endpoints.ApiDescriptor, err error) error {
+	errs, ok := configErrors(err)
+	if err != nil && !ok {
+		return err
+	}
+	if ed.strictConfigs {
+		errs = append(errs, LintApiConfigs(configs)...)
+		if len(errs) > 0 {
+			return errs
+		}
+		return nil
+	}
+	for _, configErr := range errs {
+		ed.log().Warn("Can not parse API config", "error", configErr)
+	}
+	return nil
+}
+
+// Outcome of checking the API configurations last returned by the config
+// source, so that they are only checked again, and their problems logged
+// again, once the source returns different configurations.
+type configCheck struct {
+	configs []*endpoints.ApiDescriptor
+	err     error
+	checked bool // Whether any configurations have been checked.
+	passed  bool // Whether any configurations have passed the check.
+	lock    sync.Mutex
+}
+
+// Reports whether two lists hold the same configurations, as a config
+// source returns while its configurations haven't changed.
+func sameConfigs(a, b []*endpoints.ApiDescriptor) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// LintApiConfigFiles reads the API configurations in the given .api files
+// and checks them with LintApiConfigs. Files that can't be read are
+// reported with an error. It is intended for checking configurations
+// before they are deployed.
+func LintApiConfigFiles(paths ...string) (ConfigErrors, error) {
+	configs, err := readApiConfigFiles(paths)
+	parseErrs, ok := configErrors(err)
+	if err != nil && !ok {
+		return nil, err
+	}
+	errs := append(parseErrs, LintApiConfigs(configs)...)
+	if len(errs) == 0 {
+		return nil, nil
+	}
+	return errs, nil
+}
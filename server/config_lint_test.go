@@ -0,0 +1,166 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Returns the kinds of the given errors.
+func configErrorKinds(errs ConfigErrors) []string {
+	kinds := make([]string, len(errs))
+	for i, err := range errs {
+		kinds[i] = err.Kind
+	}
+	return kinds
+}
+
+func TestLintApiConfigsValid(t *testing.T) {
+	errs := LintApiConfigs([]*endpoints.ApiDescriptor{buildSourceConfig("a_api"), buildSourceConfig("b_api")})
+	assert.Nil(t, errs)
+}
+
+func TestLintApiConfigs(t *testing.T) {
+	a := buildSourceConfig("a_api")
+	a.Methods["a_api.bad"] = &endpoints.ApiMethod{HttpMethod: "GET", Path: "bad/{1id}"}
+	a.Methods["a_api.empty"] = nil
+	a.Methods["a_api.other"] = &endpoints.ApiMethod{HttpMethod: "get", Path: "items/{key}"}
+	b := buildSourceConfig("b_api")
+	b.Methods["a_api.get"] = &endpoints.ApiMethod{HttpMethod: "POST", Path: "items"}
+
+	errs := LintApiConfigs([]*endpoints.ApiDescriptor{a, b, buildSourceConfig("a_api")})
+	assert.Equal(t, []string{
+		ConfigErrorInvalidMethod,
+		ConfigErrorInvalidPath,
+		ConfigErrorDuplicateRoute,
+		ConfigErrorDuplicateRpc,
+		ConfigErrorDuplicateApi,
+	}, configErrorKinds(errs))
+	assert.Equal(t, "a_api v1", errs[2].Api)
+	assert.Equal(t, "a_api.other", errs[2].Method)
+	assert.Equal(t, "a_api v1: a_api.other: GET a_api/v1/items/{key} is also routed to a_api v1: a_api.get",
+		errs[2].Error())
+}
+
+func TestParseApiConfigResponseErrors(t *testing.T) {
+	configs, err := parseApiConfigResponse(`{"items": ["{", 1, "{\"name\": \"a_api\"}"]}`)
+	errs, ok := configErrors(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, []string{ConfigErrorParse, ConfigErrorParse}, configErrorKinds(errs))
+		assert.Equal(t, "item 1", errs[1].Source)
+	}
+	if assert.Equal(t, 1, len(configs)) {
+		assert.Equal(t, "a_api", configs[0].Name)
+	}
+}
+
+func TestLintApiConfigFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_lint")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	good := filepath.Join(dir, "good.api")
+	writeApiConfigFile(t, good, buildSourceConfig("a_api"))
+	dup := filepath.Join(dir, "dup.api")
+	writeApiConfigFile(t, dup, buildSourceConfig("a_api"))
+	bad := filepath.Join(dir, "bad.api")
+	assert.NoError(t, ioutil.WriteFile(bad, []byte("{"), 0644))
+
+	errs, err := LintApiConfigFiles(good)
+	assert.NoError(t, err)
+	assert.Nil(t, errs)
+
+	errs, err = LintApiConfigFiles(good, bad, dup)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{ConfigErrorParse, ConfigErrorDuplicateApi}, configErrorKinds(errs))
+	assert.Equal(t, bad, errs[0].Source)
+
+	_, err = LintApiConfigFiles(filepath.Join(dir, "missing.api"))
+	assert.Error(t, err)
+}
+
+func TestStrictApiConfigs(t *testing.T) {
+	a := buildSourceConfig("a_api")
+	a.Methods["a_api.other"] = &endpoints.ApiMethod{HttpMethod: "GET", Path: "items/{key}"}
+	server := newEndpointsServer()
+	server.SetConfigSource(NewStaticConfigSource(a))
+	server.SetStrictApiConfigs(true)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 500, w.Code)
+	assert.Contains(t, w.Body.String(), "is also routed to")
+	assert.Nil(t, server.configManager.lookupRpcMethod("a_api.get", "v1"))
+
+	assert.Error(t, server.ReloadApiConfigs())
+
+	server.SetStrictApiConfigs(false)
+	assert.NoError(t, server.ReloadApiConfigs())
+	assert.NotNil(t, server.configManager.lookupRpcMethod("a_api.get", "v1"))
+}
+
+// Config source whose configurations can be replaced.
+type swapConfigSource struct {
+	configs []*endpoints.ApiDescriptor
+	err     error
+}
+
+func (s *swapConfigSource) ApiConfigs() ([]*endpoints.ApiDescriptor, error) {
+	return s.configs, s.err
+}
+
+func TestApiConfigsCheckedOnce(t *testing.T) {
+	var buf bytes.Buffer
+	u, _ := url.Parse(defaultURL)
+	server := NewEndpointsServer(u, WithLogger(newTestLogger(&buf)))
+	src := &swapConfigSource{
+		configs: []*endpoints.ApiDescriptor{buildSourceConfig("a_api")},
+		err:     ConfigErrors{{Kind: ConfigErrorParse, Source: "bad.api", Message: "unexpected EOF"}},
+	}
+	server.SetConfigSource(src)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, server.loadApiConfigs())
+	}
+	assert.Equal(t, 1, strings.Count(buf.String(), "Can not parse API config"))
+
+	// Once a strict server has loaded configurations, rejected ones are
+	// logged once and the last good ones are still served.
+	buf.Reset()
+	server.SetStrictApiConfigs(true)
+	src.err = nil
+	src.configs = []*endpoints.ApiDescriptor{buildSourceConfig("a_api")}
+	assert.NoError(t, server.loadApiConfigs())
+	bad := buildSourceConfig("b_api")
+	bad.Methods["b_api.other"] = &endpoints.ApiMethod{HttpMethod: "GET", Path: "items/{key}"}
+	src.configs = []*endpoints.ApiDescriptor{bad}
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, server.loadApiConfigs())
+	}
+	assert.Equal(t, 1, strings.Count(buf.String(), "API configs rejected"))
+	assert.NotNil(t, server.configManager.lookupRpcMethod("a_api.get", "v1"))
+	assert.Nil(t, server.configManager.lookupRpcMethod("b_api.get", "v1"))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/b_api/v1/items/1", "", nil))
+	assert.Equal(t, 404, w.Code)
+}
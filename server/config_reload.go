@@ -0,0 +1,184 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rwl/go-endpoints/endpoints"
+	"os"
+	"os/signal"
+	"reflect"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Reloading of API configurations.
+//
+// New configurations are parsed and validated in full before the method
+// tables are swapped, so a broken configuration never replaces a working
+// one.
+
+// Changes to the methods served after a reload, as "name version" strings.
+type configDiff struct {
+	added   []string
+	removed []string
+	changed []string
+}
+
+// Returns true if no methods were added, removed or changed.
+func (d *configDiff) empty() bool {
+	return len(d.added) == 0 && len(d.removed) == 0 && len(d.changed) == 0
+}
+
+func (d *configDiff) String() string {
+	if d.empty() {
+		return "no method changes"
+	}
+	parts := make([]string, 0, 3)
+	if len(d.added) > 0 {
+		parts = append(parts, "added: "+strings.Join(d.added, ", "))
+	}
+	if len(d.removed) > 0 {
+		parts = append(parts, "removed: "+strings.Join(d.removed, ", "))
+	}
+	if len(d.changed) > 0 {
+		parts = append(parts, "changed: "+strings.Join(d.changed, ", "))
+	}
+	return strings.Join(parts, "; ")
+}
+
+// Returns the differences between two RPC method tables.
+func diffMethods(before, after map[lookupKey]*endpoints.ApiMethod) *configDiff {
+	diff := &configDiff{}
+	for key, method := range after {
+		name := key.methodName + " " + key.version
+		if old, ok := before[key]; !ok {
+			diff.added = append(diff.added, name)
+		} else if !reflect.DeepEqual(old, method) {
+			diff.changed = append(diff.changed, name)
+		}
+	}
+	for key := range before {
+		if _, ok := after[key]; !ok {
+			diff.removed = append(diff.removed, key.methodName+" "+key.version)
+		}
+	}
+	sort.Strings(diff.added)
+	sort.Strings(diff.removed)
+	sort.Strings(diff.changed)
+	return diff
+}
+
+// Validates the given API configurations and, if they are all valid,
+// atomically replaces the current configurations and method tables with
+// them. Returns the changes made to the methods served.
+func (m *apiConfigManager) replaceApiConfigs(configs []*endpoints.ApiDescriptor, sources map[lookupKey]string) (*configDiff, error) {
+	m.configLock.Lock()
+	converted := m.convertedConfigs(configs)
+	convertedSources := m.convertedSources(sources)
+	m.configLock.Unlock()
+	next := newApiConfigManager()
+	if errs := next.registerApiConfigs(converted, convertedSources); len(errs) > 0 {
+		return nil, errs[0]
+	}
+	return m.swapTables(next, configs, sources), nil
+}
+
+// ReloadApiConfigs reads the API configurations from the config source
+// again and, if they are valid, replaces the configurations served. Files
+// read by file and directory sources are read afresh, and the backends
+// are asked for their configurations again. If the new configurations
+// can't all be parsed, or are invalid, the current ones are kept and the
+// error is returned.
+func (ed *EndpointsServer) ReloadApiConfigs() error {
+	if backendSrc, ok := ed.apiConfigSource().(*backendsConfigSource); ok {
+		backendSrc.refresh()
+	}
+	return ed.reloadApiConfigs()
+}
+
+// Replaces the configurations served with those of the config source, as
+// ReloadApiConfigs does, without first refreshing those of the backends.
+func (ed *EndpointsServer) reloadApiConfigs() error {
+	src := ed.apiConfigSource()
+	var configs []*endpoints.ApiDescriptor
+	var sources map[lookupKey]string
+	var stamp string
+	var readErr error
+	fileSrc, isFileSrc := src.(*fileConfigSource)
+	if isFileSrc {
+		configs, stamp, readErr = fileSrc.read()
+	} else {
+		configs, sources, readErr = readApiConfigs(src)
+	}
+	// Configurations that can't be parsed are never dropped on reload.
+	err := readErr
+	if err == nil {
+		err = ed.checkApiConfigs(configs, nil)
+	}
+	if err == nil {
+		if !ed.strictConfigs {
+			for _, configErr := range LintApiConfigs(configs) {
+				ed.log().Warn("API config problem", "error", configErr)
+			}
+		}
+		var diff *configDiff
+		if diff, err = ed.configManager.replaceApiConfigs(configs, sources); err == nil {
+			if isFileSrc {
+				fileSrc.store(configs, stamp)
+			}
+			ed.configRefreshed(nil)
+			ed.log().Info("Reloaded API configs", "changes", diff.String())
+			return nil
+		}
+	}
+	ed.configRefreshed(err)
+	ed.log().Error("API configs not reloaded", "error", err)
+	return err
+}
+
+// WatchApiConfigs reloads the API configurations whenever the process
+// receives SIGHUP and, for file and directory config sources, whenever
+// the files change, or otherwise whenever the configurations reported by
+// the backends change. Files are checked for changes, and the backends
+// asked for their configurations, at the given interval.
+// It blocks until stop is closed.
+func (ed *EndpointsServer) WatchApiConfigs(interval time.Duration, stop <-chan struct{}) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-hup:
+			ed.ReloadApiConfigs()
+		case <-ticker.C:
+			switch src := ed.apiConfigSource().(type) {
+			case *fileConfigSource:
+				if src.modified() {
+					ed.reloadApiConfigs()
+				}
+			case *backendsConfigSource:
+				if src.refresh() {
+					ed.reloadApiConfigs()
+				}
+			}
+		}
+	}
+}
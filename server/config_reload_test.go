@@ -0,0 +1,121 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReplaceApiConfigs(t *testing.T) {
+	m := newApiConfigManager()
+	diff, err := m.replaceApiConfigs([]*endpoints.ApiDescriptor{buildSourceConfig("a_api")}, nil)
+	assert.NoError(t, err)
+	assert.Contains(t, diff.String(), "added: a_api.get v1")
+	assert.NotNil(t, m.lookupRpcMethod("a_api.get", "v1"))
+
+	changed := buildSourceConfig("a_api")
+	changed.Methods["a_api.get"].Path = "things/{id}"
+	diff, err = m.replaceApiConfigs([]*endpoints.ApiDescriptor{changed, buildSourceConfig("b_api")}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"b_api.get v1"}, diff.added)
+	assert.Equal(t, []string{"a_api.get v1"}, diff.changed)
+	assert.Empty(t, diff.removed)
+	assert.Equal(t, "added: b_api.get v1; changed: a_api.get v1", diff.String())
+
+	diff, err = m.replaceApiConfigs([]*endpoints.ApiDescriptor{buildSourceConfig("b_api")}, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a_api.get v1"}, diff.removed)
+	assert.Nil(t, m.lookupRpcMethod("a_api.get", "v1"))
+	name, _, _ := m.lookupRestMethod("a_api/v1/things/1", "GET")
+	assert.Equal(t, "", name)
+}
+
+func TestReplaceApiConfigsInvalid(t *testing.T) {
+	m := newApiConfigManager()
+	_, err := m.replaceApiConfigs([]*endpoints.ApiDescriptor{buildSourceConfig("a_api")}, nil)
+	assert.NoError(t, err)
+
+	broken := buildSourceConfig("b_api")
+	broken.Methods["b_api.get"].Path = "items/{1id}"
+	_, err = m.replaceApiConfigs([]*endpoints.ApiDescriptor{broken}, nil)
+	assert.Error(t, err)
+
+	// The working configuration is kept.
+	assert.NotNil(t, m.lookupRpcMethod("a_api.get", "v1"))
+	assert.Nil(t, m.lookupRpcMethod("b_api.get", "v1"))
+	name, _, _ := m.lookupRestMethod("a_api/v1/items/1", "GET")
+	assert.Equal(t, "a_api.get", name)
+}
+
+func TestReloadApiConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_reload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeApiConfigFile(t, filepath.Join(dir, "a.api"), buildSourceConfig("a_api"))
+
+	server := newEndpointsServer()
+	server.SetConfigSource(NewDirConfigSource(dir))
+	assert.NoError(t, server.ReloadApiConfigs())
+	assert.NotNil(t, server.configManager.lookupRpcMethod("a_api.get", "v1"))
+
+	writeApiConfigFile(t, filepath.Join(dir, "b.api"), buildSourceConfig("b_api"))
+	assert.NoError(t, server.ReloadApiConfigs())
+	assert.NotNil(t, server.configManager.lookupRpcMethod("b_api.get", "v1"))
+
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "c.api"), []byte("{"), 0644))
+	assert.Error(t, server.ReloadApiConfigs())
+	assert.NotNil(t, server.configManager.lookupRpcMethod("b_api.get", "v1"))
+	configs, err := server.apiConfigSource().ApiConfigs()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, len(configs))
+}
+
+func TestWatchApiConfigs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_reload")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "a.api")
+	writeApiConfigFile(t, path, buildSourceConfig("a_api"))
+
+	server := newEndpointsServer()
+	server.SetConfigSource(NewFileConfigSource(path))
+	assert.NoError(t, server.ReloadApiConfigs())
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		server.WatchApiConfigs(10*time.Millisecond, stop)
+		close(done)
+	}()
+
+	config := buildSourceConfig("a_api")
+	config.Methods["a_api.list"] = &endpoints.ApiMethod{HttpMethod: "GET", Path: "items", RosyMethod: "MyApi.list"}
+	writeApiConfigFile(t, path, config)
+	modTime := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(path, modTime, modTime))
+
+	for i := 0; i < 100 && server.configManager.lookupRpcMethod("a_api.list", "v1") == nil; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotNil(t, server.configManager.lookupRpcMethod("a_api.list", "v1"))
+	close(stop)
+	<-done
+}
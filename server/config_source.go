@@ -0,0 +1,253 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Extension of API configuration files.
+const apiConfigExt = ".api"
+
+// ConfigSource supplies the API configurations served by an
+// EndpointsServer. It is consulted before each API request is dispatched.
+type ConfigSource interface {
+	// Returns the current API configurations. If some of the
+	// configurations can't be parsed, those that can are returned with a
+	// ConfigErrors error describing the others.
+	ApiConfigs() ([]*endpoints.ApiDescriptor, error)
+}
+
+// Config source that calls BackendService.getApiConfigs on the backend.
+type backendConfigSource struct {
+	url       string
+	transport SpiTransport // If nil, requests are made over HTTP.
+}
+
+// NewBackendConfigSource returns a ConfigSource that fetches the API
+// configurations from the BackendService.getApiConfigs method of the
+// backend at the given URL. This is the default source of an
+// EndpointsServer.
+func NewBackendConfigSource(u *url.URL) ConfigSource {
+	return &backendConfigSource{url: u.String()}
+}
+
+// NewBackendConfigSourceTransport returns a ConfigSource that fetches the
+// API configurations from the backend at the given URL, as
+// NewBackendConfigSource does, sending its requests with the given
+// transport, such as one using the TLS configuration of the backend.
+func NewBackendConfigSourceTransport(u *url.URL, t SpiTransport) ConfigSource {
+	return &backendConfigSource{url: u.String(), transport: t}
+}
+
+// Makes a call to the BackendService.getApiConfigs endpoint and parses
+// the result.
+func (s *backendConfigSource) ApiConfigs() ([]*endpoints.ApiDescriptor, error) {
+	req, err := http.NewRequest("POST",
+		s.url+"/_ah/spi/BackendService.getApiConfigs",
+		ioutil.NopCloser(bytes.NewBufferString("{}")))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+	transport := s.transport
+	if transport == nil {
+		transport = NewHttpSpiTransport(nil)
+	}
+	resp, err := transport.RoundTrip(req)
+	if err != nil {
+		return nil, fmt.Errorf("BackendService.getApiConfigs error: %s", err.Error())
+	}
+	defer resp.Body.Close()
+	if err = verifyResponse(resp, 200, "application/json"); err != nil {
+		return nil, fmt.Errorf("BackendService.getApiConfigs handling error: %s", err.Error())
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("BackendService.getApiConfigs handling error: %s", err.Error())
+	}
+	configs, err := parseApiConfigResponse(string(body))
+	if _, ok := configErrors(err); err != nil && !ok {
+		return nil, fmt.Errorf("BackendService.getApiConfigs handling error: %s", err.Error())
+	}
+	return configs, err
+}
+
+// Config source holding a fixed set of API configurations.
+type staticConfigSource struct {
+	configs []*endpoints.ApiDescriptor
+}
+
+// NewStaticConfigSource returns a ConfigSource that always supplies the
+// given API configurations.
+func NewStaticConfigSource(configs ...*endpoints.ApiDescriptor) ConfigSource {
+	return &staticConfigSource{configs: configs}
+}
+
+func (s *staticConfigSource) ApiConfigs() ([]*endpoints.ApiDescriptor, error) {
+	return s.configs, nil
+}
+
+// Config source that reads API configurations from .api files. The files
+// are read when the configurations are first requested and again when
+// they are reloaded.
+type fileConfigSource struct {
+	paths func() ([]string, error)
+
+	configs []*endpoints.ApiDescriptor
+	errs    error  // Problems parsing the files that configs were read from.
+	stamp   string // Identifies the state of the files that configs were read from.
+	lock    sync.Mutex
+}
+
+// NewFileConfigSource returns a ConfigSource that reads API
+// configurations from the given .api files, each containing the JSON
+// configuration of a single API.
+func NewFileConfigSource(paths ...string) ConfigSource {
+	return &fileConfigSource{paths: func() ([]string, error) {
+		return paths, nil
+	}}
+}
+
+// NewDirConfigSource returns a ConfigSource that reads API configurations
+// from all of the .api files in the given directory.
+func NewDirConfigSource(dir string) ConfigSource {
+	return &fileConfigSource{paths: func() ([]string, error) {
+		return apiConfigFiles(dir)
+	}}
+}
+
+func (s *fileConfigSource) ApiConfigs() ([]*endpoints.ApiDescriptor, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if s.configs != nil {
+		return s.configs, s.errs
+	}
+	configs, stamp, err := s.read()
+	if _, ok := configErrors(err); err != nil && !ok {
+		return nil, err
+	}
+	s.configs, s.errs, s.stamp = configs, err, stamp
+	return configs, err
+}
+
+// Reads the API configurations from the files, without storing them.
+// Returns the configurations and the stamp of the files they were read
+// from. Parse errors are returned as by ApiConfigs.
+func (s *fileConfigSource) read() ([]*endpoints.ApiDescriptor, string, error) {
+	paths, err := s.paths()
+	if err != nil {
+		return nil, "", err
+	}
+	stamp, err := fileStamp(paths)
+	if err != nil {
+		return nil, "", err
+	}
+	configs, err := readApiConfigFiles(paths)
+	if _, ok := configErrors(err); err != nil && !ok {
+		return nil, "", err
+	}
+	return configs, stamp, err
+}
+
+// Stores configurations returned by read, once they have been accepted.
+func (s *fileConfigSource) store(configs []*endpoints.ApiDescriptor, stamp string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.configs, s.errs, s.stamp = configs, nil, stamp
+}
+
+// Returns true if the files have changed since the configurations were
+// last stored.
+func (s *fileConfigSource) modified() bool {
+	paths, err := s.paths()
+	if err != nil {
+		return false
+	}
+	stamp, err := fileStamp(paths)
+	if err != nil {
+		// A file may be part way through being replaced.
+		return false
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return stamp != s.stamp
+}
+
+// Returns a string that changes whenever one of the files is modified,
+// added or removed.
+func fileStamp(paths []string) (string, error) {
+	var stamp bytes.Buffer
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&stamp, "%s %d %d\n", path, info.ModTime().UnixNano(), info.Size())
+	}
+	return stamp.String(), nil
+}
+
+// Returns the paths of the .api files in a directory, in name order.
+func apiConfigFiles(dir string) ([]string, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(infos))
+	for _, info := range infos {
+		if !info.IsDir() && filepath.Ext(info.Name()) == apiConfigExt {
+			paths = append(paths, filepath.Join(dir, info.Name()))
+		}
+	}
+	sort.Strings(paths)
+	return paths, nil
+}
+
+// Reads and parses the API configuration in each of the given files. If
+// some of the files can't be parsed, the configurations that can are
+// returned with a ConfigErrors error describing the others.
+func readApiConfigFiles(paths []string) ([]*endpoints.ApiDescriptor, error) {
+	configs := make([]*endpoints.ApiDescriptor, 0, len(paths))
+	var errs ConfigErrors
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		var config *endpoints.ApiDescriptor
+		if err = json.Unmarshal(data, &config); err != nil {
+			errs = append(errs, &ConfigError{Kind: ConfigErrorParse, Source: path, Message: err.Error()})
+		} else if config == nil {
+			errs = append(errs, &ConfigError{Kind: ConfigErrorParse, Source: path, Message: "Empty API config"})
+		} else {
+			configs = append(configs, config)
+		}
+	}
+	if errs != nil {
+		return configs, errs
+	}
+	return configs, nil
+}
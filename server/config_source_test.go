@@ -0,0 +1,146 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func buildSourceConfig(name string) *endpoints.ApiDescriptor {
+	return &endpoints.ApiDescriptor{
+		Name:    name,
+		Version: "v1",
+		Methods: map[string]*endpoints.ApiMethod{
+			name + ".get": &endpoints.ApiMethod{
+				HttpMethod: "GET",
+				Path:       "items/{id}",
+				RosyMethod: "MyApi.get",
+			},
+		},
+	}
+}
+
+// Write the JSON of an API config to a file.
+func writeApiConfigFile(t *testing.T, path string, config *endpoints.ApiDescriptor) {
+	data, err := json.Marshal(config)
+	assert.NoError(t, err)
+	assert.NoError(t, ioutil.WriteFile(path, data, 0644))
+}
+
+func TestStaticConfigSource(t *testing.T) {
+	config := buildSourceConfig("static_api")
+	configs, err := NewStaticConfigSource(config).ApiConfigs()
+	assert.NoError(t, err)
+	assert.Equal(t, []*endpoints.ApiDescriptor{config}, configs)
+}
+
+func TestFileConfigSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_source")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "file.api")
+	writeApiConfigFile(t, path, buildSourceConfig("file_api"))
+
+	src := NewFileConfigSource(path)
+	configs, err := src.ApiConfigs()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(configs)) {
+		assert.Equal(t, "file_api", configs[0].Name)
+		assert.Equal(t, "items/{id}", configs[0].Methods["file_api.get"].Path)
+	}
+
+	// The files are only read once.
+	assert.NoError(t, os.Remove(path))
+	configs, err = src.ApiConfigs()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, len(configs))
+
+	_, err = NewFileConfigSource(path).ApiConfigs()
+	assert.Error(t, err)
+}
+
+func TestFileConfigSourceParseError(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_source")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "bad.api")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("{"), 0644))
+
+	_, err = NewFileConfigSource(path).ApiConfigs()
+	assert.Error(t, err)
+}
+
+func TestDirConfigSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "config_source")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	writeApiConfigFile(t, filepath.Join(dir, "b.api"), buildSourceConfig("b_api"))
+	writeApiConfigFile(t, filepath.Join(dir, "a.api"), buildSourceConfig("a_api"))
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "README"), []byte("x"), 0644))
+
+	configs, err := NewDirConfigSource(dir).ApiConfigs()
+	assert.NoError(t, err)
+	if assert.Equal(t, 2, len(configs)) {
+		assert.Equal(t, "a_api", configs[0].Name)
+		assert.Equal(t, "b_api", configs[1].Name)
+	}
+}
+
+func TestBackendConfigSource(t *testing.T) {
+	ts := prepareTestServer(t, buildSourceConfig("backend_api"))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	configs, err := NewBackendConfigSource(u).ApiConfigs()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(configs)) {
+		assert.Equal(t, "backend_api", configs[0].Name)
+	}
+	// The configs are fetched with the transport given.
+	u, _ = url.Parse("http://in-process")
+	configs, err = NewBackendConfigSourceTransport(u, NewHandlerSpiTransport(newSpiHandler())).ApiConfigs()
+	assert.NoError(t, err)
+	if assert.Equal(t, 1, len(configs)) {
+		assert.Equal(t, "a_api", configs[0].Name)
+	}
+}
+
+func TestServeWithConfigSource(t *testing.T) {
+	// The SPI backend doesn't serve getApiConfigs.
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_ah/spi/MyApi.get", r.URL.Path)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"some": "response"}`)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	server.SetConfigSource(NewStaticConfigSource(buildSourceConfig("static_api")))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/static_api/v1/items/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"some": "response"`)
+}
@@ -100,7 +100,7 @@ func generateDiscoveryDirectory(apiConfigs []string) (string, error) {
 // Returns static content via a GET request. Takes the URL path after the
 // domain and returns a Response from the static proxy host and the response
 // body.
-var getStaticFile = func(path string) (*http.Response, string, error) {
+func getStaticFile(path string) (*http.Response, string, error) {
 	resp, err := http.Get(staticProxyHost + path)
 	if err != nil {
 		return nil, "", err
@@ -18,7 +18,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"github.com/rwl/go-endpoints/endpoints"
-	"log"
 	"net/http"
 )
 
@@ -77,7 +76,7 @@ func sendSuccessResponse(response string, w http.ResponseWriter) string {
 
 // Sends back HTTP response with API directory. It will return
 // the discovery doc for the requested api/version.
-func (ds *discoveryService) getRpcOrRest(apiFormat apiFormat, request *apiRequest, w http.ResponseWriter) string {
+func (ds *discoveryService) getRpcOrRest(apiFormat apiFormat, request *ApiRequest, w http.ResponseWriter) string {
 	api, ok := request.bodyJson["api"]
 	version, _ := request.bodyJson["version"]
 	apiStr, _ := api.(string)
@@ -85,14 +84,14 @@ func (ds *discoveryService) getRpcOrRest(apiFormat apiFormat, request *apiReques
 	lookupKey := lookupKey{apiStr, versionStr}
 	apiConfig, ok := ds.configManager.configs()[lookupKey]
 	if !ok {
-		log.Printf("No discovery doc for version %s of api %s", version, api)
+		ds.configManager.log().Debug("No discovery doc", "api", apiStr, "version", versionStr)
 		return sendNotFoundResponse(w, nil)
 	}
 	doc, err := generateDiscoveryDoc(apiConfig, apiFormat)
 	if err != nil {
 		errorMsg := fmt.Sprintf(`Failed to convert .api to discovery doc for version "%s" of api "%s": %s`, version, api, err.Error())
-		log.Println(errorMsg)
-		return sendErrorResponse(errorMsg, w, nil)
+		ds.configManager.log().Warn(errorMsg)
+		return sendErrorResponse(errorMsg, RequestId(request.Context()), w, nil)
 	}
 	return sendSuccessResponse(doc, w)
 }
@@ -104,7 +103,7 @@ func (ds *discoveryService) list(w http.ResponseWriter) string {
 		if apiConfig != discoveryApiConfig {
 			ac, err := json.Marshal(apiConfig)
 			if err != nil {
-				log.Printf("Failed to marshal API config: %v", apiConfig)
+				ds.configManager.log().Warn("Failed to marshal API config", "error", err)
 				return sendNotFoundResponse(w, nil)
 			}
 			apiConfigs = append(apiConfigs, string(ac))
@@ -112,7 +111,7 @@ func (ds *discoveryService) list(w http.ResponseWriter) string {
 	}
 	directory, err := generateDiscoveryDirectory(apiConfigs)
 	if err != nil {
-		log.Printf("Failed to get API directory: %s", err.Error())
+		ds.configManager.log().Warn("Failed to get API directory", "error", err)
 		// By returning a 404, code explorer still works if you select the
 		// API in the URL
 		return sendNotFoundResponse(w, nil)
@@ -122,7 +121,7 @@ func (ds *discoveryService) list(w http.ResponseWriter) string {
 
 // Returns the result of a discovery service request and false if the request
 // wasn't handled by discoveryService.
-func (ds *discoveryService) handleDiscoveryRequest(path string, request *apiRequest, w http.ResponseWriter) (string, bool) {
+func (ds *discoveryService) handleDiscoveryRequest(path string, request *ApiRequest, w http.ResponseWriter) (string, bool) {
 	switch path {
 	case getRestApi:
 		return ds.getRpcOrRest(rest, request, w), true
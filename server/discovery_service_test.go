@@ -23,7 +23,7 @@ import (
 	"testing"
 )
 
-func commonSetup() (*apiConfigManager, *apiRequest, *discoveryService) {
+func commonSetup() (*apiConfigManager, *ApiRequest, *discoveryService) {
 	apiConfigMap := map[string]interface{}{"items": []string{apiConfigJson}}
 	apiConfigManager := newApiConfigManager()
 	apiConfig, _ := json.Marshal(apiConfigMap)
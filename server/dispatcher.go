@@ -0,0 +1,174 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"github.com/rwl/go-endpoints/endpoints"
+	"net/http"
+)
+
+// Replaceable stages of request handling.
+//
+// Each EndpointsServer holds its own implementation of each stage, so
+// that servers in the same process don't affect each other. The stages
+// are passed the server so that an implementation can wrap the default
+// one.
+
+// Dispatcher sends a parsed API request to the SPI and writes the
+// response, returning the response body written.
+type Dispatcher interface {
+	Dispatch(ed *EndpointsServer, w http.ResponseWriter, origRequest *ApiRequest) (string, error)
+}
+
+// DispatcherFunc adapts a function to a Dispatcher.
+type DispatcherFunc func(ed *EndpointsServer, w http.ResponseWriter, origRequest *ApiRequest) (string, error)
+
+func (f DispatcherFunc) Dispatch(ed *EndpointsServer, w http.ResponseWriter, origRequest *ApiRequest) (string, error) {
+	return f(ed, w, origRequest)
+}
+
+// NewDefaultDispatcher returns the Dispatcher that looks up the method of
+// a request, transforms it and calls the method on the SPI.
+func NewDefaultDispatcher() Dispatcher {
+	return DispatcherFunc(callSpi)
+}
+
+// SpiUrlBuilder returns the URL that a transformed request is posted to.
+type SpiUrlBuilder interface {
+	SpiUrl(ed *EndpointsServer, spiRequest *ApiRequest) string
+}
+
+// SpiUrlBuilderFunc adapts a function to a SpiUrlBuilder.
+type SpiUrlBuilderFunc func(ed *EndpointsServer, spiRequest *ApiRequest) string
+
+func (f SpiUrlBuilderFunc) SpiUrl(ed *EndpointsServer, spiRequest *ApiRequest) string {
+	return f(ed, spiRequest)
+}
+
+// NewDefaultSpiUrlBuilder returns the SpiUrlBuilder that posts requests
+// to /_ah/spi/<RosyMethod> on the backend, or replica, serving the
+// method.
+func NewDefaultSpiUrlBuilder() SpiUrlBuilder {
+	return SpiUrlBuilderFunc(buildSpiUrl)
+}
+
+// ResponseHandler transforms the SPI's response to a request and writes
+// it, returning the response body written.
+type ResponseHandler interface {
+	HandleSpiResponse(ed *EndpointsServer, origRequest, spiRequest *ApiRequest, response *http.Response,
+		methodConfig *endpoints.ApiMethod, w http.ResponseWriter) (string, error)
+}
+
+// ResponseHandlerFunc adapts a function to a ResponseHandler.
+type ResponseHandlerFunc func(ed *EndpointsServer, origRequest, spiRequest *ApiRequest, response *http.Response,
+	methodConfig *endpoints.ApiMethod, w http.ResponseWriter) (string, error)
+
+func (f ResponseHandlerFunc) HandleSpiResponse(ed *EndpointsServer, origRequest, spiRequest *ApiRequest, response *http.Response,
+	methodConfig *endpoints.ApiMethod, w http.ResponseWriter) (string, error) {
+	return f(ed, origRequest, spiRequest, response, methodConfig, w)
+}
+
+// NewDefaultResponseHandler returns the ResponseHandler that writes SPI
+// responses in the REST or JSON-RPC format of the original request.
+func NewDefaultResponseHandler() ResponseHandler {
+	return ResponseHandlerFunc(handleSpiResponse)
+}
+
+// StaticContent supplies the files served under /static. It returns the
+// response for the file at the given URL path and its body.
+type StaticContent interface {
+	GetStaticFile(path string) (*http.Response, string, error)
+}
+
+// StaticContentFunc adapts a function to a StaticContent.
+type StaticContentFunc func(path string) (*http.Response, string, error)
+
+func (f StaticContentFunc) GetStaticFile(path string) (*http.Response, string, error) {
+	return f(path)
+}
+
+// NewDefaultStaticContent returns the StaticContent that fetches files
+// from the static proxy host.
+func NewDefaultStaticContent() StaticContent {
+	return StaticContentFunc(getStaticFile)
+}
+
+// ServerOption configures an EndpointsServer when it is created.
+type ServerOption func(ed *EndpointsServer)
+
+// WithDispatcher sets the server's Dispatcher.
+func WithDispatcher(d Dispatcher) ServerOption {
+	return func(ed *EndpointsServer) { ed.SetDispatcher(d) }
+}
+
+// WithSpiUrlBuilder sets the server's SpiUrlBuilder.
+func WithSpiUrlBuilder(b SpiUrlBuilder) ServerOption {
+	return func(ed *EndpointsServer) { ed.SetSpiUrlBuilder(b) }
+}
+
+// WithResponseHandler sets the server's ResponseHandler.
+func WithResponseHandler(h ResponseHandler) ServerOption {
+	return func(ed *EndpointsServer) { ed.SetResponseHandler(h) }
+}
+
+// WithStaticContent sets the server's StaticContent.
+func WithStaticContent(c StaticContent) ServerOption {
+	return func(ed *EndpointsServer) { ed.SetStaticContent(c) }
+}
+
+// WithSpiTransport sets the server's SpiTransport.
+func WithSpiTransport(t SpiTransport) ServerOption {
+	return func(ed *EndpointsServer) { ed.SetSpiTransport(t) }
+}
+
+// SetDispatcher sets the Dispatcher that API requests are passed to.
+// Passing nil restores the default. It must not be called while the
+// server is serving requests.
+func (ed *EndpointsServer) SetDispatcher(d Dispatcher) {
+	if d == nil {
+		d = NewDefaultDispatcher()
+	}
+	ed.dispatcher = d
+}
+
+// SetSpiUrlBuilder sets the SpiUrlBuilder that chooses where SPI requests
+// are posted. Passing nil restores the default. It must not be called
+// while the server is serving requests.
+func (ed *EndpointsServer) SetSpiUrlBuilder(b SpiUrlBuilder) {
+	if b == nil {
+		b = NewDefaultSpiUrlBuilder()
+	}
+	ed.spiUrlBuilder = b
+}
+
+// SetResponseHandler sets the ResponseHandler that writes SPI responses.
+// Passing nil restores the default. It must not be called while the
+// server is serving requests.
+func (ed *EndpointsServer) SetResponseHandler(h ResponseHandler) {
+	if h == nil {
+		h = NewDefaultResponseHandler()
+	}
+	ed.responseHandler = h
+}
+
+// SetStaticContent sets the StaticContent served under /static. Passing
+// nil restores the default. It must not be called while the server is
+// serving requests.
+func (ed *EndpointsServer) SetStaticContent(c StaticContent) {
+	if c == nil {
+		c = NewDefaultStaticContent()
+	}
+	ed.staticContent = c
+}
@@ -0,0 +1,79 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Test that servers in the same process keep their own stages.
+func TestServersHaveOwnDispatchers(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(newSpiHandler())
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	custom := NewEndpointsServer(u, WithDispatcher(DispatcherFunc(
+		func(ed *EndpointsServer, w http.ResponseWriter, origRequest *ApiRequest) (string, error) {
+			fmt.Fprint(w, "custom")
+			return "custom", nil
+		})))
+	plain := NewEndpointsServer(u)
+
+	w := httptest.NewRecorder()
+	custom.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, "custom", w.Body.String())
+
+	w = httptest.NewRecorder()
+	plain.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `{\"id\":\"1\"}`)
+}
+
+// Test that a stage can wrap the default implementation.
+func TestWrapDefaultResponseHandler(t *testing.T) {
+	t.Parallel()
+	ts := httptest.NewServer(newSpiHandler())
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	var methods []string
+	defaultHandler := NewDefaultResponseHandler()
+	server := NewEndpointsServer(u, WithResponseHandler(ResponseHandlerFunc(
+		func(ed *EndpointsServer, origRequest, spiRequest *ApiRequest, response *http.Response,
+			methodConfig *endpoints.ApiMethod, w http.ResponseWriter) (string, error) {
+			methods = append(methods, methodConfig.RosyMethod)
+			w.Header().Set("X-Wrapped", "true")
+			return defaultHandler.HandleSpiResponse(ed, origRequest, spiRequest, response, methodConfig, w)
+		})))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "true", w.Header().Get("X-Wrapped"))
+	assert.Equal(t, []string{"MyApi.get"}, methods)
+
+	// Passing nil restores the default.
+	server.SetResponseHandler(nil)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, "", w.Header().Get("X-Wrapped"))
+}
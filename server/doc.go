@@ -20,7 +20,21 @@ and then re-dispatches them to /_ah/spi.  It does not do any authentication,
 quota checking, DoS checking, etc.
 
 In addition, the server loads api configs from
-/_ah/spi/BackendService.getApiConfigs prior to each call, in case the
-configuration has changed.
+/_ah/spi/BackendService.getApiConfigs before the first call to each
+backend. They are not loaded again on later calls: ReloadApiConfigs must
+be called, or a watch interval set with SetConfigWatchInterval, for
+changes to the configuration to be served. Alternatively, a ConfigSource
+may supply the configs from .api files, a directory of them or memory, so
+that requests can be routed before the backend is up.
+
+Several backends may be fronted with AddBackend. Configs are gathered
+from all of them and each API's calls are sent to the backend that
+reported its config. The calls of APIs whose configs come from a
+ConfigSource are sent to the backend named by the Adapter.Bns of the
+config.
+
+Requests to /_ah/api/upload carry media rather than JSON. The media is
+streamed to the SPI method as a multipart/related request whose first
+part is the JSON request and whose second part is the media.
 */
 package server
@@ -20,12 +20,16 @@ import (
 	"errors"
 	"fmt"
 	"github.com/rwl/go-endpoints/endpoints"
+	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"net/url"
 	"path"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const defaultURL = "http://localhost:8080"
@@ -45,16 +49,104 @@ type EndpointsServer struct {
 
 	// URL to which SPI requests should be dispatched.
 	url string
+
+	// Source of API configurations. If nil the configurations are
+	// fetched from the backend.
+	configSource ConfigSource
+
+	// Whether API configurations with problems are rejected.
+	strictConfigs bool
+
+	// URLs of the SPI backends fronted in addition to url.
+	backends     []string
+	backendsLock sync.Mutex
+
+	// Gathers the API configurations from the backends, if there is no
+	// configSource.
+	backendSource *backendsConfigSource
+
+	// Health of the SPI backends called.
+	backendHealth backendHealth
+
+	// Policies for retrying failed SPI calls, for all methods and by
+	// method name.
+	retryPolicy         *RetryPolicy
+	methodRetryPolicies map[string]*RetryPolicy
+	retryLock           sync.Mutex
+	retryBudget         retryBudget
+	retryCounter        retryCounter
+
+	// Replicas of the SPI backends, by backend URL.
+	replicas     map[string]*replicaPool
+	replicasLock sync.Mutex
+
+	// Circuit breakers of the SPI methods called.
+	breakers circuitBreakers
+
+	// Transport that SPI requests are sent with. If nil they are sent
+	// over HTTP.
+	transport     SpiTransport
+	transportLock sync.Mutex
+
+	// Transport of the connections to https backends set by
+	// SetBackendTLS, or nil for the default, and the SPI transport it
+	// installed, if any.
+	backendTransport    *http.Transport
+	backendSpiTransport SpiTransport
+
+	// Optional cache of REST GET responses.
+	responseCache *ResponseCache
+
+	// Resumable media upload sessions.
+	uploads uploadSessions
+
+	// Names of the methods whose media may be downloaded with alt=media.
+	mediaDownloads     map[string]bool
+	mediaDownloadsLock sync.RWMutex
+
+	// Stages of request handling.
+	dispatcher      Dispatcher
+	spiUrlBuilder   SpiUrlBuilder
+	responseHandler ResponseHandler
+	staticContent   StaticContent
+
+	// Interceptors of API calls, outermost first.
+	interceptors []Interceptor
+
+	// Metrics of the traffic served, and the path HandleHttp registers
+	// their handler at, if any.
+	metrics     *serverMetrics
+	metricsPath string
+
+	// Exporter of the spans of traced requests, or nil if tracing is
+	// disabled.
+	spanExporter SpanExporter
+
+	// Logger of diagnostics and the access log, or nil for the default,
+	// and the lower-cased names of parameters redacted in the access log.
+	logger         Logger
+	redactedParams map[string]bool
+
+	// Outcomes of loading the API configurations, and of checking those
+	// last returned by the config source.
+	configStatus configStatus
+	configCheck  configCheck
+
+	// Path prefix of the health endpoints, or "" for the default.
+	healthPrefix string
+
+	// Background work and shutdown.
+	lifecycle lifecycle
 }
 
 // NewEndpointsServer returns a new EndpointsServer that will dispatch
 // SPI requests to the given URL.
-func NewEndpointsServer(URL *url.URL) *EndpointsServer {
-	return newEndpointsServerConfig(newApiConfigManager(), "", URL)
+func NewEndpointsServer(URL *url.URL, opts ...ServerOption) *EndpointsServer {
+	return newEndpointsServerConfig(newApiConfigManager(), "", URL, opts...)
 }
 
-func NewEndpointsServerRoot(root string, URL *url.URL) *EndpointsServer {
-	return newEndpointsServerConfig(newApiConfigManager(), root, URL)
+func NewEndpointsServerRoot(root string, URL *url.URL, opts ...ServerOption) *EndpointsServer {
+	return newEndpointsServerConfig(newApiConfigManager(), root, URL, opts...)
 }
 
 func newEndpointsServer() *EndpointsServer {
@@ -62,15 +154,52 @@ func newEndpointsServer() *EndpointsServer {
 	return newEndpointsServerConfig(newApiConfigManager(), "", u)
 }
 
-func newEndpointsServerConfig(configManager *apiConfigManager, root string, u *url.URL) *EndpointsServer {
+func newEndpointsServerConfig(configManager *apiConfigManager, root string, u *url.URL, opts ...ServerOption) *EndpointsServer {
 	if root == "" {
 		root = defaultRoot
 	}
-	s := &EndpointsServer{configManager: configManager, root: root}
+	s := &EndpointsServer{
+		configManager:   configManager,
+		root:            root,
+		dispatcher:      NewDefaultDispatcher(),
+		spiUrlBuilder:   NewDefaultSpiUrlBuilder(),
+		responseHandler: NewDefaultResponseHandler(),
+		staticContent:   NewDefaultStaticContent(),
+		metrics:         newServerMetrics(),
+	}
+	s.backendSource = &backendsConfigSource{ed: s}
 	s.SetURL(u)
+	for _, opt := range opts {
+		opt(s)
+	}
 	return s
 }
 
+// SetResponseCache enables caching of REST GET responses in the given
+// cache. Passing nil disables caching.
+func (ed *EndpointsServer) SetResponseCache(c *ResponseCache) {
+	ed.responseCache = c
+}
+
+// SetConfigSource sets the source of the API configurations served. By
+// default they are fetched from each backend before its first request and
+// kept. They are only fetched again by ReloadApiConfigs, or at the
+// interval given to SetConfigWatchInterval or WatchApiConfigs, so changes
+// to a backend's configurations aren't served until then.
+func (ed *EndpointsServer) SetConfigSource(src ConfigSource) {
+	ed.configSource = src
+}
+
+// SetStrictApiConfigs sets whether API configurations are linted with
+// LintApiConfigs and rejected if any problems are found. Once
+// configurations have been loaded, rejected ones are logged and the last
+// good configurations are served until they are fixed. By default
+// configurations that can't be parsed are logged and skipped, and later
+// duplicate routes replace earlier ones.
+func (ed *EndpointsServer) SetStrictApiConfigs(strict bool) {
+	ed.strictConfigs = strict
+}
+
 // Configures the server to handler API requests to the default paths.
 // If mux is not specified then http.DefaultServeMux is used.
 func (ed *EndpointsServer) HandleHttp(mux *http.ServeMux) {
@@ -80,45 +209,141 @@ func (ed *EndpointsServer) HandleHttp(mux *http.ServeMux) {
 	r := newRouter()
 	r.HandleFunc(path.Join(ed.root, "/explorer"), ed.HandleApiExplorerRequest)
 	r.HandleFunc(path.Join(ed.root, "/static"), ed.HandleApiStaticRequest)
+	r.HandleFunc(path.Join(ed.root, "/upload")+"/", ed.HandleApiUploadRequest)
 	r.HandleFunc("/", ed.ServeHTTP)
 	mux.Handle(ed.root, r)
+	if ed.metricsPath != "" {
+		mux.HandleFunc(ed.metricsPath, ed.HandleMetricsRequest)
+	}
+	ed.handleHealth(mux)
 }
 
 // EndpointsServer implements the http.Handler interface.
-func (ed *EndpointsServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	ar, err := newApiRequest(r)
+func (ed *EndpointsServer) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	ed.instrument(rw, r, newApiRequest, ed.serveHTTP)
+}
+
+// Parses a request and serves it with the instrumentation of API requests:
+// the request id, the count of requests in progress, metrics, the access
+// log and tracing. Requests are rejected once the server is shutting down.
+func (ed *EndpointsServer) instrument(rw http.ResponseWriter, r *http.Request, parse func(r *http.Request) (*ApiRequest, error), serve func(w http.ResponseWriter, ar *ApiRequest)) {
+	start := time.Now()
+	atomic.AddInt64(&ed.metrics.inFlight, 1)
+	defer atomic.AddInt64(&ed.metrics.inFlight, -1)
+	w := &statusResponseWriter{ResponseWriter: rw}
+	r, id := withRequestId(r)
+	w.Header().Set(headerRequestId, id)
+	httpMethod := r.Method
+	ar, err := parse(r)
+	defer func() {
+		elapsed := time.Since(start)
+		ed.metrics.observeRequest(ar, w.statusCode(), elapsed)
+		ed.logAccess(id, httpMethod, ar, w, elapsed)
+	}()
 	if err != nil {
+		if rpcErr, ok := err.(*jsonRpcError); ok {
+			// Malformed JSON-RPC requests get JSON-RPC error responses.
+			ed.handleRequestError(w, &ApiRequest{Request: r}, rpcErr)
+			return
+		}
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	ed.serveHTTP(w, ar)
+	if ed.rejectIfShuttingDown(w, ar) {
+		return
+	}
+	ar.trace = ed.newRequestTrace(r)
+	defer func() {
+		ar.trace.finish(w.statusCode())
+	}()
+	serve(w, ar)
 }
 
-func (ed *EndpointsServer) serveHTTP(w http.ResponseWriter, ar *apiRequest) {
+func (ed *EndpointsServer) serveHTTP(w http.ResponseWriter, ar *ApiRequest) {
+	if ar.batchSize > 1 {
+		ed.log().Warn("Batch requests with more than 1 element aren't supported, only the first element will be handled",
+			"elements", ar.batchSize)
+	}
+	if ar.isBatch {
+		ed.log().Debug("Converting batch request to single request")
+	}
+
 	// Get API configuration first. We need this so we know how to
 	// call the back end.
-	apiConfigResponse, err := ed.getApiConfigs()
-	if err != nil {
-		ed.failRequest(w, ar.Request, "BackendService.getApiConfigs error: "+err.Error())
-		return
-	}
-	err = ed.handleApiConfigResponse(apiConfigResponse)
-	if err != nil {
-		ed.failRequest(w, ar.Request, "BackendService.getApiConfigs handling error: "+err.Error())
+	if !ed.updateApiConfigs(w, ar.Request) {
 		return
 	}
 
 	// Call the service.
-	_, err = callSpi(ed, w, ar)
+	_, err := ed.dispatcher.Dispatch(ed, w, ar)
 	if err != nil {
-		reqErr, ok := err.(requestError)
-		if ok {
-			ed.handleRequestError(w, ar, reqErr)
-			return
-		} else {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		ed.handleError(w, ar, err)
+	}
+}
+
+// Loads the API configuration from the config source. If this fails a
+// failure response is written and false is returned.
+func (ed *EndpointsServer) updateApiConfigs(w http.ResponseWriter, r *http.Request) bool {
+	if err := ed.loadApiConfigs(); err != nil {
+		ed.failRequest(w, r, err.Error())
+		return false
+	}
+	return true
+}
+
+// Loads the API configuration from the config source. Configurations are
+// only checked when they differ from those last checked. If a strict
+// server's configurations are rejected after others have been loaded, the
+// last good configurations are still served.
+func (ed *EndpointsServer) loadApiConfigs() error {
+	configs, sources, err := readApiConfigs(ed.apiConfigSource())
+	if _, ok := configErrors(err); err != nil && !ok {
+		ed.configRefreshed(err)
+		return err
+	}
+	c := &ed.configCheck
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.checked && sameConfigs(c.configs, configs) {
+		if c.passed {
+			return nil
+		}
+		return c.err
+	}
+	c.configs, c.checked = configs, true
+	c.err = ed.checkApiConfigs(configs, err)
+	ed.configRefreshed(c.err)
+	if c.err != nil {
+		if c.passed {
+			ed.log().Error("API configs rejected, serving the last good ones", "error", c.err)
+			return nil
 		}
+		return c.err
+	}
+	c.passed = true
+	ed.configManager.saveApiConfigs(configs, sources)
+	return nil
+}
+
+// Returns the source of API configurations, which defaults to the
+// BackendService.getApiConfigs method of each backend.
+func (ed *EndpointsServer) apiConfigSource() ConfigSource {
+	if ed.configSource != nil {
+		return ed.configSource
+	}
+	if ed.backendSource != nil {
+		return ed.backendSource
+	}
+	return &backendsConfigSource{ed: ed}
+}
+
+// Writes the response for an error returned while dispatching a request.
+func (ed *EndpointsServer) handleError(w http.ResponseWriter, ar *ApiRequest, err error) {
+	reqErr, ok := err.(requestError)
+	if ok {
+		ed.handleRequestError(w, ar, reqErr)
+	} else {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
@@ -138,7 +363,7 @@ func (ed *EndpointsServer) HandleApiStaticRequest(w http.ResponseWriter, r *http
 		return
 	}
 
-	response, body, err := getStaticFile(request.relativeUrl)
+	response, body, err := ed.staticContent.GetStaticFile(request.relativeUrl)
 
 	//	status_string := fmt.Sprintf("%d %s", response.status, response.reason)
 	if err == nil && response.StatusCode == 200 {
@@ -151,8 +376,8 @@ func (ed *EndpointsServer) HandleApiStaticRequest(w http.ResponseWriter, r *http
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
 		fmt.Fprintf(w, body)
 	} else {
-		log.Printf("Discovery API proxy failed on %s with %d. Details: %s",
-			request.relativeUrl, response.StatusCode, body)
+		ed.log().Warn("Discovery API proxy failed", "path", request.relativeUrl,
+			"status", response.StatusCode, "details", body)
 		w.Header().Add("Content-Type", response.Header.Get("Content-Type"))
 		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
 		w.WriteHeader(response.StatusCode)
@@ -161,23 +386,6 @@ func (ed *EndpointsServer) HandleApiStaticRequest(w http.ResponseWriter, r *http
 	}
 }
 
-// Makes a call to the BackendService.getApiConfigs endpoint.
-func (ed *EndpointsServer) getApiConfigs() (*http.Response, error) {
-	req, err := http.NewRequest("POST",
-		ed.url+"/_ah/spi/BackendService.getApiConfigs",
-		ioutil.NopCloser(bytes.NewBufferString("{}")))
-	if err != nil {
-		return nil, err
-	}
-	req.Header.Add("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return nil, err
-	}
-	return resp, nil
-}
-
 // Verifies that a response has the expected status and content type.
 // Returns true if both statusCode and contentType match the response.
 func verifyResponse(response *http.Response, statusCode int, contentType string) error {
@@ -197,78 +405,208 @@ func verifyResponse(response *http.Response, statusCode int, contentType string)
 	return fmt.Errorf("Incorrect response Content-Type: %s != %s", ct, contentType)
 }
 
-// Parses the result of getApiConfigs and stores its information.
-func (ed *EndpointsServer) handleApiConfigResponse(apiConfigResponse *http.Response) error {
-	err := verifyResponse(apiConfigResponse, 200, "application/json")
-	if err == nil {
-		body, err := ioutil.ReadAll(apiConfigResponse.Body)
-		defer apiConfigResponse.Body.Close()
-		if err != nil {
-			return err
-		}
-		err = ed.configManager.parseApiConfigResponse(string(body))
-		if err != nil {
-			return err
-		}
-		return nil
-	}
-	return err
-}
-
 // Generate SPI call (from earlier-saved request).
-var callSpi = func(ed *EndpointsServer, w http.ResponseWriter, origRequest *apiRequest) (string, error) {
+func callSpi(ed *EndpointsServer, w http.ResponseWriter, origRequest *ApiRequest) (string, error) {
 	var methodConfig *endpoints.ApiMethod
 	var params map[string]string
+	span := origRequest.trace.startSpan("route", SpanKindInternal)
 	if origRequest.isRpc() {
+		if err := validateJsonrpcRequest(origRequest.bodyJson); err != nil {
+			span.end(err)
+			return "", err
+		}
 		methodConfig = ed.lookupRpcMethod(origRequest)
+		if methodConfig == nil {
+			err := newJsonRpcError(jsonrpcMethodNotFound,
+				fmt.Sprintf("Method not found: %s", origRequest.Method))
+			span.end(err)
+			return "", err
+		}
 		params = nil
 	} else {
 		methodConfig, params = ed.lookupRestMethod(origRequest)
+		origRequest.params = params
 	}
+	span.setAttribute("rpc.method", origRequest.Method)
+	span.end(nil)
 	if methodConfig == nil {
 		corsHandler := newCheckCorsHeaders(origRequest.Request)
 		return sendNotFoundResponse(w, corsHandler), nil
 	}
 
 	// Prepare the request for the back end.
+	span = origRequest.trace.startSpan("transform_request", SpanKindInternal)
 	spiRequest, err := ed.transformRequest(origRequest, params, methodConfig)
+	span.end(err)
 	if err != nil {
 		return err.Error(), err
 	}
+	spiRequest.spiHeader = make(http.Header)
+	return ed.intercept(w, &Call{
+		OrigRequest: origRequest,
+		MethodName:  origRequest.Method,
+		Method:      methodConfig,
+		Rpc:         origRequest.isRpc(),
+		Params:      params,
+		SpiRequest:  spiRequest,
+		SpiHeader:   spiRequest.spiHeader,
+	})
+}
+
+// Serves a call from the response cache, if it is enabled for the call's
+// method, or else by dispatching it.
+func (ed *EndpointsServer) serveCall(w http.ResponseWriter, call *Call) (string, error) {
+	if call.dispatch != nil {
+		return call.dispatch(w, call)
+	}
+	origRequest := call.OrigRequest
+	if ed.responseCache != nil && !call.Rpc && isReadMethod(call.Method) &&
+		!ed.isMediaDownload(origRequest) {
+		return ed.serveCached(w, origRequest, call.MethodName, call.Params,
+			func(w http.ResponseWriter) (string, error) {
+				return ed.dispatchMethod(w, origRequest, call.SpiRequest, call.Method)
+			})
+	}
+	return ed.dispatchMethod(w, origRequest, call.SpiRequest, call.Method)
+}
 
+// Sends a transformed request for a resolved method to the SPI and writes
+// the transformed response.
+func (ed *EndpointsServer) dispatchMethod(w http.ResponseWriter, origRequest, spiRequest *ApiRequest, methodConfig *endpoints.ApiMethod) (string, error) {
 	// Check if this SPI call is for the Discovery service. If so, route
 	// it to our Discovery handler.
 	discovery := newDiscoveryService(ed.configManager)
+	start := time.Now()
 	discoveryResponse, ok := discovery.handleDiscoveryRequest(spiRequest.URL.Path,
 		spiRequest, w)
 	if ok {
+		ed.metrics.discovery.observe(time.Since(start), spiRequest.URL.Path)
 		return discoveryResponse, nil
 	}
 
-	// Send the request to the user's SPI handlers.
-	url := buildSpiUrl(ed, spiRequest)
+	if !ed.isMediaDownload(origRequest) {
+		// Byte ranges only apply to media.
+		spiRequest.Header.Del(headerRange)
+		spiRequest.Header.Del(headerIfRange)
+	}
 
-	req, err := http.NewRequest("POST", url, spiRequest.Body)
-	if err != nil {
-		return "", err
+	// Evaluate any If-Match precondition before modifying the resource.
+	// This only saves calling the backend when the precondition already
+	// fails: the resource may change between the check and the write, so
+	// If-Match is still passed on for the backend to enforce.
+	ifMatch := ""
+	if !origRequest.isRpc() && isMutatingMethod(methodConfig) {
+		ifMatch = origRequest.Header.Get(headerIfMatch)
 	}
-	req.Header.Add("Content-Type", "application/json")
-	req.RemoteAddr = spiRequest.RemoteAddr
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	if ifMatch != "" {
+		if err := ed.checkIfMatch(origRequest); err != nil {
+			return "", err
+		}
+	}
+
+	// Send the request to the user's SPI handlers.
+	resp, err := ed.dispatchSpi(spiRequest, methodConfig)
 	if err != nil {
 		return "", err
 	}
-	return handleSpiResponse(ed, origRequest, spiRequest, resp,
+	if ifMatch != "" && resp.StatusCode == http.StatusPreconditionFailed {
+		resp.Body.Close()
+		return "", newConditionNotMetError(
+			fmt.Sprintf("Precondition failed: %s", ifMatch))
+	}
+	span := origRequest.trace.startSpan("transform_response", SpanKindInternal)
+	body, err := ed.responseHandler.HandleSpiResponse(ed, origRequest, spiRequest, resp,
 		methodConfig, w)
+	span.end(err)
+	return body, err
 }
 
-var buildSpiUrl = func(ed *EndpointsServer, spiRequest *apiRequest) string {
-	return ed.url + fmt.Sprintf(spiRootFormat, spiRequest.URL.Path)
+// Request headers that are passed on to the SPI.
+var forwardedHeaders = []string{headerIfMatch, headerRange, headerIfRange}
+
+// Sends a transformed request to the user's SPI handlers and returns
+// the raw response.
+func (ed *EndpointsServer) dispatchSpi(spiRequest *ApiRequest, methodConfig *endpoints.ApiMethod) (*http.Response, error) {
+	return ed.postSpiWithRetries(spiRequest, methodConfig)
+}
+
+// Posts the given body to the SPI method of a transformed request.
+func (ed *EndpointsServer) postSpi(spiRequest *ApiRequest, contentType string, body io.Reader) (*http.Response, error) {
+	breaker := breakerKey{ed.spiBackend(spiRequest), spiRequest.URL.Path}
+	if !ed.breakers.allow(breaker) {
+		return nil, newCircuitOpenError(breaker)
+	}
+	replicaDone := ed.pickReplica(spiRequest)
+	url := ed.spiUrlBuilder.SpiUrl(ed, spiRequest)
+
+	req, err := http.NewRequest("POST", url, body)
+	if err != nil {
+		replicaDone(nil, err, true)
+		ed.breakers.record(breaker, nil, err, true)
+		return nil, err
+	}
+	req.Header.Add("Content-Type", contentType)
+	for _, header := range forwardedHeaders {
+		if value := spiRequest.Header.Get(header); value != "" {
+			req.Header.Set(header, value)
+		}
+	}
+	for header, values := range spiRequest.spiHeader {
+		req.Header[header] = values
+	}
+	if id := RequestId(spiRequest.Context()); id != "" {
+		req.Header.Set(headerRequestId, id)
+	}
+	req.RemoteAddr = spiRequest.RemoteAddr
+	req = req.WithContext(spiRequest.Context())
+	span := spiRequest.trace.startSpan("spi_call", SpanKindClient)
+	span.setAttribute("endpoints.backend", ed.spiBackend(spiRequest))
+	span.setAttribute("rpc.method", spiRequest.URL.Path)
+	spiRequest.trace.inject(req.Header, span)
+	start := time.Now()
+	atomic.AddInt64(&ed.lifecycle.spiCalls, 1)
+	resp, err := ed.spiTransport().RoundTrip(req)
+	atomic.AddInt64(&ed.lifecycle.spiCalls, -1)
+	spiRequest.stats.addBackendTime(time.Since(start))
+	if resp != nil {
+		span.setAttribute("http.status_code", strconv.Itoa(resp.StatusCode))
+	}
+	span.end(err)
+	// Calls cut short by the client going away or its deadline passing
+	// don't count against the backend.
+	abandoned := spiRequest.Context().Err() != nil
+	replicaDone(resp, err, abandoned)
+	if !abandoned {
+		ed.backendHealth.record(ed.spiBackend(spiRequest), resp, err)
+	}
+	ed.breakers.record(breaker, resp, err, abandoned)
+	return resp, err
+}
+
+// Returns the URL of the backend that serves the method of a transformed
+// request.
+func (ed *EndpointsServer) spiBackend(spiRequest *ApiRequest) string {
+	if spiRequest.backend != "" {
+		return spiRequest.backend
+	}
+	return ed.url
+}
+
+// Returns the URL of the SPI method of a transformed request.
+func buildSpiUrl(ed *EndpointsServer, spiRequest *ApiRequest) string {
+	target := spiRequest.target
+	if target == "" {
+		target = ed.spiBackend(spiRequest)
+	}
+	return target + fmt.Sprintf(spiRootFormat, spiRequest.URL.Path)
 }
 
 // Handle SPI response, transforming output as needed.
-var handleSpiResponse = func(ed *EndpointsServer, origRequest, spiRequest *apiRequest, response *http.Response, methodConfig *endpoints.ApiMethod, w http.ResponseWriter) (string, error) {
+func handleSpiResponse(ed *EndpointsServer, origRequest, spiRequest *ApiRequest, response *http.Response, methodConfig *endpoints.ApiMethod, w http.ResponseWriter) (string, error) {
+	if ed.isMediaDownload(origRequest) {
+		return ed.handleMediaResponse(origRequest, response, w)
+	}
+
 	// Verify that the response is json.  If it isn"t treat, the body as an
 	// error message and wrap it in a json error response.
 	for header, value := range response.Header {
@@ -298,7 +636,10 @@ var handleSpiResponse = func(ed *EndpointsServer, origRequest, spiRequest *apiRe
 	// Need to check isRpc() against the original request, because the
 	// incoming request here has had its path modified.
 	var body string
-	if origRequest.isRpc() {
+	if origRequest.isNotification() {
+		corsHandler := newCheckCorsHeaders(origRequest.Request)
+		return sendNoContentResponse(w, corsHandler), nil
+	} else if origRequest.isRpc() {
 		body, err = ed.transformJsonrpcResponse(spiRequest, string(respBody))
 	} else {
 		// Check if the response from the SPI was empty. Empty REST responses
@@ -315,10 +656,20 @@ var handleSpiResponse = func(ed *EndpointsServer, origRequest, spiRequest *apiRe
 	}
 
 	corsHandler := newCheckCorsHeaders(origRequest.Request)
+	if !origRequest.isRpc() && isReadMethod(methodConfig) {
+		// Tag GET responses so clients can poll with If-None-Match.
+		etag := responseETag(response, body)
+		ifNoneMatch := origRequest.Header.Get(headerIfNoneMatch)
+		if ifNoneMatch != "" && etagMatches(ifNoneMatch, etag, true) {
+			return sendNotModifiedResponse(w, etag, corsHandler), nil
+		}
+		w.Header().Set(headerETag, etag)
+	}
 	corsHandler.updateHeaders(w.Header())
 	for k, vals := range response.Header {
 		w.Header()[k] = vals
 	}
+	setRequestIdHeader(w.Header(), origRequest.Context())
 	w.Header().Set("Content-Length", fmt.Sprintf("%d", len(body)))
 	w.WriteHeader(response.StatusCode)
 	fmt.Fprint(w, body)
@@ -328,16 +679,18 @@ var handleSpiResponse = func(ed *EndpointsServer, origRequest, spiRequest *apiRe
 // Write an immediate failure response to outfile, no redirect.
 func (ed *EndpointsServer) failRequest(w http.ResponseWriter, origRequest *http.Request, message string) string {
 	corsHandler := newCheckCorsHeaders(origRequest)
-	return sendErrorResponse(message, w, corsHandler)
+	return sendErrorResponse(message, RequestId(origRequest.Context()), w, corsHandler)
 }
 
 // Looks up and returns rest method for the currently-pending request.
 //
 // Returns a method descriptor and a parameter map, or (nil, nil) if no
 // method was found for the current request.
-func (ed *EndpointsServer) lookupRestMethod(origRequest *apiRequest) (*endpoints.ApiMethod, map[string]string) {
-	methodName, method, params := ed.configManager.lookupRestMethod(origRequest.URL.Path, origRequest.Method)
+func (ed *EndpointsServer) lookupRestMethod(origRequest *ApiRequest) (*endpoints.ApiMethod, map[string]string) {
+	methodName, method, params, api, backend := ed.configManager.lookupRestTarget(origRequest.URL.Path, origRequest.Method)
 	origRequest.Method = methodName
+	origRequest.backend = backend
+	origRequest.api = api
 	return method, params
 }
 
@@ -345,7 +698,7 @@ func (ed *EndpointsServer) lookupRestMethod(origRequest *apiRequest) (*endpoints
 //
 // Returns the RPC method descriptor that was found for the current request,
 // or nil if none was found.
-func (ed *EndpointsServer) lookupRpcMethod(origRequest *apiRequest) *endpoints.ApiMethod {
+func (ed *EndpointsServer) lookupRpcMethod(origRequest *ApiRequest) *endpoints.ApiMethod {
 	if origRequest.bodyJson == nil {
 		return nil
 	}
@@ -360,7 +713,10 @@ func (ed *EndpointsServer) lookupRpcMethod(origRequest *apiRequest) *endpoints.A
 		versionStr = ""
 	}
 	origRequest.Method = methodNameStr
-	return ed.configManager.lookupRpcMethod(methodNameStr, versionStr)
+	method, api, backend := ed.configManager.lookupRpcTarget(methodNameStr, versionStr)
+	origRequest.backend = backend
+	origRequest.api = api
+	return method
 }
 
 // Transforms origRequest to an api-serving request.
@@ -369,8 +725,8 @@ func (ed *EndpointsServer) lookupRpcMethod(origRequest *apiRequest) *endpoints.A
 // and returns a new transformed request ready to send to the SPI. The path
 // is updated and parts of the body or other properties may also be changed.
 // This method accepts a REST-style or RPC-style request.
-func (ed *EndpointsServer) transformRequest(origRequest *apiRequest, params map[string]string, methodConfig *endpoints.ApiMethod) (*apiRequest, error) {
-	var request *apiRequest
+func (ed *EndpointsServer) transformRequest(origRequest *ApiRequest, params map[string]string, methodConfig *endpoints.ApiMethod) (*ApiRequest, error) {
+	var request *ApiRequest
 	var err error
 	if origRequest.isRpc() {
 		request, err = ed.transformJsonrpcRequest(origRequest)
@@ -415,7 +771,7 @@ func (ed *EndpointsServer) addMessageField(fieldName string, value interface{},
 	if ok {
 		subParams, ok = _subParams.(map[string]interface{})
 		if !ok {
-			log.Printf("Problem accessing sub-params: %#v", _subParams)
+			ed.log().Warn("Problem accessing sub-params", "params", fmt.Sprintf("%#v", _subParams))
 		}
 	} else {
 		subParams = make(map[string]interface{})
@@ -482,9 +838,9 @@ func (ed *EndpointsServer) updateFromBody(destination map[string]interface{}, so
 // configuration for the parameters for the request and returns a copy of
 // the current request that's been modified so it can be sent to the SPI.
 // The body is updated to include parameters from the URL.
-func (ed *EndpointsServer) transformRestRequest(origRequest *apiRequest,
+func (ed *EndpointsServer) transformRestRequest(origRequest *ApiRequest,
 	params map[string]string,
-	methodParameters map[string]*endpoints.ApiRequestParamSpec) (*apiRequest, error) {
+	methodParameters map[string]*endpoints.ApiRequestParamSpec) (*ApiRequest, error) {
 	request, err := origRequest.copy()
 	if err != nil {
 		return request, err
@@ -579,28 +935,19 @@ func (ed *EndpointsServer) transformRestRequest(origRequest *apiRequest,
 //
 // Returns a new request with the request_id updated and params moved to the
 // body.
-func (ed *EndpointsServer) transformJsonrpcRequest(origRequest *apiRequest) (*apiRequest, error) {
+func (ed *EndpointsServer) transformJsonrpcRequest(origRequest *ApiRequest) (*ApiRequest, error) {
 	request, err := origRequest.copy()
 	if err != nil {
 		return request, err
 	}
 
-	requestId, okId := request.bodyJson["id"]
-	if okId {
-		requestIdStr, ok := requestId.(string)
-		if ok {
-			request.requestId = requestIdStr
-		} else {
-			requestIdInt, ok := requestId.(int)
-			if ok {
-				request.requestId = fmt.Sprintf("%d", requestIdInt)
-			} else {
-				return nil, fmt.Errorf("Problem extracting request ID: %#v", requestId)
-			}
-		}
-	} else {
-		request.requestId = ""
+	// The id may be of any type and is echoed back exactly.
+	request.requestId = request.bodyJson["id"]
+	if !isValidJsonrpcId(request.requestId) {
+		return nil, newJsonRpcError(jsonrpcInvalidRequest,
+			fmt.Sprintf("Problem extracting request ID: %#v", request.requestId))
 	}
+	request.jsonrpcVersion, _ = request.bodyJson["jsonrpc"].(string)
 
 	bodyJson, okParam := request.bodyJson["params"]
 	if okParam {
@@ -608,12 +955,8 @@ func (ed *EndpointsServer) transformJsonrpcRequest(origRequest *apiRequest) (*ap
 		if ok {
 			request.bodyJson = bodyJsonObj
 		} else {
-			bodyJsonMap, ok := bodyJson.(map[string]interface{})
-			if ok {
-				request.bodyJson = bodyJsonMap
-			} else {
-				return nil, fmt.Errorf("Problem extracting JSON body from params: %#v", bodyJson)
-			}
+			return nil, newJsonRpcError(jsonrpcInvalidParams,
+				fmt.Sprintf("Problem extracting JSON body from params: %#v", bodyJson))
 		}
 	} else {
 		request.bodyJson = make(map[string]interface{})
@@ -641,7 +984,7 @@ func (ed *EndpointsServer) checkErrorResponse(response *http.Response) error {
 // response body that should be returned to the user.  If the SPI response
 // wasn't empty, this returns None, indicating that we should not exit early
 // with a 204.
-func (ed *EndpointsServer) checkEmptyResponse(origRequest *apiRequest, methodConfig *endpoints.ApiMethod, w http.ResponseWriter) bool {
+func (ed *EndpointsServer) checkEmptyResponse(origRequest *ApiRequest, methodConfig *endpoints.ApiMethod, w http.ResponseWriter) bool {
 	if methodConfig.Response.Body == "empty" {
 		// The response to this function should be empty.  We should return a 204.
 		// Note that it's possible that the SPI returned something, but we'll
@@ -672,22 +1015,30 @@ func (ed *EndpointsServer) transformRestResponse(responseBody string) (string, e
 // Translates an api-serving response to a JsonRpc response.
 //
 // Returns the updated, JsonRPC-formatted request body.
-func (ed *EndpointsServer) transformJsonrpcResponse(spiRequest *apiRequest, responseBody string) (string, error) {
+func (ed *EndpointsServer) transformJsonrpcResponse(spiRequest *ApiRequest, responseBody string) (string, error) {
 	var result interface{}
-	err := json.Unmarshal([]byte(responseBody), &result)
+	dec := json.NewDecoder(strings.NewReader(responseBody))
+	dec.UseNumber()
+	err := dec.Decode(&result)
 	if err != nil {
 		return responseBody, fmt.Errorf("Problem unmarshalling RPC response: %s", err.Error())
 	}
 	bodyJson := map[string]interface{}{"result": result}
-	return ed.finishRpcResponse(spiRequest.requestId, spiRequest.isBatch, bodyJson), nil
+	return ed.finishRpcResponse(spiRequest.requestId, spiRequest.jsonrpcVersion,
+		spiRequest.isBatch, bodyJson), nil
 }
 
 // Finish adding information to a JSON RPC response.
 //
-// The requestId argument may be empty if the request didn't have a
-// request ID. Returns the updated, JsonRPC-formatted request body.
-func (ed *EndpointsServer) finishRpcResponse(requestId string, isBatch bool, bodyJson map[string]interface{}) string {
-	if len(requestId) > 0 {
+// The requestId argument may be nil if the request didn't have a request
+// ID. If the request gave a JSON-RPC version it is echoed back, along with
+// the id, which is null if there wasn't one. Returns the updated,
+// JsonRPC-formatted request body.
+func (ed *EndpointsServer) finishRpcResponse(requestId interface{}, version string, isBatch bool, bodyJson map[string]interface{}) string {
+	if version != "" {
+		bodyJson["jsonrpc"] = version
+		bodyJson["id"] = requestId
+	} else if requestId != nil {
 		bodyJson["id"] = requestId
 	}
 	var body []byte
@@ -699,22 +1050,36 @@ func (ed *EndpointsServer) finishRpcResponse(requestId string, isBatch bool, bod
 	return string(body)
 }
 
-func (ed *EndpointsServer) handleRequestError(w http.ResponseWriter, origRequest *apiRequest, err requestError) string {
+func (ed *EndpointsServer) handleRequestError(w http.ResponseWriter, origRequest *ApiRequest, err requestError) string {
 	var statusCode int
 	var body string
 	if origRequest.isRpc() {
 		// JSON RPC errors are returned with status 200 OK and the
 		// error details in the body.
+		rpcErr, isRpcErr := err.(*jsonRpcError)
+		if origRequest.isNotification() && (!isRpcErr || rpcErr.rpcCode == jsonrpcMethodNotFound) {
+			// Notifications are never answered, even with an error.
+			return sendNoContentResponse(w, newCheckCorsHeaders(origRequest.Request))
+		}
 		statusCode = 200
-		_id, _ := origRequest.bodyJson["id"]
-		id, ok := _id.(string)
-		if !ok {
-			// fixme: handle type assertion failure
+		id := origRequest.bodyJson["id"]
+		if !isValidJsonrpcId(id) {
+			id = nil
+		}
+		version, _ := origRequest.bodyJson["jsonrpc"].(string)
+		if isRpcErr {
+			// The standard error codes are defined by JSON-RPC 2.0.
+			version = jsonrpcVersion
 		}
-		body = ed.finishRpcResponse(id, origRequest.isBatch, err.rpcError())
+		body = ed.finishRpcResponse(id, version, origRequest.isBatch,
+			err.rpcError(RequestId(origRequest.Context())))
 	} else {
 		statusCode = err.statusCode()
-		body = err.restError()
+		var formatErr error
+		body, formatErr = err.restError(RequestId(origRequest.Context()))
+		if formatErr != nil {
+			ed.log().Error("Problem formatting error as REST response", "error", formatErr)
+		}
 	}
 
 	//response_status = fmt.Sprintf("%d %s", status_code,
@@ -143,7 +143,8 @@ func TestRpc(t *testing.T) {
 			"result": map[string]interface{}{
 				"text": "MyName 23",
 			},
-			"id": "gapiRpc",
+			"id":      "gapiRpc",
+			"jsonrpc": "2.0",
 		},
 	}, responseJson)
 }
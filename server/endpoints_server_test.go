@@ -51,17 +51,13 @@ func prepareTestServer(t *testing.T, config *endpoints.ApiDescriptor) *httptest.
 }
 
 // Assert that dispatching a request to the SPI works.
-func assertDispatchToSpi(t *testing.T, request *apiRequest, config *endpoints.ApiDescriptor, spiPath string,
+func assertDispatchToSpi(t *testing.T, request *ApiRequest, config *endpoints.ApiDescriptor, spiPath string,
 	expectedSpiBodyJson map[string]interface{}) {
 	server := newEndpointsServer()
-	orig := handleSpiResponse
-	defer func() {
-		handleSpiResponse = orig
-	}()
-	handleSpiResponse = func(ed *EndpointsServer, origRequest, spiRequest *apiRequest, response *http.Response, methodConfig *endpoints.ApiMethod, w http.ResponseWriter) (string, error) {
+	server.SetResponseHandler(ResponseHandlerFunc(func(ed *EndpointsServer, origRequest, spiRequest *ApiRequest, response *http.Response, methodConfig *endpoints.ApiMethod, w http.ResponseWriter) (string, error) {
 		fmt.Fprint(w, "Test")
 		return "Test", nil
-	}
+	}))
 	ts := prepareTestServer(t, config)
 	server.url = ts.URL
 	defer ts.Close()
@@ -95,13 +91,9 @@ func assertDispatchToSpi(t *testing.T, request *apiRequest, config *endpoints.Ap
 	}))
 	defer ts2.Close()
 
-	save := buildSpiUrl
-	buildSpiUrl = func(ed *EndpointsServer, spiRequest *apiRequest) string {
+	server.SetSpiUrlBuilder(SpiUrlBuilderFunc(func(ed *EndpointsServer, spiRequest *ApiRequest) string {
 		return ts2.URL + fmt.Sprintf(spiRootFormat, spiRequest.URL.Path)
-	}
-	defer func() {
-		buildSpiUrl = save
-	}()
+	}))
 
 	server.serveHTTP(w, request)
 	response, err := ioutil.ReadAll(w.Body)
@@ -123,6 +115,7 @@ func TestDispatchInvalidPath(t *testing.T) {
 		},
 	}
 	request := buildRequest("/_ah/api/foo", "", nil)
+	request.Header.Set("X-Request-Id", "test-request")
 	ts := prepareTestServer(t, config)
 	server.url = ts.URL
 	defer ts.Close()
@@ -137,6 +130,7 @@ func TestDispatchInvalidPath(t *testing.T) {
 	header := make(http.Header)
 	header.Set("Content-Type", "text/plain")
 	header.Set("Content-Length", "9")
+	header.Set("X-Request-Id", "test-request")
 	assertHttpMatchRecorder(t, w, 404, header, "Not Found")
 }
 
@@ -230,14 +224,10 @@ func TestDispatchSpiError(t *testing.T) {
 			),
 		),
 	}
-	orig := callSpi
-	defer func() {
-		callSpi = orig
-	}()
-	callSpi = func(ed *EndpointsServer, w http.ResponseWriter, origRequest *apiRequest) (string, error) {
+	server.SetDispatcher(DispatcherFunc(func(ed *EndpointsServer, w http.ResponseWriter, origRequest *ApiRequest) (string, error) {
 		assert.Equal(t, origRequest, request)
 		return "", newBackendError(response)
-	}
+	}))
 
 	server.serveHTTP(w, request)
 
@@ -295,14 +285,10 @@ func TestDispatchRpcError(t *testing.T) {
 			),
 		),
 	}
-	orig := callSpi
-	defer func() {
-		callSpi = orig
-	}()
-	callSpi = func(ed *EndpointsServer, w http.ResponseWriter, origRequest *apiRequest) (string, error) {
+	server.SetDispatcher(DispatcherFunc(func(ed *EndpointsServer, w http.ResponseWriter, origRequest *ApiRequest) (string, error) {
 		assert.Equal(t, origRequest, request)
 		return "", newBackendError(response)
-	}
+	}))
 
 	/*responseBody := */ server.serveHTTP(w, request)
 	responseBody, err := ioutil.ReadAll(w.Body)
@@ -395,14 +381,10 @@ func TestStaticExistingFile(t *testing.T) {
 		ContentLength: int64(len(testBody)),
 		Body:          ioutil.NopCloser(bytes.NewBufferString(testBody)),
 	}
-	orig := getStaticFile
-	defer func() {
-		getStaticFile = orig
-	}()
-	getStaticFile = func(path string) (*http.Response, string, error) {
+	server.SetStaticContent(StaticContentFunc(func(path string) (*http.Response, string, error) {
 		assert.Equal(t, path, relativeUrl)
 		return staticResponse, testBody, nil
-	}
+	}))
 
 	// Make sure the dispatch works as expected.
 	request := buildRequest(relativeUrl, "", nil)
@@ -432,14 +414,10 @@ func TestStaticNonExistingFile(t *testing.T) {
 		Body:          ioutil.NopCloser(bytes.NewBufferString(testBody)),
 	}
 
-	orig := getStaticFile
-	defer func() {
-		getStaticFile = orig
-	}()
-	getStaticFile = func(path string) (*http.Response, string, error) {
+	server.SetStaticContent(StaticContentFunc(func(path string) (*http.Response, string, error) {
 		assert.Equal(t, path, relativeUrl)
 		return staticResponse, testBody, nil
-	}
+	}))
 
 	// Make sure the dispatch works as expected.
 	request := buildRequest(relativeUrl, "", nil)
@@ -734,3 +712,52 @@ func TestCheckNonEmptyResponse(t *testing.T) {
 	assert.Equal(t, len(w.Header()), 0)
 	//assert.Nil(t, w.responseExcInfo)
 }
+
+// Test that a method the backend stops reporting can no longer be called.
+func TestRemovedMethodNotFound(t *testing.T) {
+	config := &endpoints.ApiDescriptor{
+		Name:    "guestbook_api",
+		Version: "v1",
+		Methods: map[string]*endpoints.ApiMethod{
+			"guestbook.get": &endpoints.ApiMethod{
+				HttpMethod: "GET",
+				Path:       "greetings/{gid}",
+				RosyMethod: "MyApi.greetings_get",
+			},
+		},
+	}
+	removed := false
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path != "/_ah/spi/BackendService.getApiConfigs" {
+			fmt.Fprint(w, `{"some": "response"}`)
+			return
+		}
+		items := []string{}
+		if !removed {
+			configBytes, _ := json.Marshal(config)
+			items = append(items, string(configBytes))
+		}
+		body, _ := json.Marshal(map[string]interface{}{"items": items})
+		w.Write(body)
+	}))
+	defer ts.Close()
+	server := newEndpointsServer()
+	server.url = ts.URL
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/guestbook_api/v1/greetings/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+
+	removed = true
+	assert.NoError(t, server.ReloadApiConfigs())
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/guestbook_api/v1/greetings/1", "", nil))
+	assert.Equal(t, 404, w.Code)
+
+	w = httptest.NewRecorder()
+	req := buildRequest("/_ah/api/rpc", `{"method": "guestbook.get", "apiVersion": "v1", "id": 1}`, nil)
+	req.Method = "POST"
+	server.ServeHTTP(w, req)
+	assertJsonrpcError(t, w, jsonrpcMethodNotFound, float64(1))
+}
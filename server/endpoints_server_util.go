@@ -32,11 +32,15 @@ func sendNotFoundResponse(w http.ResponseWriter, corsHandler corsHandler) string
 	return body
 }
 
-func sendErrorResponse(message string, w http.ResponseWriter, corsHandler corsHandler) string {
+func sendErrorResponse(message, requestId string, w http.ResponseWriter, corsHandler corsHandler) string {
+	errorMap := map[string]interface{}{
+		"message": message,
+	}
+	if requestId != "" {
+		errorMap["requestId"] = requestId
+	}
 	bodyMap := map[string]interface{}{
-		"error": map[string]interface{}{
-			"message": message,
-		},
+		"error": errorMap,
 	}
 	bodyBytes, _ := json.Marshal(bodyMap)
 	body := string(bodyBytes)
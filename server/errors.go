@@ -18,7 +18,6 @@ import (
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"net/http"
 )
 
@@ -26,8 +25,8 @@ import (
 
 type requestError interface {
 	statusCode() int
-	rpcError() map[string]interface{}
-	restError() string
+	rpcError(requestId string) map[string]interface{}
+	restError(requestId string) (string, error)
 }
 
 // Base type for errors that happen while processing a request.
@@ -58,8 +57,9 @@ func (re *baseRequestError) Error() string {
 	return re.message
 }
 
-// Format this error into a JSON response.
-func (err *baseRequestError) FormatError(errorListTag string) map[string]interface{} {
+// Format this error into a JSON response. The id of the request is
+// included, if it isn't empty, so that reports can be matched to logs.
+func (err *baseRequestError) FormatError(errorListTag, requestId string) map[string]interface{} {
 	errorMap := map[string]interface{}{
 		"domain":  err.domain,
 		"reason":  err.reason,
@@ -68,29 +68,41 @@ func (err *baseRequestError) FormatError(errorListTag string) map[string]interfa
 	for k, v := range err.extraFields {
 		errorMap[k] = v
 	}
+	body := map[string]interface{}{
+		errorListTag: []map[string]interface{}{errorMap},
+		"code":       err.statusCode(),
+		"message":    err.message,
+	}
+	if requestId != "" {
+		body["requestId"] = requestId
+	}
 	return map[string]interface{}{
-		"error": map[string]interface{}{
-			errorListTag: []map[string]interface{}{errorMap},
-			"code":       err.statusCode(),
-			"message":    err.message,
-		},
+		"error": body,
 	}
 }
 
 // Format this error into a response to a REST request.
-func (err *baseRequestError) restError() string {
-	errorJson := err.FormatError("errors")
+func (err *baseRequestError) restError(requestId string) (string, error) {
+	errorJson := err.FormatError("errors", requestId)
 	rest, e := json.MarshalIndent(errorJson, "", "  ") // todo: sort keys
 	if e != nil {
-		log.Printf("Problem formatting error as REST response: %s", e.Error())
-		return e.Error()
+		return e.Error(), e
 	}
-	return string(rest)
+	return string(rest), nil
 }
 
-// Format this error into a response to a JSON RPC request.
-func (err *baseRequestError) rpcError() map[string]interface{} {
-	return err.FormatError("data")
+// Format this error into a response to a JSON RPC request. Members other
+// than code, message and data aren't allowed in a JSON-RPC 2.0 error, so
+// the id of the request goes in the error under data.
+func (err *baseRequestError) rpcError(requestId string) map[string]interface{} {
+	errorJson := err.FormatError("data", "")
+	if requestId != "" {
+		body := errorJson["error"].(map[string]interface{})
+		for _, errorMap := range body["data"].([]map[string]interface{}) {
+			errorMap["requestId"] = requestId
+		}
+	}
+	return errorJson
 }
 
 // Base type for invalid parameter errors.
@@ -193,3 +205,102 @@ func newBackendError(response *http.Response) *backendError {
 func (err *backendError) Error() string {
 	return err.message
 }
+
+// Returns a baseRequestError with the reason and domain the live server
+// would report for the given HTTP status.
+func newStatusError(status int, message string) baseRequestError {
+	errorInfo := getErrorInfo(status)
+	return baseRequestError{
+		code:    errorInfo.httpStatus,
+		message: message,
+		reason:  errorInfo.reason,
+		domain:  errorInfo.domain,
+	}
+}
+
+// Error returned when a request precondition, such as If-Match, fails.
+type conditionNotMetError struct {
+	baseRequestError
+}
+
+func newConditionNotMetError(message string) *conditionNotMetError {
+	return &conditionNotMetError{newStatusError(http.StatusPreconditionFailed, message)}
+}
+
+func (err *conditionNotMetError) Error() string {
+	return err.message
+}
+
+// Error returned when a request is malformed.
+type badRequestError struct {
+	baseRequestError
+}
+
+func newBadRequestError(message string) *badRequestError {
+	return &badRequestError{newStatusError(http.StatusBadRequest, message)}
+}
+
+func (err *badRequestError) Error() string {
+	return err.message
+}
+
+// Error returned when a resumable upload session doesn't exist or has
+// expired.
+type uploadNotFoundError struct {
+	baseRequestError
+	uploadId string
+}
+
+func newUploadNotFoundError(uploadId string) *uploadNotFoundError {
+	return &uploadNotFoundError{
+		newStatusError(http.StatusNotFound,
+			fmt.Sprintf("No upload session found: %s", uploadId)),
+		uploadId,
+	}
+}
+
+func (err *uploadNotFoundError) Error() string {
+	return err.message
+}
+
+// JSON-RPC 2.0 error codes.
+const (
+	jsonrpcParseError     = -32700
+	jsonrpcInvalidRequest = -32600
+	jsonrpcMethodNotFound = -32601
+	jsonrpcInvalidParams  = -32602
+)
+
+// Error in the structure of a JSON-RPC request, reported with one of the
+// standard JSON-RPC error codes.
+type jsonRpcError struct {
+	baseRequestError
+	rpcCode int
+}
+
+func newJsonRpcError(rpcCode int, message string) *jsonRpcError {
+	status := http.StatusBadRequest
+	if rpcCode == jsonrpcMethodNotFound {
+		status = http.StatusNotFound
+	}
+	return &jsonRpcError{newStatusError(status, message), rpcCode}
+}
+
+func (err *jsonRpcError) Error() string {
+	return err.message
+}
+
+// Format this error into a response to a JSON RPC request.
+func (err *jsonRpcError) rpcError(requestId string) map[string]interface{} {
+	body := map[string]interface{}{
+		"code":    err.rpcCode,
+		"message": err.message,
+	}
+	if requestId != "" {
+		// Members other than code, message and data aren't allowed.
+		body["data"] = map[string]interface{}{"requestId": requestId}
+	}
+	return map[string]interface{}{
+		"error": body,
+	}
+}
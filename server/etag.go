@@ -0,0 +1,154 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// Entity tag and conditional request handling for REST methods.
+
+const (
+	headerETag        = "ETag"
+	headerIfMatch     = "If-Match"
+	headerIfNoneMatch = "If-None-Match"
+)
+
+// Returns a strong entity tag for the given response body.
+func computeETag(body string) string {
+	sum := sha1.Sum([]byte(body))
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// Reports whether etag matches any of the entity tags listed in the value
+// of an If-Match or If-None-Match header. A value of "*" matches any tag.
+//
+// If weak is true the weak comparison function is used (as required for
+// If-None-Match), otherwise two tags only match if neither is weak.
+func etagMatches(header, etag string, weak bool) bool {
+	if etag == "" {
+		return false
+	}
+	for _, candidate := range strings.Split(header, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if weak {
+			if strings.TrimPrefix(candidate, "W/") == strings.TrimPrefix(etag, "W/") {
+				return true
+			}
+		} else if !strings.HasPrefix(candidate, "W/") && candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns true if the method is safe and its responses can carry an ETag.
+func isReadMethod(methodConfig *endpoints.ApiMethod) bool {
+	return strings.ToUpper(methodConfig.HttpMethod) == "GET"
+}
+
+// Returns true if the method modifies a resource and so should honour
+// If-Match preconditions.
+func isMutatingMethod(methodConfig *endpoints.ApiMethod) bool {
+	switch strings.ToUpper(methodConfig.HttpMethod) {
+	case "POST", "PUT", "PATCH", "DELETE":
+		return true
+	}
+	return false
+}
+
+// Returns the entity tag for a REST response, preferring any ETag supplied
+// by the backend over one computed from the transformed body.
+func responseETag(response *http.Response, body string) string {
+	if etag := response.Header.Get(headerETag); etag != "" {
+		return etag
+	}
+	return computeETag(body)
+}
+
+// Writes a 304 Not Modified response for a conditional GET.
+func sendNotModifiedResponse(w http.ResponseWriter, etag string, corsHandler corsHandler) string {
+	if corsHandler != nil {
+		corsHandler.updateHeaders(w.Header())
+	}
+	w.Header().Set(headerETag, etag)
+	w.WriteHeader(http.StatusNotModified)
+	return ""
+}
+
+// Evaluates an If-Match precondition on a mutating REST request.
+//
+// The current entity tag is obtained by dispatching the GET method
+// registered for the same path. If no such method exists, nil is returned
+// and the precondition is left for the backend to evaluate. A
+// conditionNotMetError is returned if the precondition fails.
+//
+// The check is best-effort and not atomic with the write that follows it,
+// which may find the resource changed. Only the backend can enforce the
+// precondition, so the header is passed on to it either way.
+func (ed *EndpointsServer) checkIfMatch(origRequest *ApiRequest) error {
+	ifMatch := origRequest.Header.Get(headerIfMatch)
+	getName, getConfig, params := ed.configManager.lookupRestMethod(origRequest.URL.Path, "GET")
+	if getConfig == nil {
+		return nil
+	}
+
+	getRequest, err := origRequest.copy()
+	if err != nil {
+		return err
+	}
+	getRequest.Method = getName
+	getRequest.bodyJson = nil
+	getRequest.Header.Del(headerIfMatch)
+	spiRequest, err := ed.transformRequest(getRequest, params, getConfig)
+	if err != nil {
+		return err
+	}
+	resp, err := ed.dispatchSpi(spiRequest, getConfig)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		// There is no current representation for any tag, even "*", to match.
+		return newConditionNotMetError(
+			fmt.Sprintf("Precondition failed: %s", ifMatch))
+	}
+	if err = ed.checkErrorResponse(resp); err != nil {
+		return err
+	}
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	body, err := ed.transformRestResponse(string(respBody))
+	if err != nil {
+		return err
+	}
+	if !etagMatches(ifMatch, responseETag(resp, body), false) {
+		return newConditionNotMetError(
+			fmt.Sprintf("Precondition failed: %s", ifMatch))
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var etagMethodConfig = &endpoints.ApiMethod{
+	HttpMethod: "GET",
+	Path:       "greetings/{gid}",
+	RosyMethod: "MyApi.greetings_get",
+}
+
+func TestComputeETag(t *testing.T) {
+	etag := computeETag(`{"some": "response"}`)
+	assert.Equal(t, etag, computeETag(`{"some": "response"}`))
+	assert.NotEqual(t, etag, computeETag(`{"some": "other"}`))
+	assert.Equal(t, byte('"'), etag[0])
+	assert.Equal(t, byte('"'), etag[len(etag)-1])
+}
+
+func TestEtagMatches(t *testing.T) {
+	assert.True(t, etagMatches(`"a"`, `"a"`, false))
+	assert.True(t, etagMatches(`"b", "a"`, `"a"`, false))
+	assert.True(t, etagMatches(`*`, `"a"`, false))
+	assert.False(t, etagMatches(`"b"`, `"a"`, false))
+	assert.False(t, etagMatches(`W/"a"`, `"a"`, false))
+	assert.True(t, etagMatches(`W/"a"`, `"a"`, true))
+	assert.False(t, etagMatches(`*`, "", true))
+}
+
+func buildEtagSpiResponse(header http.Header) *http.Response {
+	return &http.Response{
+		Status:     "200 OK",
+		StatusCode: 200,
+		Header:     header,
+		Body:       ioutil.NopCloser(bytes.NewBufferString(`{"some": "response"}`)),
+	}
+}
+
+func TestHandleSpiResponseETag(t *testing.T) {
+	server := newEndpointsServer()
+	w := httptest.NewRecorder()
+	origRequest := buildApiRequest("/_ah/api/test", "{}", nil)
+	spiRequest, err := origRequest.copy()
+	assert.NoError(t, err)
+	body, err := handleSpiResponse(server, origRequest, spiRequest,
+		buildEtagSpiResponse(http.Header{}), etagMethodConfig, w)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, computeETag(body), w.Header().Get("ETag"))
+}
+
+func TestHandleSpiResponseBackendETag(t *testing.T) {
+	server := newEndpointsServer()
+	w := httptest.NewRecorder()
+	origRequest := buildApiRequest("/_ah/api/test", "{}", nil)
+	spiRequest, err := origRequest.copy()
+	assert.NoError(t, err)
+	_, err = handleSpiResponse(server, origRequest, spiRequest,
+		buildEtagSpiResponse(http.Header{"Etag": []string{`"v1"`}}),
+		etagMethodConfig, w)
+	assert.NoError(t, err)
+	assert.Equal(t, `"v1"`, w.Header().Get("ETag"))
+}
+
+func TestHandleSpiResponseNotModified(t *testing.T) {
+	server := newEndpointsServer()
+	w := httptest.NewRecorder()
+	origRequest := buildApiRequest("/_ah/api/test", "{}",
+		http.Header{"If-None-Match": []string{`"x", "v1"`}})
+	spiRequest, err := origRequest.copy()
+	assert.NoError(t, err)
+	_, err = handleSpiResponse(server, origRequest, spiRequest,
+		buildEtagSpiResponse(http.Header{"Etag": []string{`"v1"`}}),
+		etagMethodConfig, w)
+	assert.NoError(t, err)
+	assertHttpMatchRecorder(t, w, 304, http.Header{"Etag": []string{`"v1"`}}, "")
+}
+
+func TestHandleSpiResponseNoETagForPost(t *testing.T) {
+	server := newEndpointsServer()
+	w := httptest.NewRecorder()
+	origRequest := buildApiRequest("/_ah/api/test", "{}", nil)
+	spiRequest, err := origRequest.copy()
+	assert.NoError(t, err)
+	_, err = handleSpiResponse(server, origRequest, spiRequest,
+		buildEtagSpiResponse(http.Header{}),
+		&endpoints.ApiMethod{HttpMethod: "POST"}, w)
+	assert.NoError(t, err)
+	assert.Empty(t, w.Header().Get("ETag"))
+}
+
+// Dispatch a PUT with the given If-Match header to a backend whose GET
+// method returns an entity with ETag "v1" and whose update method responds
+// with the given status.
+func dispatchIfMatch(t *testing.T, ifMatch string, updateStatus int) (*httptest.ResponseRecorder, int) {
+	config := &endpoints.ApiDescriptor{
+		Name:    "guestbook_api",
+		Version: "v1",
+		Methods: map[string]*endpoints.ApiMethod{
+			"guestbook.get": etagMethodConfig,
+			"guestbook.update": &endpoints.ApiMethod{
+				HttpMethod: "PUT",
+				Path:       "greetings/{gid}",
+				RosyMethod: "MyApi.greetings_update",
+			},
+		},
+	}
+	server := newEndpointsServer()
+	ts := prepareTestServer(t, config)
+	server.url = ts.URL
+	defer ts.Close()
+
+	updates := 0
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/_ah/spi/MyApi.greetings_get":
+			assert.Empty(t, r.Header.Get("If-Match"))
+			w.Header().Set("ETag", `"v1"`)
+		case "/_ah/spi/MyApi.greetings_update":
+			// The backend is left to enforce the precondition.
+			assert.Equal(t, ifMatch, r.Header.Get("If-Match"))
+			updates++
+			w.WriteHeader(updateStatus)
+		}
+		fmt.Fprint(w, `{"some": "response"}`)
+	}))
+	defer ts2.Close()
+
+	server.SetSpiUrlBuilder(SpiUrlBuilderFunc(func(ed *EndpointsServer, spiRequest *ApiRequest) string {
+		return ts2.URL + fmt.Sprintf(spiRootFormat, spiRequest.URL.Path)
+	}))
+
+	req := buildRequest("/_ah/api/guestbook_api/v1/greetings/1", `{"text": "x"}`,
+		http.Header{"If-Match": []string{ifMatch}})
+	req.Method = "PUT"
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	return w, updates
+}
+
+func TestIfMatchPreconditionMet(t *testing.T) {
+	w, updates := dispatchIfMatch(t, `"v1"`, 200)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 1, updates)
+}
+
+func TestIfMatchPreconditionFailedByBackend(t *testing.T) {
+	// The entity changed between the proxy's check and the update.
+	w, updates := dispatchIfMatch(t, `"v1"`, 412)
+	assert.Equal(t, 412, w.Code)
+	assert.Equal(t, 1, updates)
+	assert.Contains(t, w.Body.String(), `"reason": "conditionNotMet"`)
+	assert.Contains(t, w.Body.String(), `Precondition failed: \"v1\"`)
+}
+
+func TestIfMatchPreconditionFailed(t *testing.T) {
+	w, updates := dispatchIfMatch(t, `"v0"`, 200)
+	assert.Equal(t, 412, w.Code)
+	assert.Equal(t, 0, updates)
+	assert.Contains(t, w.Body.String(), `"reason": "conditionNotMet"`)
+}
@@ -0,0 +1,130 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// Health endpoints for orchestrators.
+//
+// /healthz reports that the process is up and serving HTTP. /readyz
+// reports whether the server can serve API requests: a set of API
+// configurations has loaded, no backend is failing and every backend with
+// replicas has one in rotation.
+
+const defaultHealthPrefix = "/"
+
+// Returns the paths of the health endpoints.
+func (ed *EndpointsServer) healthPaths() (healthz, readyz string) {
+	prefix := ed.healthPrefix
+	if prefix == "" {
+		prefix = defaultHealthPrefix
+	}
+	return path.Join("/", prefix, "healthz"), path.Join("/", prefix, "readyz")
+}
+
+// Reports whether a path is under the server's root, where it would hide
+// API paths.
+func (ed *EndpointsServer) underRoot(p string) bool {
+	return strings.HasPrefix(p+"/", strings.TrimSuffix(ed.root, "/")+"/")
+}
+
+// SetHealthPrefix sets the path prefix of the /healthz and /readyz
+// endpoints registered by HandleHttp, which is "/" by default. Returns an
+// error, and leaves the prefix unchanged, if the endpoints would be under
+// the server's root.
+func (ed *EndpointsServer) SetHealthPrefix(prefix string) error {
+	old := ed.healthPrefix
+	ed.healthPrefix = prefix
+	if healthz, _ := ed.healthPaths(); ed.underRoot(healthz) {
+		ed.healthPrefix = old
+		return fmt.Errorf("Health endpoint %s is under the API root %s", healthz, ed.root)
+	}
+	return nil
+}
+
+// Registers the health endpoints with the given mux, unless they are
+// under the server's root.
+func (ed *EndpointsServer) handleHealth(mux *http.ServeMux) {
+	healthz, readyz := ed.healthPaths()
+	if ed.underRoot(healthz) {
+		ed.log().Warn("Health endpoints not registered under the API root",
+			"path", healthz, "root", ed.root)
+		return
+	}
+	mux.HandleFunc(healthz, ed.HandleHealthzRequest)
+	mux.HandleFunc(readyz, ed.HandleReadyzRequest)
+}
+
+// Handler for liveness checks. Always responds with 200 and "ok".
+func (ed *EndpointsServer) HandleHealthzRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprintln(w, "ok")
+}
+
+// Handler for readiness checks. Responds with 200 and "ok" if the server
+// is ready to serve API requests, or else with 503 and "not ready". The
+// reasons the server isn't ready name internal backends, so they are
+// logged and served by the admin readyz endpoint rather than here.
+func (ed *EndpointsServer) HandleReadyzRequest(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	problems := ed.readinessProblems()
+	if len(problems) == 0 {
+		fmt.Fprintln(w, "ok")
+		return
+	}
+	ed.log().Warn("Server not ready", "problems", problems)
+	w.WriteHeader(http.StatusServiceUnavailable)
+	fmt.Fprintln(w, "not ready")
+}
+
+// Returns the reasons the server isn't ready to serve API requests.
+func (ed *EndpointsServer) readinessProblems() []string {
+	var problems []string
+	if ed.lifecycle.isShuttingDown() {
+		problems = append(problems, "Server is shutting down")
+	}
+	ed.configStatus.lock.Lock()
+	loaded := !ed.configStatus.lastSuccess.IsZero()
+	ed.configStatus.lock.Unlock()
+	if !loaded {
+		// Configurations from the backends are otherwise only loaded when
+		// requests arrive.
+		if err := ed.loadApiConfigs(); err != nil {
+			problems = append(problems, "API configs not loaded: "+err.Error())
+		}
+	}
+	for _, status := range ed.BackendStatus() {
+		if !status.Healthy {
+			problems = append(problems, fmt.Sprintf("Backend %s is unhealthy: %s",
+				status.URL, status.LastError))
+		}
+	}
+	for _, pool := range ed.replicaPools() {
+		available := false
+		for _, status := range pool.statuses() {
+			available = available || status.Available
+		}
+		if !available {
+			problems = append(problems, fmt.Sprintf("No replica of backend %s is available",
+				pool.backend))
+		}
+	}
+	return problems
+}
@@ -0,0 +1,99 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func serveHealth(mux *http.ServeMux, path string) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, buildRequest(path, "", nil))
+	return w
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	ts := httptest.NewServer(newSpiHandler())
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	mux := http.NewServeMux()
+	server.HandleHttp(mux)
+
+	w := serveHealth(mux, "/healthz")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "ok\n", w.Body.String())
+
+	// The API configs are loaded by the readiness check.
+	w = serveHealth(mux, "/readyz")
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "ok\n", w.Body.String())
+
+	for i := 0; i < backendUnhealthyThreshold; i++ {
+		server.backendHealth.record(ts.URL, nil, errors.New("connection refused"))
+	}
+	w = serveHealth(mux, "/readyz")
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, "not ready\n", w.Body.String())
+	assert.Equal(t, 200, serveHealth(mux, "/healthz").Code)
+
+	// The reasons are only given by the admin endpoint.
+	adminMux := http.NewServeMux()
+	server.HandleAdmin(adminMux, "/_admin")
+	var readiness adminReadiness
+	assert.Equal(t, 503, adminRequest(t, adminMux, "GET", "/_admin/readyz", &readiness))
+	assert.False(t, readiness.Ready)
+	assert.Equal(t, []string{"Backend " + ts.URL + " is unhealthy: connection refused"},
+		readiness.Problems)
+}
+
+func TestReadyzWithoutConfigs(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	mux := http.NewServeMux()
+	server.HandleHttp(mux)
+
+	var buf bytes.Buffer
+	server.SetLogger(newTestLogger(&buf))
+	w := serveHealth(mux, "/readyz")
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, "not ready\n", w.Body.String())
+	assert.Contains(t, buf.String(), "API configs not loaded: ")
+}
+
+func TestSetHealthPrefix(t *testing.T) {
+	u, _ := url.Parse("http://localhost:8080")
+	server := NewEndpointsServer(u)
+	assert.Error(t, server.SetHealthPrefix("/_ah/api/status"))
+	assert.Error(t, server.SetHealthPrefix("/_ah/api"))
+	assert.NoError(t, server.SetHealthPrefix("/_status"))
+
+	mux := http.NewServeMux()
+	server.HandleHttp(mux)
+	assert.Equal(t, 200, serveHealth(mux, "/_status/healthz").Code)
+	assert.Equal(t, 404, serveHealth(mux, "/healthz").Code)
+
+	// Health endpoints would hide the APIs of a server at the root.
+	root := NewEndpointsServerRoot("/", u)
+	assert.Error(t, root.SetHealthPrefix("/"))
+}
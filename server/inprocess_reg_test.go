@@ -0,0 +1,93 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+// Regression tests for dispatch to a go-endpoints server in the same
+// process.
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Serves the test API with the SPI called in-process rather than over
+// HTTP. The SPI handlers aren't registered with the server's mux, so any
+// request that went over the network would fail.
+func initInProcessTestApi(t *testing.T) *httptest.Server {
+	spiMux := http.NewServeMux()
+	newTestSpi(t).HandleHttp(spiMux)
+
+	u, _ := url.Parse("http://in-process")
+	server := NewEndpointsServer(u)
+	server.SetSpiTransport(NewHandlerSpiTransport(spiMux))
+
+	mux := http.NewServeMux()
+	server.HandleHttp(mux)
+	return httptest.NewServer(mux)
+}
+
+// Test that a GET request to a REST API works in-process.
+func TestInProcessRestGet(t *testing.T) {
+	ts := initInProcessTestApi(t)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/_ah/api/test_service/v1/test")
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, 200)
+	assert.Equal(t, resp.Header.Get("Content-Type"), "application/json")
+
+	body, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	var responseJson map[string]interface{}
+	err = json.Unmarshal(body, &responseJson)
+	assert.NoError(t, err)
+
+	expected := map[string]interface{}{"text": "Test response"}
+	assert.Equal(t, expected, responseJson)
+}
+
+// Test that a POST request to a REST API works in-process.
+func TestInProcessRestPost(t *testing.T) {
+	ts := initInProcessTestApi(t)
+	defer ts.Close()
+
+	body, err := json.Marshal(map[string]interface{}{
+		"name":   "MyName",
+		"number": 23,
+	})
+	assert.NoError(t, err)
+
+	resp, err := http.Post(ts.URL+"/_ah/api/test_service/v1/t2path",
+		"application/json", bytes.NewBuffer(body))
+	assert.NoError(t, err)
+	assert.Equal(t, resp.StatusCode, 200)
+
+	content, err := ioutil.ReadAll(resp.Body)
+	assert.NoError(t, err)
+
+	var responseJson map[string]interface{}
+	err = json.Unmarshal(content, &responseJson)
+	assert.NoError(t, err)
+
+	expected := map[string]interface{}{"text": "MyName 23"}
+	assert.Equal(t, expected, responseJson)
+}
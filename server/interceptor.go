@@ -0,0 +1,156 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"net/http"
+)
+
+// Interception of API calls.
+//
+// Interceptors run once a call's method has been resolved and its request
+// transformed for the SPI, for REST and JSON-RPC calls alike. Each may
+// inspect or modify the call, stop it by returning an error, or rewrite
+// the response produced by the rest of the chain. The response is
+// buffered, rather than streamed, while any interceptors are installed,
+// except for media downloads, which are streamed to the client as usual.
+
+// Call is an API call passing through the server's interceptors.
+type Call struct {
+	// The request from the client.
+	OrigRequest *ApiRequest
+
+	// The name of the API method called, such as "guestbook.get", and its
+	// configuration.
+	MethodName string
+	Method     *endpoints.ApiMethod
+
+	// True for JSON-RPC calls, false for REST calls.
+	Rpc bool
+
+	// Parameters taken from the path of a REST call. Nil for JSON-RPC.
+	Params map[string]string
+
+	// The request sent to the SPI. Interceptors may replace its body.
+	SpiRequest *ApiRequest
+
+	// Headers sent to the SPI in addition to those passed on from the
+	// client's request, such as If-Match. Interceptors may add to them.
+	SpiHeader http.Header
+
+	// Serves the call in place of the usual dispatch to the SPI, as for
+	// media uploads. Nil for other calls.
+	dispatch func(w http.ResponseWriter, call *Call) (string, error)
+}
+
+// CallResponse is the response to an API call, before it is written.
+type CallResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+
+	// True if the response, a media download, has already been streamed
+	// to the client. Its Body is nil and it can't be rewritten.
+	Streamed bool
+}
+
+// CallHandler continues an intercepted call through the rest of the chain.
+type CallHandler func(call *Call) (*CallResponse, error)
+
+// Interceptor intercepts API calls. It calls next to continue the call and
+// may return its response, a rewritten response or an error. An error
+// made with NewRequestError is reported to the client in the format of
+// the call; other errors give a 500 response.
+type Interceptor func(call *Call, next CallHandler) (*CallResponse, error)
+
+// NewRequestError returns an error that an Interceptor can return to fail
+// a call with the given HTTP status. The error reason and domain are those
+// the live server would report for the status.
+func NewRequestError(status int, message string) error {
+	err := newStatusError(status, message)
+	return &err
+}
+
+// AddInterceptor adds an interceptor to the end of the server's chain.
+// Interceptors run in the order they were added, so the first added sees
+// calls first and responses last. It must not be called while the server
+// is serving requests.
+func (ed *EndpointsServer) AddInterceptor(i Interceptor) {
+	ed.interceptors = append(ed.interceptors, i)
+}
+
+// Passes a call through the interceptors and writes the response.
+func (ed *EndpointsServer) intercept(w http.ResponseWriter, call *Call) (string, error) {
+	if len(ed.interceptors) == 0 {
+		return ed.serveCall(w, call)
+	}
+	handler := CallHandler(func(call *Call) (*CallResponse, error) {
+		if ed.isMediaDownload(call.OrigRequest) {
+			sw := &statusResponseWriter{ResponseWriter: w}
+			if _, err := ed.serveCall(sw, call); err != nil {
+				return nil, err
+			}
+			return &CallResponse{StatusCode: sw.statusCode(), Header: w.Header(), Streamed: true}, nil
+		}
+		bw := newBufferedResponseWriter()
+		if _, err := ed.serveCall(bw, call); err != nil {
+			return nil, err
+		}
+		return &CallResponse{StatusCode: bw.status, Header: bw.header, Body: bw.body.Bytes()}, nil
+	})
+	for i := len(ed.interceptors) - 1; i >= 0; i-- {
+		interceptor, next := ed.interceptors[i], handler
+		handler = func(call *Call) (*CallResponse, error) {
+			return interceptor(call, next)
+		}
+	}
+
+	resp, err := handler(call)
+	if err != nil {
+		return "", err
+	}
+	if resp == nil {
+		return "", errors.New("Interceptor returned no response")
+	}
+	if resp.Streamed {
+		return "", nil
+	}
+	for k, vals := range resp.Header {
+		w.Header()[k] = vals
+	}
+	if w.Header().Get("Content-Length") != "" {
+		// The body may have been rewritten.
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", len(resp.Body)))
+	}
+	status := resp.StatusCode
+	if status == 0 {
+		status = http.StatusOK
+	}
+	w.WriteHeader(status)
+	w.Write(resp.Body)
+	return string(resp.Body), nil
+}
+
+// WithInterceptors adds interceptors to the server's chain.
+func WithInterceptors(interceptors ...Interceptor) ServerOption {
+	return func(ed *EndpointsServer) {
+		for _, i := range interceptors {
+			ed.AddInterceptor(i)
+		}
+	}
+}
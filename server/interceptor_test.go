@@ -0,0 +1,109 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+// Starts a backend whose methods respond with the X-User header they were
+// sent, counting the calls made.
+func startHeaderBackend() (*httptest.Server, *int) {
+	calls := 0
+	spi := newSpiHandler()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/_ah/spi/MyApi.get" {
+			spi.ServeHTTP(w, r)
+			return
+		}
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"user": %q}`, r.Header.Get("X-User"))
+	}))
+	return ts, &calls
+}
+
+func TestInterceptorRewrites(t *testing.T) {
+	ts, _ := startHeaderBackend()
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+
+	var order []string
+	server := NewEndpointsServer(u, WithInterceptors(
+		func(call *Call, next CallHandler) (*CallResponse, error) {
+			order = append(order, "outer "+call.MethodName)
+			call.SpiHeader.Set("X-User", "alice")
+			return next(call)
+		},
+		func(call *Call, next CallHandler) (*CallResponse, error) {
+			order = append(order, "inner "+call.Method.RosyMethod)
+			resp, err := next(call)
+			if err == nil {
+				resp.Header.Set("X-Intercepted", "true")
+				resp.Body = bytes.Replace(resp.Body, []byte("alice"), []byte("bob"), 1)
+			}
+			return resp, err
+		},
+	))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "true", w.Header().Get("X-Intercepted"))
+	assert.Contains(t, w.Body.String(), `"user": "bob"`)
+	assert.Equal(t, fmt.Sprintf("%d", w.Body.Len()), w.Header().Get("Content-Length"))
+	assert.Equal(t, []string{"outer a_api.get", "inner MyApi.get"}, order)
+}
+
+func TestInterceptorShortCircuit(t *testing.T) {
+	ts, calls := startHeaderBackend()
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	server.AddInterceptor(func(call *Call, next CallHandler) (*CallResponse, error) {
+		if call.OrigRequest.Header.Get("Authorization") == "" {
+			return nil, NewRequestError(http.StatusForbidden, "Not allowed")
+		}
+		return next(call)
+	})
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 403, w.Code)
+	assert.Contains(t, w.Body.String(), `"reason": "forbidden"`)
+	assert.Contains(t, w.Body.String(), `"message": "Not allowed"`)
+
+	req := buildRequest("/_ah/api/rpc",
+		`{"jsonrpc": "2.0", "method": "a_api.get", "apiVersion": "v1", "id": 1, "params": {"id": "1"}}`, nil)
+	req.Method = "POST"
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `"code": 403`)
+	assert.Contains(t, w.Body.String(), `"message": "Not allowed"`)
+	assert.Equal(t, 0, *calls)
+
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "",
+		http.Header{"Authorization": []string{"Bearer x"}}))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 1, *calls)
+}
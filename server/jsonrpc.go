@@ -0,0 +1,60 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// JSON-RPC 2.0 request validation.
+
+const jsonrpcVersion = "2.0"
+
+// Returns true if id is a valid JSON-RPC request id: a string, a number
+// or null.
+func isValidJsonrpcId(id interface{}) bool {
+	switch id.(type) {
+	case nil, string, json.Number, float64:
+		return true
+	}
+	return false
+}
+
+// Checks that a JSON-RPC request is well formed.
+//
+// Returns a jsonRpcError with the invalid request or invalid params code
+// if it isn't.
+func validateJsonrpcRequest(bodyJson map[string]interface{}) error {
+	if version, ok := bodyJson["jsonrpc"]; ok && version != jsonrpcVersion {
+		return newJsonRpcError(jsonrpcInvalidRequest,
+			fmt.Sprintf("Unsupported JSON-RPC version: %v", version))
+	}
+	if _, ok := bodyJson["method"].(string); !ok {
+		return newJsonRpcError(jsonrpcInvalidRequest,
+			fmt.Sprintf("Invalid method: %#v", bodyJson["method"]))
+	}
+	if !isValidJsonrpcId(bodyJson["id"]) {
+		return newJsonRpcError(jsonrpcInvalidRequest,
+			fmt.Sprintf("Invalid request ID: %#v", bodyJson["id"]))
+	}
+	if params, ok := bodyJson["params"]; ok {
+		if _, ok := params.(map[string]interface{}); !ok {
+			return newJsonRpcError(jsonrpcInvalidParams,
+				fmt.Sprintf("Params must be an object: %#v", params))
+		}
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestValidateJsonrpcRequest(t *testing.T) {
+	valid := func(body string) error {
+		var bodyJson map[string]interface{}
+		assert.NoError(t, json.Unmarshal([]byte(body), &bodyJson))
+		return validateJsonrpcRequest(bodyJson)
+	}
+	assert.NoError(t, valid(`{"method": "a", "id": 1}`))
+	assert.NoError(t, valid(`{"jsonrpc": "2.0", "method": "a", "id": null, "params": {}}`))
+	assert.Equal(t, jsonrpcInvalidRequest, valid(`{"jsonrpc": "1.0", "method": "a"}`).(*jsonRpcError).rpcCode)
+	assert.Equal(t, jsonrpcInvalidRequest, valid(`{"method": 1}`).(*jsonRpcError).rpcCode)
+	assert.Equal(t, jsonrpcInvalidRequest, valid(`{"method": "a", "id": {}}`).(*jsonRpcError).rpcCode)
+	assert.Equal(t, jsonrpcInvalidParams, valid(`{"method": "a", "params": [1]}`).(*jsonRpcError).rpcCode)
+}
+
+// Serve a JSON-RPC request against a backend that echoes its params.
+func serveJsonrpc(t *testing.T, body string) (*httptest.ResponseRecorder, int) {
+	config := &endpoints.ApiDescriptor{
+		Name:    "guestbook_api",
+		Version: "v1",
+		Methods: map[string]*endpoints.ApiMethod{
+			"guestbook.get": &endpoints.ApiMethod{
+				HttpMethod: "GET",
+				Path:       "greetings/{gid}",
+				RosyMethod: "MyApi.greetings_get",
+			},
+		},
+	}
+	server := newEndpointsServer()
+	ts := prepareTestServer(t, config)
+	server.url = ts.URL
+	defer ts.Close()
+
+	calls := 0
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		params, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, string(params))
+	}))
+	defer ts2.Close()
+	server.SetSpiUrlBuilder(SpiUrlBuilderFunc(func(ed *EndpointsServer, spiRequest *ApiRequest) string {
+		return ts2.URL + fmt.Sprintf(spiRootFormat, spiRequest.URL.Path)
+	}))
+
+	w := httptest.NewRecorder()
+	req := buildRequest("/_ah/api/rpc", body, nil)
+	req.Method = "POST"
+	server.ServeHTTP(w, req)
+	return w, calls
+}
+
+func TestJsonrpcNumericId(t *testing.T) {
+	w, _ := serveJsonrpc(t, `{"jsonrpc": "2.0", "method": "guestbook.get", "apiVersion": "v1",
+		"id": 12345678901234567890, "params": {"gid": 9007199254740993}}`)
+	assert.Equal(t, 200, w.Code)
+	expected := `{
+  "id": 12345678901234567890,
+  "jsonrpc": "2.0",
+  "result": {
+    "gid": 9007199254740993
+  }
+}`
+	assert.Equal(t, expected, w.Body.String())
+}
+
+func TestJsonrpcNotification(t *testing.T) {
+	w, calls := serveJsonrpc(t, `{"jsonrpc": "2.0", "method": "guestbook.get", "apiVersion": "v1"}`)
+	assert.Equal(t, 204, w.Code)
+	assert.Equal(t, 1, calls)
+	assert.Empty(t, w.Body.String())
+}
+
+func assertJsonrpcError(t *testing.T, w *httptest.ResponseRecorder, code int, id interface{}) {
+	assert.Equal(t, 200, w.Code)
+	var response map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &response))
+	assert.Equal(t, "2.0", response["jsonrpc"])
+	assert.Equal(t, id, response["id"])
+	errorJson, ok := response["error"].(map[string]interface{})
+	if assert.True(t, ok) {
+		assert.Equal(t, float64(code), errorJson["code"])
+	}
+}
+
+func TestJsonrpcParseError(t *testing.T) {
+	w, calls := serveJsonrpc(t, `{"method": "guestbook.get"`)
+	assertJsonrpcError(t, w, jsonrpcParseError, nil)
+	assert.Equal(t, 0, calls)
+}
+
+func TestJsonrpcMethodNotFound(t *testing.T) {
+	w, calls := serveJsonrpc(t, `{"method": "guestbook.nope", "apiVersion": "v1", "id": 7}`)
+	assertJsonrpcError(t, w, jsonrpcMethodNotFound, float64(7))
+	assert.Equal(t, 0, calls)
+}
+
+func TestJsonrpcInvalidParams(t *testing.T) {
+	w, _ := serveJsonrpc(t, `{"method": "guestbook.get", "apiVersion": "v1", "id": "a", "params": [1]}`)
+	assertJsonrpcError(t, w, jsonrpcInvalidParams, "a")
+}
+
+func TestJsonrpcInvalidRequest(t *testing.T) {
+	w, _ := serveJsonrpc(t, `{"jsonrpc": "2.0", "method": 5, "id": "a"}`)
+	assertJsonrpcError(t, w, jsonrpcInvalidRequest, "a")
+}
@@ -0,0 +1,216 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Lifecycle of the server's background work.
+//
+// Start loads the API configurations and starts the config watcher.
+// Shutdown stops new API requests from being served, abandons open upload
+// sessions, waits for the requests in progress and their SPI calls to
+// finish, and then stops the watcher and the health checks of backend
+// replicas and shuts down the span exporter.
+
+// How often Shutdown checks whether requests have drained.
+const drainPollInterval = 10 * time.Millisecond
+
+// Time the span exporter is given to shut down if Shutdown's context is
+// done before the requests have drained.
+const exporterShutdownGrace = time.Second
+
+// Error that ends the SPI calls of upload sessions open on shutdown.
+var errShuttingDown = errors.New("Server is shutting down")
+
+// State of the server's lifecycle.
+type lifecycle struct {
+	started      bool
+	shuttingDown int32 // Set atomically.
+	stop         chan struct{}
+	background   sync.WaitGroup
+	lock         sync.Mutex
+
+	// Interval at which the config watcher checks config files, or the
+	// backends, for changes. The watcher isn't started if it is zero.
+	watchInterval time.Duration
+
+	// SPI calls in progress, updated atomically.
+	spiCalls int64
+}
+
+// Returns the channel that is closed when the server shuts down.
+func (l *lifecycle) stopChan() chan struct{} {
+	if l.stop == nil {
+		l.stop = make(chan struct{})
+	}
+	return l.stop
+}
+
+// Reports whether the server is shutting down.
+func (l *lifecycle) isShuttingDown() bool {
+	return atomic.LoadInt32(&l.shuttingDown) != 0
+}
+
+// Runs f in the background until the server shuts down. It must be called
+// with the lock held.
+func (l *lifecycle) goBackground(f func(stop <-chan struct{})) {
+	stop := l.stopChan()
+	l.background.Add(1)
+	go func() {
+		defer l.background.Done()
+		f(stop)
+	}()
+}
+
+// SetConfigWatchInterval sets the interval at which the config watcher
+// started by Start checks file and directory config sources, or the
+// configurations reported by the backends, for changes. By default no
+// watcher is started, and the backends are only asked for their
+// configurations again by ReloadApiConfigs.
+func (ed *EndpointsServer) SetConfigWatchInterval(d time.Duration) {
+	ed.lifecycle.lock.Lock()
+	defer ed.lifecycle.lock.Unlock()
+	ed.lifecycle.watchInterval = d
+}
+
+// Start loads the API configurations and, if a watch interval has been
+// set, starts watching them for changes as WatchApiConfigs does. A failure
+// to load the configurations is logged, and reported by the readiness
+// endpoint, rather than returned, as the backends may not be up yet. The
+// background work stops when ctx is done or the server is shut down;
+// requests are still served until Shutdown is called.
+func (ed *EndpointsServer) Start(ctx context.Context) error {
+	l := &ed.lifecycle
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.isShuttingDown() {
+		return errors.New("Server has been shut down")
+	}
+	if l.started {
+		return errors.New("Server already started")
+	}
+	l.started = true
+
+	if err := ed.loadApiConfigs(); err != nil {
+		ed.log().Warn("API configs not loaded on start", "error", err)
+	}
+	if l.watchInterval > 0 {
+		interval := l.watchInterval
+		l.goBackground(func(stop <-chan struct{}) {
+			ed.WatchApiConfigs(interval, stop)
+		})
+	}
+	l.goBackground(func(stop <-chan struct{}) {
+		select {
+		case <-ctx.Done():
+			ed.stopBackground()
+		case <-stop:
+		}
+	})
+	return nil
+}
+
+// Responds with 503 to a request that arrives once the server has begun
+// shutting down, and returns true if it did.
+func (ed *EndpointsServer) rejectIfShuttingDown(w http.ResponseWriter, ar *ApiRequest) bool {
+	if !ed.lifecycle.isShuttingDown() {
+		return false
+	}
+	err := newStatusError(http.StatusServiceUnavailable, errShuttingDown.Error())
+	ed.handleRequestError(w, ar, &err)
+	return true
+}
+
+// Stops the server's background work: the config watcher and the health
+// checks of backend replicas. The replicas are kept, so that calls are
+// still balanced across them.
+func (ed *EndpointsServer) stopBackground() {
+	ed.lifecycle.lock.Lock()
+	stop := ed.lifecycle.stopChan()
+	select {
+	case <-stop:
+	default:
+		close(stop)
+	}
+	ed.lifecycle.lock.Unlock()
+
+	for _, pool := range ed.replicaPools() {
+		pool.close()
+	}
+}
+
+// Waits for the requests in progress and their SPI calls to finish, or
+// for ctx to be done, in which case its error is returned.
+func (ed *EndpointsServer) drain(ctx context.Context) error {
+	ticker := time.NewTicker(drainPollInterval)
+	defer ticker.Stop()
+	for atomic.LoadInt64(&ed.metrics.inFlight) > 0 || atomic.LoadInt64(&ed.lifecycle.spiCalls) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// Shutdown gracefully shuts down the server. New API requests are
+// rejected with 503, the readiness endpoint reports the server as not
+// ready, and open upload sessions are abandoned. Once the requests in
+// progress and their SPI calls have finished, the background work is
+// stopped and the span exporter is shut down. If ctx is done first, its
+// error is returned and the requests still in progress are left to finish
+// by themselves, but the background work is still stopped and the span
+// exporter is given a short grace period to flush its spans.
+func (ed *EndpointsServer) Shutdown(ctx context.Context) error {
+	l := &ed.lifecycle
+	atomic.StoreInt32(&l.shuttingDown, 1)
+	ed.uploads.abortAll(errShuttingDown)
+
+	err := ed.drain(ctx)
+	ed.stopBackground()
+	if err == nil {
+		stopped := make(chan struct{})
+		go func() {
+			l.background.Wait()
+			close(stopped)
+		}()
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+		case <-stopped:
+		}
+	}
+
+	if ed.spanExporter != nil {
+		exportCtx := ctx
+		if err != nil {
+			var cancel context.CancelFunc
+			exportCtx, cancel = context.WithTimeout(context.Background(), exporterShutdownGrace)
+			defer cancel()
+		}
+		if exportErr := ed.spanExporter.Shutdown(exportCtx); err == nil {
+			err = exportErr
+		}
+	}
+	return err
+}
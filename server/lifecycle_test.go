@@ -0,0 +1,207 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// Starts a backend whose MyApi.get calls block until release is closed.
+func startBlockingBackend() (ts *httptest.Server, release chan struct{}) {
+	release = make(chan struct{})
+	spi := newSpiHandler()
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ah/spi/MyApi.get" {
+			<-release
+		}
+		spi.ServeHTTP(w, r)
+	}))
+	return ts, release
+}
+
+// Waits for an SPI call to be in progress.
+func waitForSpiCall(t *testing.T, server *EndpointsServer) {
+	deadline := time.Now().Add(5 * time.Second)
+	for atomic.LoadInt64(&server.lifecycle.spiCalls) == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("No SPI call started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// Span exporter that records whether it was shut down.
+type shutdownExporter struct {
+	shutdown bool
+}
+
+func (e *shutdownExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	return nil
+}
+
+func (e *shutdownExporter) Shutdown(ctx context.Context) error {
+	e.shutdown = true
+	return nil
+}
+
+func TestShutdownDrainsRequests(t *testing.T) {
+	ts, release := startBlockingBackend()
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	exporter := &shutdownExporter{}
+	server.SetSpanExporter(exporter)
+
+	inFlight := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		server.ServeHTTP(inFlight, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+		close(served)
+	}()
+	waitForSpiCall(t, server)
+
+	shutdown := make(chan error)
+	go func() {
+		shutdown <- server.Shutdown(context.Background())
+	}()
+	select {
+	case <-shutdown:
+		t.Fatal("Shutdown returned before the request finished")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// New requests are rejected while shutting down.
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 503, w.Code)
+	assert.Contains(t, w.Body.String(), "Server is shutting down")
+	w = httptest.NewRecorder()
+	server.HandleReadyzRequest(w, buildRequest("/readyz", "", nil))
+	assert.Equal(t, 503, w.Code)
+
+	close(release)
+	assert.NoError(t, <-shutdown)
+	<-served
+	assert.Equal(t, 200, inFlight.Code)
+	assert.True(t, exporter.shutdown)
+}
+
+func TestShutdownDeadline(t *testing.T) {
+	ts, release := startBlockingBackend()
+	defer ts.Close()
+	defer close(release)
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	exporter := &shutdownExporter{}
+	server.SetSpanExporter(exporter)
+	server.SetReplicas(u, []*url.URL{u}, ReplicaOptions{
+		HealthCheckPath:     "/_ah/health",
+		HealthCheckInterval: time.Millisecond,
+	})
+	assert.NoError(t, server.Start(context.Background()))
+
+	go server.ServeHTTP(httptest.NewRecorder(), buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	waitForSpiCall(t, server)
+
+	// The background work is still stopped and the exporter shut down.
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, server.Shutdown(ctx))
+	assert.True(t, exporter.shutdown)
+	assertHealthChecksStopped(t, server, u)
+}
+
+// Checks that the health checks of a backend's replicas have stopped but
+// that the replicas are kept.
+func assertHealthChecksStopped(t *testing.T, server *EndpointsServer, u *url.URL) {
+	pool := server.replicaPool(formatBackendURL(u))
+	if assert.NotNil(t, pool) {
+		select {
+		case <-pool.stop:
+		default:
+			t.Error("Health checks not stopped")
+		}
+	}
+	assert.Equal(t, 1, len(server.ReplicaStatus(u)))
+}
+
+func TestStartStopsBackgroundWork(t *testing.T) {
+	ts := httptest.NewServer(newSpiHandler())
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	server.SetConfigWatchInterval(time.Millisecond)
+	server.SetReplicas(u, []*url.URL{u}, ReplicaOptions{
+		HealthCheckPath:     "/_ah/health",
+		HealthCheckInterval: time.Millisecond,
+	})
+
+	assert.NoError(t, server.Start(context.Background()))
+	assert.Error(t, server.Start(context.Background()))
+	assert.False(t, server.ConfigSourceStatus().LastSuccessTime.IsZero())
+
+	assert.NoError(t, server.Shutdown(context.Background()))
+	assertHealthChecksStopped(t, server, u)
+	assert.Error(t, server.Start(context.Background()))
+}
+
+func TestNoHealthChecksAfterShutdown(t *testing.T) {
+	var probes int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&probes, 1)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	assert.NoError(t, server.Shutdown(context.Background()))
+
+	server.SetReplicas(u, []*url.URL{u}, ReplicaOptions{
+		HealthCheckPath:     "/_ah/health",
+		HealthCheckInterval: time.Millisecond,
+	})
+	time.Sleep(20 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&probes))
+	assert.Equal(t, 1, len(server.ReplicaStatus(u)))
+}
+
+func TestStartContextStopsBackgroundWork(t *testing.T) {
+	ts := httptest.NewServer(newSpiHandler())
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	server.SetReplicas(u, []*url.URL{u}, ReplicaOptions{
+		HealthCheckPath:     "/_ah/health",
+		HealthCheckInterval: time.Millisecond,
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	assert.NoError(t, server.Start(ctx))
+	cancel()
+	server.lifecycle.background.Wait()
+	assertHealthChecksStopped(t, server, u)
+
+	// Requests are still served until Shutdown is called.
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.NoError(t, server.Shutdown(context.Background()))
+}
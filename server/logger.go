@@ -0,0 +1,141 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"log/slog"
+	"strings"
+	"time"
+)
+
+// Logger is a structured logger. Each method takes a message followed by
+// alternating keys and values, as those of *slog.Logger, which implements
+// it.
+type Logger interface {
+	Debug(msg string, args ...interface{})
+	Info(msg string, args ...interface{})
+	Warn(msg string, args ...interface{})
+	Error(msg string, args ...interface{})
+}
+
+// The value logged in place of a redacted parameter.
+const redacted = "[REDACTED]"
+
+// Returns the given logger, or the default slog logger if it is nil. The
+// default logger writes through the log package unless slog.SetDefault
+// has been called.
+func loggerOrDefault(l Logger) Logger {
+	if l == nil {
+		return slog.Default()
+	}
+	return l
+}
+
+// Returns the logger of the server.
+func (ed *EndpointsServer) log() Logger {
+	return loggerOrDefault(ed.logger)
+}
+
+// Returns the logger of the API config manager.
+func (m *apiConfigManager) log() Logger {
+	return loggerOrDefault(m.logger)
+}
+
+// SetLogger sets the logger of the server's diagnostics and access log.
+// Passing nil restores the default, which is slog.Default(). It must not
+// be called while the server is serving requests.
+func (ed *EndpointsServer) SetLogger(l Logger) {
+	ed.logger = l
+	ed.configManager.logger = l
+
+	ed.backendHealth.lock.Lock()
+	ed.backendHealth.logger = l
+	ed.backendHealth.lock.Unlock()
+
+	ed.breakers.lock.Lock()
+	ed.breakers.logger = l
+	ed.breakers.lock.Unlock()
+
+	for _, pool := range ed.replicaPools() {
+		pool.lock.Lock()
+		pool.logger = l
+		pool.lock.Unlock()
+	}
+
+	ed.transportLock.Lock()
+	if handlerTransport, ok := ed.transport.(*handlerSpiTransport); ok {
+		handlerTransport.logger = l
+	}
+	ed.transportLock.Unlock()
+}
+
+// WithLogger sets the logger of the server's diagnostics and access log.
+func WithLogger(l Logger) ServerOption {
+	return func(ed *EndpointsServer) {
+		ed.SetLogger(l)
+	}
+}
+
+// SetRedactedParams sets the names of the path parameters whose values
+// are replaced with "[REDACTED]" in the access log, such as "token".
+// Names are matched ignoring case.
+func (ed *EndpointsServer) SetRedactedParams(names ...string) {
+	redact := make(map[string]bool)
+	for _, name := range names {
+		redact[strings.ToLower(name)] = true
+	}
+	ed.redactedParams = redact
+}
+
+// Returns the path parameters of a request for the access log.
+func (ed *EndpointsServer) loggedParams(params map[string]string) map[string]string {
+	if len(params) == 0 {
+		return nil
+	}
+	logged := make(map[string]string, len(params))
+	for name, value := range params {
+		if ed.redactedParams[strings.ToLower(name)] {
+			value = redacted
+		}
+		logged[name] = value
+	}
+	return logged
+}
+
+// Writes the access log line of the request with the given id and HTTP
+// method. The API request is nil if the request couldn't be parsed.
+func (ed *EndpointsServer) logAccess(id, httpMethod string, ar *ApiRequest, w *statusResponseWriter, elapsed time.Duration) {
+	args := []interface{}{"request_id", id}
+	if ar != nil && ar.api.methodName != "" {
+		args = append(args,
+			"api", ar.api.methodName,
+			"version", ar.api.version,
+			"method", ar.Method,
+		)
+		if params := ed.loggedParams(ar.params); params != nil {
+			args = append(args, "params", params)
+		}
+	}
+	args = append(args,
+		"http_method", httpMethod,
+		"status", w.statusCode(),
+		"bytes", w.bytes,
+		"duration", elapsed,
+	)
+	if ar != nil && ar.stats.calledBackend() {
+		args = append(args, "backend_duration", ar.stats.backendTime())
+	}
+	ed.log().Info("API request", args...)
+}
@@ -0,0 +1,134 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"log/slog"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Returns the records written by a slog JSON handler.
+func readLogRecords(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var records []map[string]interface{}
+	scanner := bufio.NewScanner(bytes.NewReader(buf.Bytes()))
+	for scanner.Scan() {
+		var record map[string]interface{}
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func newTestLogger(buf *bytes.Buffer) *slog.Logger {
+	return slog.New(slog.NewJSONHandler(buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+}
+
+func TestAccessLog(t *testing.T) {
+	ts := httptest.NewServer(newSpiHandler())
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	var buf bytes.Buffer
+	server := NewEndpointsServer(u, WithLogger(newTestLogger(&buf)))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+
+	records := readLogRecords(t, &buf)
+	if assert.Equal(t, 1, len(records)) {
+		record := records[0]
+		assert.Equal(t, "INFO", record["level"])
+		assert.Equal(t, "API request", record["msg"])
+		assert.Equal(t, 16, len(record["request_id"].(string)))
+		assert.Equal(t, "a_api", record["api"])
+		assert.Equal(t, "v1", record["version"])
+		assert.Equal(t, "a_api.get", record["method"])
+		assert.Equal(t, map[string]interface{}{"id": "1"}, record["params"])
+		assert.Equal(t, "GET", record["http_method"])
+		assert.Equal(t, float64(200), record["status"])
+		assert.Equal(t, float64(w.Body.Len()), record["bytes"])
+		assert.NotNil(t, record["duration"])
+		assert.NotNil(t, record["backend_duration"])
+	}
+}
+
+func TestAccessLogRedactsParams(t *testing.T) {
+	ts := httptest.NewServer(newSpiHandler())
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	var buf bytes.Buffer
+	server := NewEndpointsServer(u, WithLogger(newTestLogger(&buf)))
+	server.SetRedactedParams("ID")
+
+	server.ServeHTTP(httptest.NewRecorder(), buildRequest("/_ah/api/a_api/v1/items/secret", "", nil))
+	records := readLogRecords(t, &buf)
+	if assert.Equal(t, 1, len(records)) {
+		assert.Equal(t, map[string]interface{}{"id": "[REDACTED]"}, records[0]["params"])
+	}
+	assert.False(t, strings.Contains(buf.String(), "secret"))
+}
+
+func TestConfigManagerLogger(t *testing.T) {
+	ts := httptest.NewServer(newSpiHandler())
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	var buf bytes.Buffer
+	server := NewEndpointsServer(u)
+	server.SetLogger(newTestLogger(&buf))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/missing", "", nil))
+	assert.Equal(t, 404, w.Code)
+
+	records := readLogRecords(t, &buf)
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, "DEBUG", records[0]["level"])
+		assert.Equal(t, "No endpoint found for path", records[0]["msg"])
+		assert.Equal(t, "a_api/v1/missing", records[0]["path"])
+		assert.Equal(t, "API request", records[1]["msg"])
+		assert.Equal(t, float64(404), records[1]["status"])
+		assert.Nil(t, records[1]["api"])
+	}
+}
+
+func TestDiagnosticsLogger(t *testing.T) {
+	u, _ := url.Parse(defaultURL)
+	var buf bytes.Buffer
+	server := NewEndpointsServer(u, WithLogger(newTestLogger(&buf)))
+	server.SetCircuitBreaker(&CircuitBreakerOptions{FailureThreshold: 1})
+
+	for i := 0; i < backendUnhealthyThreshold; i++ {
+		server.backendHealth.record(defaultURL, nil, errors.New("refused"))
+	}
+	key := breakerKey{defaultURL, "MyApi.get"}
+	server.breakers.allow(key)
+	server.breakers.record(key, nil, errors.New("refused"), false)
+
+	records := readLogRecords(t, &buf)
+	if assert.Equal(t, 2, len(records)) {
+		assert.Equal(t, "SPI backend is unhealthy", records[0]["msg"])
+		assert.Equal(t, "refused", records[0]["error"])
+		assert.Equal(t, "Circuit breaker is open", records[1]["msg"])
+		assert.Equal(t, "MyApi.get", records[1]["method"])
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// Media download support for REST methods.
+//
+// A REST request with the query parameter alt=media, to a method that has
+// media download enabled, has the backend's response streamed back to the
+// client unchanged instead of being treated as JSON.
+
+const (
+	headerRange        = "Range"
+	headerIfRange      = "If-Range"
+	headerContentRange = "Content-Range"
+)
+
+// Backend response headers that are passed on with downloaded media.
+var mediaResponseHeaders = []string{
+	"Content-Type",
+	"Content-Disposition",
+	"Content-Length",
+	"Content-Encoding",
+	headerContentRange,
+	"Accept-Ranges",
+	"Cache-Control",
+	headerETag,
+	"Last-Modified",
+}
+
+// SetMediaDownload enables or disables downloading of media with
+// alt=media for the named method, as used in the API configuration
+// (e.g. "files.get").
+func (ed *EndpointsServer) SetMediaDownload(methodName string, enabled bool) {
+	ed.mediaDownloadsLock.Lock()
+	defer ed.mediaDownloadsLock.Unlock()
+	if ed.mediaDownloads == nil {
+		ed.mediaDownloads = make(map[string]bool)
+	}
+	if enabled {
+		ed.mediaDownloads[methodName] = true
+	} else {
+		delete(ed.mediaDownloads, methodName)
+	}
+}
+
+// Returns true if the request is for the media of a method that has media
+// download enabled. The request's method must already have been looked up.
+func (ed *EndpointsServer) isMediaDownload(origRequest *ApiRequest) bool {
+	if origRequest.isRpc() || origRequest.URL.Query().Get("alt") != "media" {
+		return false
+	}
+	ed.mediaDownloadsLock.RLock()
+	defer ed.mediaDownloadsLock.RUnlock()
+	return ed.mediaDownloads[origRequest.Method]
+}
+
+// Parses a single byte range from a Range header for media of the given
+// size. The boolean result is false if the header can't be served as a
+// single range, in which case the whole media should be returned. If the
+// range can't be satisfied, first is -1.
+func parseByteRange(rangeHeader string, size int64) (first, last int64, ok bool) {
+	if !strings.HasPrefix(rangeHeader, "bytes=") || strings.Contains(rangeHeader, ",") {
+		return 0, 0, false
+	}
+	bounds := strings.SplitN(strings.TrimSpace(rangeHeader[len("bytes="):]), "-", 2)
+	if len(bounds) != 2 {
+		return 0, 0, false
+	}
+	var err error
+	if bounds[0] == "" {
+		// A suffix range, giving the number of bytes at the end.
+		n, err := strconv.ParseInt(bounds[1], 10, 64)
+		if err != nil {
+			return 0, 0, false
+		}
+		if n == 0 || size == 0 {
+			return -1, -1, true
+		}
+		if n > size {
+			n = size
+		}
+		return size - n, size - 1, true
+	}
+	if first, err = strconv.ParseInt(bounds[0], 10, 64); err != nil {
+		return 0, 0, false
+	}
+	last = size - 1
+	if bounds[1] != "" {
+		if last, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || last < first {
+			return 0, 0, false
+		}
+		if last >= size {
+			last = size - 1
+		}
+	}
+	if first >= size {
+		return -1, -1, true
+	}
+	return first, last, true
+}
+
+// Streams downloaded media from the SPI response to the client.
+//
+// If the backend returns the whole media for a request with a single byte
+// range, the requested range is extracted here and returned with a 206.
+func (ed *EndpointsServer) handleMediaResponse(origRequest *ApiRequest, response *http.Response, w http.ResponseWriter) (string, error) {
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusRequestedRangeNotSatisfiable {
+		if err := ed.checkErrorResponse(response); err != nil {
+			return "", err
+		}
+	}
+
+	corsHandler := newCheckCorsHeaders(origRequest.Request)
+	corsHandler.updateHeaders(w.Header())
+	for _, header := range mediaResponseHeaders {
+		if value := response.Header.Get(header); value != "" {
+			w.Header().Set(header, value)
+		}
+	}
+	if w.Header().Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/octet-stream")
+	}
+
+	status := response.StatusCode
+	var body io.Reader = response.Body
+	rangeHeader := origRequest.Header.Get(headerRange)
+	ifRange := origRequest.Header.Get(headerIfRange)
+	if status == http.StatusOK && rangeHeader != "" && response.ContentLength >= 0 &&
+		(ifRange == "" || ifRange == response.Header.Get(headerETag)) {
+		size := response.ContentLength
+		first, last, ok := parseByteRange(rangeHeader, size)
+		if ok && first == -1 {
+			w.Header().Del("Content-Length")
+			w.Header().Set(headerContentRange, fmt.Sprintf("bytes */%d", size))
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return "", nil
+		}
+		if ok {
+			if _, err := io.CopyN(ioutil.Discard, response.Body, first); err != nil {
+				return "", err
+			}
+			body = io.LimitReader(response.Body, last-first+1)
+			w.Header().Set(headerContentRange, fmt.Sprintf("bytes %d-%d/%d", first, last, size))
+			w.Header().Set("Content-Length", strconv.FormatInt(last-first+1, 10))
+			status = http.StatusPartialContent
+		}
+	}
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, body); err != nil {
+		// The response has started, so the error can't be reported.
+		ed.log().Warn("Problem streaming media", "path", origRequest.relativeUrl, "error", err)
+	}
+	return "", nil
+}
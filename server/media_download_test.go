@@ -0,0 +1,173 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestParseByteRange(t *testing.T) {
+	check := func(header string, first, last int64, ok bool) {
+		f, l, o := parseByteRange(header, 100)
+		assert.Equal(t, []interface{}{first, last, ok}, []interface{}{f, l, o}, header)
+	}
+	check("bytes=0-9", 0, 9, true)
+	check("bytes=90-", 90, 99, true)
+	check("bytes=-10", 90, 99, true)
+	check("bytes=50-500", 50, 99, true)
+	check("bytes=100-", -1, -1, true)
+	check("bytes=0-1,5-6", 0, 0, false)
+	check("items=0-1", 0, 0, false)
+}
+
+const mediaContents = "0123456789"
+
+func buildMediaResponse(status int) *http.Response {
+	return &http.Response{
+		StatusCode:    status,
+		Header:        http.Header{"Content-Type": []string{"image/png"}, "Content-Disposition": []string{"attachment"}},
+		ContentLength: int64(len(mediaContents)),
+		Body:          ioutil.NopCloser(bytes.NewBufferString(mediaContents)),
+	}
+}
+
+func handleMedia(server *EndpointsServer, header http.Header, response *http.Response) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	origRequest := buildApiRequest("/_ah/api/files_api/v1/files/1?alt=media", "", header)
+	origRequest.Method = "files.get"
+	spiRequest, _ := origRequest.copy()
+	handleSpiResponse(server, origRequest, spiRequest, response, &endpoints.ApiMethod{HttpMethod: "GET"}, w)
+	return w
+}
+
+func TestMediaDownload(t *testing.T) {
+	server := newEndpointsServer()
+	server.SetMediaDownload("files.get", true)
+	w := handleMedia(server, nil, buildMediaResponse(200))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "image/png", w.Header().Get("Content-Type"))
+	assert.Equal(t, "attachment", w.Header().Get("Content-Disposition"))
+	assert.Equal(t, mediaContents, w.Body.String())
+}
+
+func TestMediaDownloadNotEnabled(t *testing.T) {
+	server := newEndpointsServer()
+	w := handleMedia(server, nil, buildMediaResponse(200))
+	assert.Equal(t, 500, w.Code)
+}
+
+func TestMediaDownloadRange(t *testing.T) {
+	server := newEndpointsServer()
+	server.SetMediaDownload("files.get", true)
+	w := handleMedia(server, http.Header{"Range": []string{"bytes=2-4"}}, buildMediaResponse(200))
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "bytes 2-4/10", w.Header().Get("Content-Range"))
+	assert.Equal(t, "3", w.Header().Get("Content-Length"))
+	assert.Equal(t, "234", w.Body.String())
+
+	w = handleMedia(server, http.Header{"Range": []string{"bytes=20-"}}, buildMediaResponse(200))
+	assert.Equal(t, 416, w.Code)
+	assert.Equal(t, "bytes */10", w.Header().Get("Content-Range"))
+}
+
+func TestMediaDownloadBackendRange(t *testing.T) {
+	config := &endpoints.ApiDescriptor{
+		Name:    "files_api",
+		Version: "v1",
+		Methods: map[string]*endpoints.ApiMethod{
+			"files.get": &endpoints.ApiMethod{
+				HttpMethod: "GET",
+				Path:       "files/{fid}",
+				RosyMethod: "FileService.get",
+			},
+		},
+	}
+	server := newEndpointsServer()
+	server.SetMediaDownload("files.get", true)
+	ts := prepareTestServer(t, config)
+	server.url = ts.URL
+	defer ts.Close()
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "bytes=0-1", r.Header.Get("Range"))
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Content-Range", "bytes 0-1/10")
+		w.WriteHeader(206)
+		fmt.Fprint(w, "01")
+	}))
+	defer ts2.Close()
+	server.SetSpiUrlBuilder(SpiUrlBuilderFunc(func(ed *EndpointsServer, spiRequest *ApiRequest) string {
+		return ts2.URL + fmt.Sprintf(spiRootFormat, spiRequest.URL.Path)
+	}))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/files_api/v1/files/1?alt=media", "",
+		http.Header{"Range": []string{"bytes=0-1"}}))
+	assert.Equal(t, 206, w.Code)
+	assert.Equal(t, "bytes 0-1/10", w.Header().Get("Content-Range"))
+	assert.Equal(t, "01", w.Body.String())
+}
+
+func TestMediaDownloadIntercepted(t *testing.T) {
+	config := &endpoints.ApiDescriptor{
+		Name:    "files_api",
+		Version: "v1",
+		Methods: map[string]*endpoints.ApiMethod{
+			"files.get": &endpoints.ApiMethod{
+				HttpMethod: "GET",
+				Path:       "files/{fid}",
+				RosyMethod: "FileService.get",
+			},
+		},
+	}
+	server := newEndpointsServer()
+	server.SetMediaDownload("files.get", true)
+	ts := prepareTestServer(t, config)
+	server.url = ts.URL
+	defer ts.Close()
+
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		fmt.Fprint(w, mediaContents)
+	}))
+	defer ts2.Close()
+	server.SetSpiUrlBuilder(SpiUrlBuilderFunc(func(ed *EndpointsServer, spiRequest *ApiRequest) string {
+		return ts2.URL + fmt.Sprintf(spiRootFormat, spiRequest.URL.Path)
+	}))
+	var seen *CallResponse
+	server.AddInterceptor(func(call *Call, next CallHandler) (*CallResponse, error) {
+		resp, err := next(call)
+		seen = resp
+		return resp, err
+	})
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/files_api/v1/files/1?alt=media", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, mediaContents, w.Body.String())
+	if assert.NotNil(t, seen) {
+		assert.True(t, seen.Streamed)
+		assert.Nil(t, seen.Body)
+		assert.Equal(t, 200, seen.StatusCode)
+		assert.Equal(t, "image/png", seen.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,368 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Metrics of the traffic proxied, in the Prometheus text format.
+
+// Upper bounds, in seconds, of the latency histogram buckets.
+var latencyBuckets = []float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+// Separates label values in series keys.
+const labelSeparator = "\xff"
+
+// A family of counters, one for each combination of label values.
+type counterVec struct {
+	name, help string
+	labels     []string
+	values     map[string]float64
+	lock       sync.Mutex
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) inc(labelValues ...string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.values[strings.Join(labelValues, labelSeparator)]++
+}
+
+func (c *counterVec) write(buf *bytes.Buffer) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	writeMetricHeader(buf, c.name, c.help, "counter")
+	for _, key := range sortedKeys(c.values) {
+		writeSample(buf, c.name, c.labels, strings.Split(key, labelSeparator), c.values[key])
+	}
+}
+
+// A family of histograms, one for each combination of label values.
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	values     map[string]*histogram
+	lock       sync.Mutex
+}
+
+type histogram struct {
+	counts []uint64 // By bucket, not cumulative.
+	sum    float64
+	count  uint64
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:    name,
+		help:    help,
+		labels:  labels,
+		buckets: latencyBuckets,
+		values:  make(map[string]*histogram),
+	}
+}
+
+func (h *histogramVec) observe(d time.Duration, labelValues ...string) {
+	v := d.Seconds()
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	key := strings.Join(labelValues, labelSeparator)
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+	}
+	for i, bound := range h.buckets {
+		if v <= bound {
+			hist.counts[i]++
+			break
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	writeMetricHeader(buf, h.name, h.help, "histogram")
+	keys := make([]string, 0, len(h.values))
+	for key := range h.values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	bucketLabels := append(append([]string(nil), h.labels...), "le")
+	for _, key := range keys {
+		hist := h.values[key]
+		labelValues := strings.Split(key, labelSeparator)
+		var cumulative uint64
+		for i, bound := range h.buckets {
+			cumulative += hist.counts[i]
+			writeSample(buf, h.name+"_bucket", bucketLabels,
+				withLabel(labelValues, formatFloat(bound)), float64(cumulative))
+		}
+		writeSample(buf, h.name+"_bucket", bucketLabels, withLabel(labelValues, "+Inf"), float64(hist.count))
+		writeSample(buf, h.name+"_sum", h.labels, labelValues, hist.sum)
+		writeSample(buf, h.name+"_count", h.labels, labelValues, float64(hist.count))
+	}
+}
+
+// Returns a copy of labelValues with another value appended.
+func withLabel(labelValues []string, value string) []string {
+	return append(append(make([]string, 0, len(labelValues)+1), labelValues...), value)
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, help, metricType string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func writeSample(buf *bytes.Buffer, name string, labels, labelValues []string, value float64) {
+	buf.WriteString(name)
+	if len(labels) > 0 {
+		buf.WriteByte('{')
+		for i, label := range labels {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			fmt.Fprintf(buf, "%s=\"%s\"", label, escapeLabelValue(labelValues[i]))
+		}
+		buf.WriteByte('}')
+	}
+	buf.WriteByte(' ')
+	buf.WriteString(formatFloat(value))
+	buf.WriteByte('\n')
+}
+
+var labelValueEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func escapeLabelValue(v string) string {
+	return labelValueEscaper.Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+// Metrics of an EndpointsServer.
+type serverMetrics struct {
+	requests        *counterVec
+	requestDuration *histogramVec
+	backendDuration *histogramVec
+	proxyOverhead   *histogramVec
+	configRefreshes *counterVec
+	discovery       *histogramVec
+	inFlight        int64
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		requests: newCounterVec("endpoints_requests_total",
+			"API requests served.", "api", "version", "method", "status"),
+		requestDuration: newHistogramVec("endpoints_request_duration_seconds",
+			"Time taken to serve API requests.", "api", "version", "method", "status"),
+		backendDuration: newHistogramVec("endpoints_backend_duration_seconds",
+			"Time spent waiting for the SPI backend while serving API requests.", "api", "version", "method"),
+		proxyOverhead: newHistogramVec("endpoints_proxy_overhead_seconds",
+			"Time spent serving API requests other than waiting for the SPI backend.", "api", "version", "method"),
+		configRefreshes: newCounterVec("endpoints_config_refreshes_total",
+			"Refreshes of the API configurations, by result.", "result"),
+		discovery: newHistogramVec("endpoints_discovery_generation_seconds",
+			"Time taken to generate discovery documents.", "method"),
+	}
+}
+
+// Records a request served. The request is nil if it couldn't be parsed.
+func (m *serverMetrics) observeRequest(ar *ApiRequest, status int, elapsed time.Duration) {
+	var api, version, method string
+	if ar != nil && ar.api.methodName != "" {
+		api, version, method = ar.api.methodName, ar.api.version, ar.Method
+	}
+	m.requests.inc(api, version, method, strconv.Itoa(status))
+	m.requestDuration.observe(elapsed, api, version, method, strconv.Itoa(status))
+	if ar == nil || !ar.stats.calledBackend() {
+		return
+	}
+	backend := ar.stats.backendTime()
+	m.backendDuration.observe(backend, api, version, method)
+	m.proxyOverhead.observe(elapsed-backend, api, version, method)
+}
+
+// Records the outcome of refreshing the API configurations.
+func (m *serverMetrics) configRefreshed(err error) {
+	if err != nil {
+		m.configRefreshes.inc("failure")
+	} else {
+		m.configRefreshes.inc("success")
+	}
+}
+
+// Timings of an API request, shared by the request and the requests
+// transformed from it.
+type requestStats struct {
+	backendNanos int64
+	backendCalls int64
+}
+
+// Adds the time spent waiting for a response from the SPI.
+func (s *requestStats) addBackendTime(d time.Duration) {
+	if s == nil {
+		return
+	}
+	atomic.AddInt64(&s.backendNanos, int64(d))
+	atomic.AddInt64(&s.backendCalls, 1)
+}
+
+func (s *requestStats) backendTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&s.backendNanos))
+}
+
+func (s *requestStats) calledBackend() bool {
+	return s != nil && atomic.LoadInt64(&s.backendCalls) > 0
+}
+
+// A ResponseWriter that records the status and size of the response.
+type statusResponseWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64 // Bytes of body written.
+}
+
+func (w *statusResponseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += int64(n)
+	return n, err
+}
+
+func (w *statusResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Returns the status written, which is 200 if none was.
+func (w *statusResponseWriter) statusCode() int {
+	if w.status == 0 {
+		return http.StatusOK
+	}
+	return w.status
+}
+
+// SetMetricsPath sets the path, such as "/metrics", that HandleHttp
+// registers the metrics handler at. By default the handler isn't
+// registered.
+func (ed *EndpointsServer) SetMetricsPath(p string) {
+	ed.metricsPath = p
+}
+
+// Handler for requests for the server's metrics, in the Prometheus text
+// exposition format.
+func (ed *EndpointsServer) HandleMetricsRequest(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	ed.writeMetrics(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+// Writes the server's metrics in the Prometheus text exposition format.
+func (ed *EndpointsServer) writeMetrics(buf *bytes.Buffer) {
+	m := ed.metrics
+	m.requests.write(buf)
+	m.requestDuration.write(buf)
+	m.backendDuration.write(buf)
+	m.proxyOverhead.write(buf)
+	m.configRefreshes.write(buf)
+	m.discovery.write(buf)
+
+	writeMetricHeader(buf, "endpoints_requests_in_flight", "API requests being served.", "gauge")
+	writeSample(buf, "endpoints_requests_in_flight", nil, nil, float64(atomic.LoadInt64(&m.inFlight)))
+
+	retries := ed.RetryCounts()
+	writeMetricHeader(buf, "endpoints_spi_retries_total", "Retries of failed SPI calls.", "counter")
+	names := make([]string, 0, len(retries))
+	for name := range retries {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		writeSample(buf, "endpoints_spi_retries_total", []string{"method"}, []string{name}, float64(retries[name]))
+	}
+
+	backendLabels := []string{"backend"}
+	writeMetricHeader(buf, "endpoints_backend_healthy", "Whether an SPI backend is healthy (1) or not (0).", "gauge")
+	for _, status := range ed.BackendStatus() {
+		healthy := 0.0
+		if status.Healthy {
+			healthy = 1
+		}
+		writeSample(buf, "endpoints_backend_healthy", backendLabels, []string{status.URL}, healthy)
+	}
+
+	replicaLabels := []string{"backend", "replica"}
+	writeMetricHeader(buf, "endpoints_replica_available",
+		"Whether a backend replica is in rotation (1) or not (0).", "gauge")
+	for _, pool := range ed.replicaPools() {
+		for _, status := range pool.statuses() {
+			available := 0.0
+			if status.Available {
+				available = 1
+			}
+			writeSample(buf, "endpoints_replica_available", replicaLabels,
+				[]string{pool.backend, status.URL}, available)
+		}
+	}
+
+	breakerLabels := []string{"backend", "method"}
+	writeMetricHeader(buf, "endpoints_circuit_breaker_state",
+		"State of the circuit breaker of an SPI method: 0 closed, 1 open, 2 half-open.", "gauge")
+	for _, status := range ed.CircuitBreakerStatus() {
+		writeSample(buf, "endpoints_circuit_breaker_state", breakerLabels,
+			[]string{status.Backend, status.Method}, float64(status.State))
+	}
+}
@@ -0,0 +1,85 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestHistogramVec(t *testing.T) {
+	h := newHistogramVec("test_seconds", "Test.", "method")
+	h.buckets = []float64{0.1, 1}
+	h.observe(50*time.Millisecond, "a")
+	h.observe(500*time.Millisecond, "a")
+	h.observe(2*time.Second, "a")
+
+	var buf bytes.Buffer
+	h.write(&buf)
+	assert.Equal(t, `# HELP test_seconds Test.
+# TYPE test_seconds histogram
+test_seconds_bucket{method="a",le="0.1"} 1
+test_seconds_bucket{method="a",le="1"} 2
+test_seconds_bucket{method="a",le="+Inf"} 3
+test_seconds_sum{method="a"} 2.55
+test_seconds_count{method="a"} 3
+`, buf.String())
+}
+
+func TestCounterVecEscapes(t *testing.T) {
+	c := newCounterVec("test_total", "Test.", "path")
+	c.inc(`a"b\c` + "\n")
+	c.inc(`a"b\c` + "\n")
+
+	var buf bytes.Buffer
+	c.write(&buf)
+	assert.Contains(t, buf.String(), `test_total{path="a\"b\\c\n"} 2`)
+}
+
+func TestMetricsHandler(t *testing.T) {
+	ts := httptest.NewServer(newSpiHandler())
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	server.SetMetricsPath("/metrics")
+	mux := http.NewServeMux()
+	server.HandleHttp(mux)
+
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/missing", "", nil))
+	assert.Equal(t, 404, w.Code)
+
+	w = httptest.NewRecorder()
+	mux.ServeHTTP(w, buildRequest("/metrics", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "text/plain; version=0.0.4; charset=utf-8", w.Header().Get("Content-Type"))
+	body := w.Body.String()
+	assert.Contains(t, body, `endpoints_requests_total{api="a_api",version="v1",method="a_api.get",status="200"} 1`)
+	assert.Contains(t, body, `endpoints_requests_total{api="",version="",method="",status="404"} 1`)
+	assert.Contains(t, body, `endpoints_backend_duration_seconds_count{api="a_api",version="v1",method="a_api.get"} 1`)
+	assert.Contains(t, body, `endpoints_proxy_overhead_seconds_count{api="a_api",version="v1",method="a_api.get"} 1`)
+	// The configurations are only refreshed when they change.
+	assert.Contains(t, body, `endpoints_config_refreshes_total{result="success"} 1`)
+	assert.Contains(t, body, "endpoints_requests_in_flight 0\n")
+	assert.Contains(t, body, `endpoints_backend_healthy{backend="`+ts.URL+`"} 1`)
+}
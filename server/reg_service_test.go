@@ -135,7 +135,8 @@ func (ss *SecondService) SecondTest(_ *http.Request, _ *VoidMessage, resp *TestR
 	return nil
 }
 
-func initTestApi(t *testing.T) *httptest.Server {
+// Returns a go-endpoints server with the test services registered.
+func newTestSpi(t *testing.T) *endpoints.Server {
 	spi := endpoints.NewServer("")
 
 	testService := &TestService{}
@@ -183,6 +184,12 @@ func initTestApi(t *testing.T) *httptest.Server {
 	info = api.MethodByName("SecondTest").Info()
 	info.Name, info.HttpMethod, info.Path = "test_name", "GET", "test"
 
+	return spi
+}
+
+func initTestApi(t *testing.T) *httptest.Server {
+	spi := newTestSpi(t)
+
 	mux := http.NewServeMux()
 	ts := httptest.NewServer(mux)
 
@@ -0,0 +1,450 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"hash/crc32"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Load balancing across the replicas of an SPI backend.
+//
+// Replicas are taken out of rotation when active health checks fail, or
+// when they return errors (outlier ejection). If every replica is out of
+// rotation, requests are spread across all of them rather than dropped.
+
+// BalancePolicy selects how a replica is chosen for each SPI call.
+type BalancePolicy int
+
+const (
+	// RoundRobin sends calls to each replica in turn.
+	RoundRobin BalancePolicy = iota
+	// LeastRequests sends calls to the replica with the fewest calls
+	// outstanding.
+	LeastRequests
+	// ConsistentHash sends calls with the same hash key to the same
+	// replica while it is in rotation.
+	ConsistentHash
+)
+
+const (
+	defaultEjectAfter          = 5
+	defaultEjectFor            = 30 * time.Second
+	defaultHealthCheckInterval = 10 * time.Second
+	maxEjectFor                = 5 * time.Minute
+
+	// Points on the hash ring for each replica.
+	hashRingPoints = 100
+)
+
+// ReplicaOptions configures load balancing and health checking across the
+// replicas of a backend. The zero value balances with RoundRobin, ejects
+// a replica after 5 consecutive failures and does no active health
+// checks.
+type ReplicaOptions struct {
+	Policy BalancePolicy
+
+	// Path on each replica, such as "/_ah/health", that is requested with
+	// GET every HealthCheckInterval. A replica is out of rotation while it
+	// doesn't respond with a 200. Active health checks are disabled if
+	// this is empty.
+	HealthCheckPath     string
+	HealthCheckInterval time.Duration
+
+	// Number of consecutive connection errors or 5xx responses after
+	// which a replica is ejected, and the time it is first ejected for.
+	// Each further ejection lasts longer.
+	EjectAfter int
+	EjectFor   time.Duration
+
+	// Returns the key used by ConsistentHash for a request. By default
+	// the client's IP address is used.
+	HashKey func(r *http.Request) string
+}
+
+// ReplicaStatus describes the state of a backend replica.
+type ReplicaStatus struct {
+	URL                 string
+	Available           bool // In rotation.
+	Healthy             bool // Passing active health checks.
+	Outstanding         int
+	ConsecutiveFailures int
+	EjectedUntil        time.Time
+}
+
+// A replica of an SPI backend.
+type replica struct {
+	url string
+
+	outstanding  int
+	failures     int
+	ejections    int
+	ejectedUntil time.Time
+	healthy      bool
+}
+
+// Returns true if the replica is in rotation.
+func (r *replica) available(now time.Time) bool {
+	return r.healthy && !now.Before(r.ejectedUntil)
+}
+
+// The replicas of an SPI backend.
+type replicaPool struct {
+	backend  string
+	replicas []*replica
+	opts     ReplicaOptions
+
+	next         int      // Round robin position.
+	ring         []uint32 // Sorted hash ring points.
+	ringReplicas map[uint32]*replica
+
+	lock sync.Mutex
+	stop chan struct{}
+	now  func() time.Time
+
+	// Transport that health checks are made with, or nil for the default.
+	transport http.RoundTripper
+
+	// Logger of ejections and health check results, or nil for the
+	// default.
+	logger Logger
+}
+
+func newReplicaPool(backend string, urls []string, opts ReplicaOptions) *replicaPool {
+	if opts.EjectAfter <= 0 {
+		opts.EjectAfter = defaultEjectAfter
+	}
+	if opts.EjectFor <= 0 {
+		opts.EjectFor = defaultEjectFor
+	}
+	if opts.HealthCheckInterval <= 0 {
+		opts.HealthCheckInterval = defaultHealthCheckInterval
+	}
+	p := &replicaPool{
+		backend:      backend,
+		opts:         opts,
+		ringReplicas: make(map[uint32]*replica),
+		stop:         make(chan struct{}),
+		now:          time.Now,
+	}
+	for _, u := range urls {
+		r := &replica{url: u, healthy: true}
+		p.replicas = append(p.replicas, r)
+		for i := 0; i < hashRingPoints; i++ {
+			point := crc32.ChecksumIEEE([]byte(u + "#" + strconv.Itoa(i)))
+			p.ring = append(p.ring, point)
+			p.ringReplicas[point] = r
+		}
+	}
+	sort.Sort(uint32Slice(p.ring))
+	return p
+}
+
+type uint32Slice []uint32
+
+func (s uint32Slice) Len() int           { return len(s) }
+func (s uint32Slice) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s uint32Slice) Less(i, j int) bool { return s[i] < s[j] }
+
+// Chooses a replica for a call with the given hash key and counts the
+// call as outstanding. done must be called with the outcome of the call
+// once its response headers have been received.
+func (p *replicaPool) pick(key string) *replica {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.now()
+	candidates := make([]*replica, 0, len(p.replicas))
+	for _, r := range p.replicas {
+		if r.available(now) {
+			candidates = append(candidates, r)
+		}
+	}
+	if len(candidates) == 0 {
+		// Better to try a replica that may be failing than to fail.
+		candidates = p.replicas
+	}
+
+	var chosen *replica
+	switch p.opts.Policy {
+	case LeastRequests:
+		// Start from the round robin position so that ties are spread.
+		for i := range candidates {
+			r := candidates[(p.next+i)%len(candidates)]
+			if chosen == nil || r.outstanding < chosen.outstanding {
+				chosen = r
+			}
+		}
+		p.next++
+	case ConsistentHash:
+		chosen = p.ringReplica(crc32.ChecksumIEEE([]byte(key)), candidates)
+	default:
+		chosen = candidates[p.next%len(candidates)]
+		p.next++
+	}
+	chosen.outstanding++
+	return chosen
+}
+
+// Returns the first of the candidates at or after a point on the hash
+// ring.
+func (p *replicaPool) ringReplica(point uint32, candidates []*replica) *replica {
+	isCandidate := make(map[*replica]bool, len(candidates))
+	for _, r := range candidates {
+		isCandidate[r] = true
+	}
+	start := sort.Search(len(p.ring), func(i int) bool { return p.ring[i] >= point })
+	for i := range p.ring {
+		r := p.ringReplicas[p.ring[(start+i)%len(p.ring)]]
+		if isCandidate[r] {
+			return r
+		}
+	}
+	return candidates[0]
+}
+
+// Records that a call to a replica chosen by pick was abandoned, by the
+// client going away or its deadline passing, so that its outcome says
+// nothing about the replica.
+func (p *replicaPool) abandon(r *replica) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	r.outstanding--
+}
+
+// Records the outcome of a call to a replica chosen by pick. Connection
+// errors and 5xx responses count towards ejecting the replica.
+func (p *replicaPool) done(r *replica, resp *http.Response, err error) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	r.outstanding--
+	if err == nil && resp != nil && resp.StatusCode < 500 {
+		r.failures = 0
+		if r.ejections > 0 && r.available(p.now()) {
+			r.ejections = 0
+		}
+		return
+	}
+	r.failures++
+	if r.failures >= p.opts.EjectAfter {
+		r.ejections++
+		ejectFor := p.opts.EjectFor * time.Duration(r.ejections)
+		if ejectFor > maxEjectFor {
+			ejectFor = maxEjectFor
+		}
+		r.ejectedUntil = p.now().Add(ejectFor)
+		r.failures = 0
+		loggerOrDefault(p.logger).Warn("Ejected replica",
+			"replica", r.url, "backend", p.backend, "eject_for", ejectFor)
+	}
+}
+
+// Marks a replica as passing or failing active health checks.
+func (p *replicaPool) setHealthy(r *replica, healthy bool) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	if r.healthy != healthy {
+		if healthy {
+			loggerOrDefault(p.logger).Info("Replica passed its health check",
+				"replica", r.url, "backend", p.backend)
+		} else {
+			loggerOrDefault(p.logger).Warn("Replica failed its health check",
+				"replica", r.url, "backend", p.backend)
+		}
+	}
+	r.healthy = healthy
+	if healthy && r.ejections > 0 && !p.now().Before(r.ejectedUntil) {
+		r.ejections = 0
+	}
+}
+
+// Returns the state of each replica.
+func (p *replicaPool) statuses() []ReplicaStatus {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	now := p.now()
+	result := make([]ReplicaStatus, len(p.replicas))
+	for i, r := range p.replicas {
+		result[i] = ReplicaStatus{
+			URL:                 r.url,
+			Available:           r.available(now),
+			Healthy:             r.healthy,
+			Outstanding:         r.outstanding,
+			ConsecutiveFailures: r.failures,
+			EjectedUntil:        r.ejectedUntil,
+		}
+	}
+	return result
+}
+
+// Checks the health of each replica every HealthCheckInterval until the
+// pool is closed or stop is.
+func (p *replicaPool) runHealthChecks(stop <-chan struct{}) {
+	client := &http.Client{Transport: p.transport, Timeout: p.opts.HealthCheckInterval}
+	ticker := time.NewTicker(p.opts.HealthCheckInterval)
+	defer ticker.Stop()
+	for {
+		p.checkHealth(client)
+		select {
+		case <-p.stop:
+			return
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Requests the health check path of each replica.
+func (p *replicaPool) checkHealth(client *http.Client) {
+	for _, r := range p.replicas {
+		resp, err := client.Get(r.url + p.opts.HealthCheckPath)
+		healthy := err == nil && resp.StatusCode == http.StatusOK
+		if err == nil {
+			resp.Body.Close()
+		}
+		p.setHealthy(r, healthy)
+	}
+}
+
+// Stops health checking.
+func (p *replicaPool) close() {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	select {
+	case <-p.stop:
+	default:
+		close(p.stop)
+	}
+}
+
+// Returns the default hash key of a request: the client's IP address.
+func clientAddress(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// SetReplicas balances the SPI calls for a backend across the given
+// replica addresses. The backend is the server's URL, one added with
+// AddBackend, or one named by an API's Adapter.Bns. Any replicas
+// previously set for the backend are replaced. If no replicas are given,
+// calls go to the backend URL itself. Health checks aren't started once
+// the server has begun shutting down.
+func (ed *EndpointsServer) SetReplicas(backend *url.URL, replicas []*url.URL, opts ReplicaOptions) {
+	urls := make([]string, len(replicas))
+	for i, u := range replicas {
+		urls[i] = formatBackendURL(u)
+	}
+	key := formatBackendURL(backend)
+
+	ed.replicasLock.Lock()
+	defer ed.replicasLock.Unlock()
+	if ed.replicas == nil {
+		ed.replicas = make(map[string]*replicaPool)
+	}
+	if old, ok := ed.replicas[key]; ok {
+		old.close()
+		delete(ed.replicas, key)
+	}
+	if len(urls) == 0 {
+		return
+	}
+	pool := newReplicaPool(key, urls, opts)
+	pool.transport = ed.healthCheckTransport()
+	pool.logger = ed.logger
+	ed.replicas[key] = pool
+	if opts.HealthCheckPath != "" {
+		ed.lifecycle.lock.Lock()
+		select {
+		case <-ed.lifecycle.stopChan():
+		default:
+			ed.lifecycle.goBackground(pool.runHealthChecks)
+		}
+		ed.lifecycle.lock.Unlock()
+	}
+}
+
+// ReplicaStatus returns the state of each replica of a backend, or nil if
+// no replicas have been set for it.
+func (ed *EndpointsServer) ReplicaStatus(backend *url.URL) []ReplicaStatus {
+	if pool := ed.replicaPool(formatBackendURL(backend)); pool != nil {
+		return pool.statuses()
+	}
+	return nil
+}
+
+// Returns the replica pools of the backends, in backend order.
+func (ed *EndpointsServer) replicaPools() []*replicaPool {
+	ed.replicasLock.Lock()
+	pools := make([]*replicaPool, 0, len(ed.replicas))
+	for _, pool := range ed.replicas {
+		pools = append(pools, pool)
+	}
+	ed.replicasLock.Unlock()
+	sort.Sort(replicaPoolsByBackend(pools))
+	return pools
+}
+
+type replicaPoolsByBackend []*replicaPool
+
+func (s replicaPoolsByBackend) Len() int           { return len(s) }
+func (s replicaPoolsByBackend) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s replicaPoolsByBackend) Less(i, j int) bool { return s[i].backend < s[j].backend }
+
+// Returns the replicas of a backend, or nil if it has none.
+func (ed *EndpointsServer) replicaPool(backend string) *replicaPool {
+	ed.replicasLock.Lock()
+	defer ed.replicasLock.Unlock()
+	return ed.replicas[backend]
+}
+
+// Chooses the replica that a transformed request is sent to, setting its
+// target. Returns a function to be called with the outcome of the call
+// and whether it was abandoned, which is a no-op if the backend has no
+// replicas.
+func (ed *EndpointsServer) pickReplica(spiRequest *ApiRequest) func(*http.Response, error, bool) {
+	pool := ed.replicaPool(ed.spiBackend(spiRequest))
+	if pool == nil {
+		return func(*http.Response, error, bool) {}
+	}
+	hashKey := pool.opts.HashKey
+	if hashKey == nil {
+		hashKey = clientAddress
+	}
+	r := pool.pick(hashKey(spiRequest.Request))
+	spiRequest.target = r.url
+	return func(resp *http.Response, err error, abandoned bool) {
+		if abandoned {
+			pool.abandon(r)
+			return
+		}
+		pool.done(r, resp, err)
+	}
+}
+
+// Formats a backend URL as http://ipaddr:port with no trailing slash.
+func formatBackendURL(u *url.URL) string {
+	s := &EndpointsServer{}
+	s.SetURL(u)
+	return s.url
+}
@@ -0,0 +1,212 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+var okResponse = &http.Response{StatusCode: 200}
+
+func TestReplicaRoundRobin(t *testing.T) {
+	p := newReplicaPool("http://b", []string{"http://r1", "http://r2", "http://r3"}, ReplicaOptions{})
+	picked := []string{}
+	for i := 0; i < 4; i++ {
+		r := p.pick("")
+		picked = append(picked, r.url)
+		p.done(r, okResponse, nil)
+	}
+	assert.Equal(t, []string{"http://r1", "http://r2", "http://r3", "http://r1"}, picked)
+}
+
+func TestReplicaLeastRequests(t *testing.T) {
+	p := newReplicaPool("http://b", []string{"http://r1", "http://r2"}, ReplicaOptions{Policy: LeastRequests})
+	r1 := p.pick("")
+	r2 := p.pick("")
+	assert.NotEqual(t, r1.url, r2.url)
+	p.done(r2, okResponse, nil)
+	// r1 is still outstanding.
+	for i := 0; i < 3; i++ {
+		r := p.pick("")
+		assert.Equal(t, r2.url, r.url)
+		p.done(r, okResponse, nil)
+	}
+}
+
+func TestReplicaConsistentHash(t *testing.T) {
+	urls := []string{"http://r1", "http://r2", "http://r3"}
+	p := newReplicaPool("http://b", urls, ReplicaOptions{Policy: ConsistentHash, EjectAfter: 1})
+	chosen := map[string]string{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("client%d", i)
+		r := p.pick(key)
+		chosen[key] = r.url
+		p.done(r, okResponse, nil)
+	}
+	for key, u := range chosen {
+		r := p.pick(key)
+		assert.Equal(t, u, r.url)
+		p.done(r, okResponse, nil)
+	}
+
+	// Ejecting a replica only moves the keys it served.
+	r := p.pick("client0")
+	p.done(r, nil, errors.New("refused"))
+	for key, u := range chosen {
+		r := p.pick(key)
+		if u == chosen["client0"] {
+			assert.NotEqual(t, u, r.url)
+		} else {
+			assert.Equal(t, u, r.url)
+		}
+		p.done(r, okResponse, nil)
+	}
+}
+
+func TestReplicaEjection(t *testing.T) {
+	now := time.Unix(1000, 0)
+	p := newReplicaPool("http://b", []string{"http://r1", "http://r2"},
+		ReplicaOptions{EjectAfter: 2, EjectFor: time.Minute})
+	p.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		r := p.pick("")
+		assert.Equal(t, "http://r1", r.url)
+		p.done(r, &http.Response{StatusCode: 503}, nil)
+		r = p.pick("")
+		p.done(r, okResponse, nil)
+	}
+	statuses := p.statuses()
+	assert.False(t, statuses[0].Available)
+	assert.Equal(t, now.Add(time.Minute), statuses[0].EjectedUntil)
+	for i := 0; i < 3; i++ {
+		r := p.pick("")
+		assert.Equal(t, "http://r2", r.url)
+		p.done(r, okResponse, nil)
+	}
+
+	// Traffic isn't dropped when every replica is out of rotation.
+	for i := 0; i < 2; i++ {
+		p.done(p.pick(""), nil, errors.New("refused"))
+	}
+	assert.False(t, p.statuses()[1].Available)
+	r := p.pick("")
+	assert.NotNil(t, r)
+	p.done(r, okResponse, nil)
+
+	now = now.Add(2 * time.Minute)
+	assert.True(t, p.statuses()[0].Available)
+}
+
+func TestReplicaHealthCheck(t *testing.T) {
+	healthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_ah/health", r.URL.Path)
+	}))
+	defer healthy.Close()
+	unhealthy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(503)
+	}))
+	defer unhealthy.Close()
+
+	p := newReplicaPool("http://b", []string{unhealthy.URL, healthy.URL},
+		ReplicaOptions{HealthCheckPath: "/_ah/health"})
+	p.checkHealth(http.DefaultClient)
+	statuses := p.statuses()
+	assert.False(t, statuses[0].Healthy)
+	assert.True(t, statuses[1].Healthy)
+	for i := 0; i < 3; i++ {
+		r := p.pick("")
+		assert.Equal(t, healthy.URL, r.url)
+		p.done(r, okResponse, nil)
+	}
+}
+
+func TestSetReplicas(t *testing.T) {
+	startReplica := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			assert.Equal(t, "/_ah/spi/MyApi.get", r.URL.Path)
+			w.Header().Set("Content-Type", "application/json")
+			fmt.Fprintf(w, `{"replica": %q}`, name)
+		}))
+	}
+	r1 := startReplica("r1")
+	defer r1.Close()
+	r2 := startReplica("r2")
+	defer r2.Close()
+
+	backend, _ := url.Parse("http://backend.invalid:8080")
+	server := NewEndpointsServer(backend)
+	server.SetConfigSource(NewStaticConfigSource(buildSourceConfig("a_api")))
+	u1, _ := url.Parse(r1.URL)
+	u2, _ := url.Parse(r2.URL)
+	server.SetReplicas(backend, []*url.URL{u1, u2}, ReplicaOptions{})
+
+	bodies := []string{}
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+		assert.Equal(t, 200, w.Code)
+		bodies = append(bodies, w.Body.String())
+	}
+	assert.Contains(t, bodies[0], `"replica": "r1"`)
+	assert.Contains(t, bodies[1], `"replica": "r2"`)
+	statuses := server.ReplicaStatus(backend)
+	if assert.Equal(t, 2, len(statuses)) {
+		assert.Equal(t, 0, statuses[0].Outstanding)
+	}
+
+	server.SetReplicas(backend, nil, ReplicaOptions{})
+	assert.Nil(t, server.ReplicaStatus(backend))
+}
+
+func TestAbandonedCallsNotRecorded(t *testing.T) {
+	release := make(chan struct{})
+	replica := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer replica.Close()
+	defer close(release)
+
+	backend, _ := url.Parse("http://backend.invalid:8080")
+	server := NewEndpointsServer(backend)
+	server.SetConfigSource(NewStaticConfigSource(buildSourceConfig("a_api")))
+	u, _ := url.Parse(replica.URL)
+	server.SetReplicas(backend, []*url.URL{u}, ReplicaOptions{EjectAfter: 1})
+
+	// The client gives up on every call before the replica responds.
+	for i := 0; i < backendUnhealthyThreshold; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		r := buildRequest("/_ah/api/a_api/v1/items/1", "", nil).WithContext(ctx)
+		server.ServeHTTP(httptest.NewRecorder(), r)
+		cancel()
+	}
+	statuses := server.ReplicaStatus(backend)
+	if assert.Equal(t, 1, len(statuses)) {
+		assert.True(t, statuses[0].Available)
+		assert.Equal(t, 0, statuses[0].ConsecutiveFailures)
+		assert.Equal(t, 0, statuses[0].Outstanding)
+	}
+	for _, status := range server.BackendStatus() {
+		assert.Equal(t, 0, status.ConsecutiveFailures, status.URL)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"net/http"
+)
+
+// Request ids correlate the logs of the server and the SPI with the
+// responses seen by clients. A client may give the id of its request in
+// the X-Request-Id header, or else one is generated. The id is passed to
+// the SPI, echoed in the response and included in error bodies.
+
+const (
+	headerRequestId = "X-Request-Id"
+
+	// Longest request id accepted from a client.
+	maxRequestIdLength = 128
+)
+
+type requestIdKey struct{}
+
+// RequestId returns the id of the API request with the given context, or
+// "" if it has none.
+func RequestId(ctx context.Context) string {
+	id, _ := ctx.Value(requestIdKey{}).(string)
+	return id
+}
+
+// Returns the request with its id in its context and the id, which is
+// taken from the X-Request-Id header if it is valid or else generated.
+func withRequestId(r *http.Request) (*http.Request, string) {
+	id := r.Header.Get(headerRequestId)
+	if !isValidRequestId(id) {
+		id = randomHex(8)
+	}
+	return r.WithContext(context.WithValue(r.Context(), requestIdKey{}, id)), id
+}
+
+// Sets the X-Request-Id header to the id of the request with the given
+// context, replacing any id copied from an SPI or cached response.
+func setRequestIdHeader(h http.Header, ctx context.Context) {
+	if id := RequestId(ctx); id != "" {
+		h.Set(headerRequestId, id)
+	}
+}
+
+// Reports whether a request id from a client is non-empty, not too long
+// and only has printable ASCII characters other than space, so that it is
+// safe to log and to echo in headers.
+func isValidRequestId(id string) bool {
+	if id == "" || len(id) > maxRequestIdLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] <= ' ' || id[i] > '~' {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,114 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequestIdPropagated(t *testing.T) {
+	var backendId string
+	spi := newSpiHandler()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ah/spi/MyApi.get" {
+			backendId = r.Header.Get("X-Request-Id")
+		}
+		spi.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+
+	r := buildRequest("/_ah/api/a_api/v1/items/1", "", nil)
+	r.Header.Set("X-Request-Id", "client-id-1")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "client-id-1", w.Header().Get("X-Request-Id"))
+	assert.Equal(t, "client-id-1", backendId)
+
+	// Invalid ids are replaced.
+	for _, id := range []string{"", "has space", strings.Repeat("x", maxRequestIdLength+1)} {
+		r = buildRequest("/_ah/api/a_api/v1/items/1", "", nil)
+		r.Header.Set("X-Request-Id", id)
+		w = httptest.NewRecorder()
+		server.ServeHTTP(w, r)
+		generated := w.Header().Get("X-Request-Id")
+		assert.Equal(t, 16, len(generated))
+		assert.Equal(t, generated, backendId)
+	}
+}
+
+func TestRequestIdInErrors(t *testing.T) {
+	ts := httptest.NewServer(newSpiHandler())
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u, WithInterceptors(
+		func(call *Call, next CallHandler) (*CallResponse, error) {
+			return nil, NewRequestError(http.StatusForbidden, "Forbidden")
+		}))
+
+	r := buildRequest("/_ah/api/a_api/v1/items/1", "", nil)
+	r.Header.Set("X-Request-Id", "client-id-2")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	assert.Equal(t, 403, w.Code)
+	var body map[string]map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "client-id-2", body["error"]["requestId"])
+	assert.Equal(t, "Forbidden", body["error"]["message"])
+}
+
+func TestRequestIdInErrorResponse(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+
+	// The API configs can't be fetched from the closed backend.
+	r := buildRequest("/_ah/api/a_api/v1/items/1", "", nil)
+	r.Header.Set("X-Request-Id", "client-id-3")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	assert.Equal(t, 500, w.Code)
+	var body map[string]map[string]interface{}
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &body))
+	assert.Equal(t, "client-id-3", body["error"]["requestId"])
+}
+
+func TestFormatErrorWithoutRequestId(t *testing.T) {
+	err := newStatusError(404, "Not found")
+	_, ok := err.FormatError("errors", "")["error"].(map[string]interface{})["requestId"]
+	assert.False(t, ok)
+	assert.Equal(t, "req", err.FormatError("errors", "req")["error"].(map[string]interface{})["requestId"])
+
+	rpcErr := newJsonRpcError(jsonrpcInvalidRequest, "Invalid")
+	_, ok = rpcErr.rpcError("")["error"].(map[string]interface{})["data"]
+	assert.False(t, ok)
+	assert.Equal(t, map[string]interface{}{"requestId": "req"},
+		rpcErr.rpcError("req")["error"].(map[string]interface{})["data"])
+
+	// JSON-RPC errors only have code, message and data members.
+	body := err.rpcError("req")["error"].(map[string]interface{})
+	_, ok = body["requestId"]
+	assert.False(t, ok)
+	assert.Equal(t, "req", body["data"].([]map[string]interface{})[0]["requestId"])
+}
@@ -0,0 +1,353 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// In-memory response cache for idempotent REST methods.
+
+// ResponseCache is an LRU cache of successful GET responses, keyed by
+// method, request path, path parameters, query and caller identity.
+//
+// An entry's lifetime is taken from the backend's Cache-Control header if
+// present, otherwise from the TTL configured for the method, otherwise from
+// the default TTL. Responses with a zero lifetime are not stored. Concurrent
+// misses for the same key are collapsed into a single backend call.
+type ResponseCache struct {
+	maxEntries int
+	defaultTTL time.Duration
+	methodTTL  map[string]time.Duration
+
+	mu      sync.Mutex
+	ll      *list.List
+	entries map[string]*list.Element
+	calls   map[string]*cacheCall
+
+	// Returns the current time, may be replaced in tests.
+	now func() time.Time
+}
+
+type cacheEntry struct {
+	key        string
+	methodName string
+	status     int
+	header     http.Header
+	body       string
+	expires    time.Time
+}
+
+// An in-flight or completed call to fill a cache entry.
+type cacheCall struct {
+	wg    sync.WaitGroup
+	entry *cacheEntry
+	err   error
+}
+
+// NewResponseCache returns a cache holding at most maxEntries responses
+// (unbounded if zero). Methods without a configured TTL and responses
+// without Cache-Control use defaultTTL; a zero defaultTTL means such
+// responses are not cached.
+func NewResponseCache(maxEntries int, defaultTTL time.Duration) *ResponseCache {
+	return &ResponseCache{
+		maxEntries: maxEntries,
+		defaultTTL: defaultTTL,
+		methodTTL:  make(map[string]time.Duration),
+		ll:         list.New(),
+		entries:    make(map[string]*list.Element),
+		calls:      make(map[string]*cacheCall),
+		now:        time.Now,
+	}
+}
+
+// SetMethodTTL sets the lifetime of cached responses for the named method,
+// as used in the API configuration (e.g. "guestbook.greetings.get").
+func (c *ResponseCache) SetMethodTTL(methodName string, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.methodTTL[methodName] = ttl
+}
+
+// Purge removes all entries from the cache.
+func (c *ResponseCache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	c.entries = make(map[string]*list.Element)
+}
+
+// PurgeMethod removes all cached responses for the named method.
+func (c *ResponseCache) PurgeMethod(methodName string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for e := c.ll.Front(); e != nil; {
+		next := e.Next()
+		if entry := e.Value.(*cacheEntry); entry.methodName == methodName {
+			c.ll.Remove(e)
+			delete(c.entries, entry.key)
+		}
+		e = next
+	}
+}
+
+// Len returns the number of cached responses.
+func (c *ResponseCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len()
+}
+
+// Returns a live entry for the key, removing it if it has expired.
+func (c *ResponseCache) get(key string) *cacheEntry {
+	e, ok := c.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := e.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.ll.Remove(e)
+		delete(c.entries, key)
+		return nil
+	}
+	c.ll.MoveToFront(e)
+	return entry
+}
+
+func (c *ResponseCache) add(entry *cacheEntry) {
+	if e, ok := c.entries[entry.key]; ok {
+		c.ll.Remove(e)
+	}
+	c.entries[entry.key] = c.ll.PushFront(entry)
+	for c.maxEntries > 0 && c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// Returns how long a response may be cached for.
+func (c *ResponseCache) ttl(methodName string, header http.Header) time.Duration {
+	if ttl, ok := cacheControlTTL(header.Get("Cache-Control")); ok {
+		return ttl
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if ttl, ok := c.methodTTL[methodName]; ok {
+		return ttl
+	}
+	return c.defaultTTL
+}
+
+// Returns the cached response for key, calling fill to produce it on a miss.
+//
+// Only one fill runs per key at a time; concurrent callers wait for it
+// and share its result.
+func (c *ResponseCache) do(key, methodName string, fill func(w http.ResponseWriter) error) (*cacheEntry, error) {
+	c.mu.Lock()
+	if entry := c.get(key); entry != nil {
+		c.mu.Unlock()
+		return entry, nil
+	}
+	if call, ok := c.calls[key]; ok {
+		c.mu.Unlock()
+		call.wg.Wait()
+		return call.entry, call.err
+	}
+	call := &cacheCall{}
+	call.wg.Add(1)
+	c.calls[key] = call
+	c.mu.Unlock()
+
+	// Waiters are released even if fill panics, and are then given this
+	// error.
+	call.err = errors.New("Response cache fill failed")
+	defer func() {
+		c.mu.Lock()
+		delete(c.calls, key)
+		c.mu.Unlock()
+		call.wg.Done()
+	}()
+
+	bw := newBufferedResponseWriter()
+	call.err = fill(bw)
+	call.entry = &cacheEntry{
+		key:        key,
+		methodName: methodName,
+		status:     bw.status,
+		header:     bw.header,
+		body:       bw.body.String(),
+	}
+	if call.err == nil && bw.status == http.StatusOK {
+		if ttl := c.ttl(methodName, bw.header); ttl > 0 {
+			call.entry.expires = c.now().Add(ttl)
+			c.mu.Lock()
+			c.add(call.entry)
+			c.mu.Unlock()
+		}
+	}
+	return call.entry, call.err
+}
+
+// Parses a Cache-Control header value and returns the lifetime it allows a
+// shared cache to store the response for. Responses marked private,
+// no-cache or no-store aren't stored. The boolean result is false if the
+// header doesn't specify a lifetime.
+func cacheControlTTL(cacheControl string) (time.Duration, bool) {
+	if cacheControl == "" {
+		return 0, false
+	}
+	var maxAge, sMaxAge string
+	for _, directive := range strings.Split(cacheControl, ",") {
+		directive = strings.ToLower(strings.TrimSpace(directive))
+		switch {
+		case directive == "no-store" || directive == "no-cache" || directive == "private" ||
+			strings.HasPrefix(directive, "private=") || strings.HasPrefix(directive, "no-cache="):
+			return 0, true
+		case strings.HasPrefix(directive, "s-maxage="):
+			sMaxAge = directive[len("s-maxage="):]
+		case strings.HasPrefix(directive, "max-age="):
+			maxAge = directive[len("max-age="):]
+		}
+	}
+	if sMaxAge != "" {
+		maxAge = sMaxAge
+	}
+	if maxAge == "" {
+		return 0, false
+	}
+	seconds, err := strconv.Atoi(strings.Trim(maxAge, `"`))
+	if err != nil || seconds < 0 {
+		return 0, true
+	}
+	return time.Duration(seconds) * time.Second, true
+}
+
+// Returns an opaque identifier for the credentials on a request, so that
+// cached responses are never shared between callers.
+func callerIdentity(r *http.Request) string {
+	auth := r.Header.Get("Authorization")
+	cookie := r.Header.Get("Cookie")
+	if auth == "" && cookie == "" {
+		return ""
+	}
+	sum := sha1.Sum([]byte(auth + "\x00" + cookie))
+	return hex.EncodeToString(sum[:])
+}
+
+// Builds the cache key for a REST request. The path carries the API name
+// and version, which the method name alone does not.
+func responseCacheKey(methodName, path string, params map[string]string, query url.Values, identity string) string {
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	pathParams := make(url.Values)
+	for _, name := range names {
+		pathParams.Set(name, params[name])
+	}
+	return strings.Join([]string{
+		methodName,
+		path,
+		pathParams.Encode(),
+		query.Encode(),
+		identity,
+	}, "\x00")
+}
+
+// Headers that depend on the individual request and so are not replayed
+// from the cache.
+var uncachedHeaders = []string{
+	corsHeaderAllowOrigin,
+	corsHeaderAllowMethods,
+	corsHeaderAllowHeaders,
+	headerRequestId,
+}
+
+// Serves a REST GET request from the response cache, dispatching to the
+// backend with fill on a miss.
+func (ed *EndpointsServer) serveCached(w http.ResponseWriter, origRequest *ApiRequest, methodName string, params map[string]string, fill func(w http.ResponseWriter) (string, error)) (string, error) {
+	key := responseCacheKey(methodName, origRequest.URL.Path, params,
+		origRequest.URL.Query(), callerIdentity(origRequest.Request))
+
+	// The entry must hold a full response, regardless of whether the
+	// caller that happens to fill it sent a conditional request.
+	ifNoneMatch := origRequest.Header.Get(headerIfNoneMatch)
+	entry, err := ed.responseCache.do(key, methodName, func(bw http.ResponseWriter) error {
+		origRequest.Header.Del(headerIfNoneMatch)
+		defer func() {
+			if ifNoneMatch != "" {
+				origRequest.Header.Set(headerIfNoneMatch, ifNoneMatch)
+			}
+		}()
+		_, err := fill(bw)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+
+	corsHandler := newCheckCorsHeaders(origRequest.Request)
+	etag := entry.header.Get(headerETag)
+	if entry.status == http.StatusOK && ifNoneMatch != "" && etagMatches(ifNoneMatch, etag, true) {
+		return sendNotModifiedResponse(w, etag, corsHandler), nil
+	}
+	for k, vals := range entry.header {
+		w.Header()[k] = vals
+	}
+	for _, k := range uncachedHeaders {
+		w.Header().Del(k)
+	}
+	corsHandler.updateHeaders(w.Header())
+	setRequestIdHeader(w.Header(), origRequest.Context())
+	w.WriteHeader(entry.status)
+	w.Write([]byte(entry.body))
+	return entry.body, nil
+}
+
+// An http.ResponseWriter that buffers the response in memory.
+type bufferedResponseWriter struct {
+	status int
+	header http.Header
+	body   bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{status: http.StatusOK, header: make(http.Header)}
+}
+
+func (bw *bufferedResponseWriter) Header() http.Header {
+	return bw.header
+}
+
+func (bw *bufferedResponseWriter) Write(b []byte) (int, error) {
+	return bw.body.Write(b)
+}
+
+func (bw *bufferedResponseWriter) WriteHeader(status int) {
+	bw.status = status
+}
@@ -0,0 +1,234 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheControlTTL(t *testing.T) {
+	ttl, ok := cacheControlTTL("")
+	assert.False(t, ok)
+	ttl, ok = cacheControlTTL("public, max-age=60")
+	assert.True(t, ok)
+	assert.Equal(t, 60*time.Second, ttl)
+	ttl, ok = cacheControlTTL("max-age=60, s-maxage=10")
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, ttl)
+	ttl, ok = cacheControlTTL("no-store")
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), ttl)
+	for _, private := range []string{"private, max-age=60", "max-age=60, no-cache", `private="Set-Cookie", max-age=60`} {
+		ttl, ok = cacheControlTTL(private)
+		assert.True(t, ok)
+		assert.Equal(t, time.Duration(0), ttl, private)
+	}
+}
+
+func TestResponseCacheKey(t *testing.T) {
+	query := url.Values{"b": []string{"2"}, "a": []string{"1"}}
+	key1 := responseCacheKey("m", "api/v1/x/1", map[string]string{"id": "1"}, query, "")
+	key2 := responseCacheKey("m", "api/v1/x/1", map[string]string{"id": "1"},
+		url.Values{"a": []string{"1"}, "b": []string{"2"}}, "")
+	assert.Equal(t, key1, key2)
+	assert.NotEqual(t, key1, responseCacheKey("m", "api/v1/x/1",
+		map[string]string{"id": "1"}, query, "someone"))
+}
+
+func fillWith(body string, calls *int) func(w http.ResponseWriter) error {
+	return func(w http.ResponseWriter) error {
+		*calls++
+		fmt.Fprint(w, body)
+		return nil
+	}
+}
+
+func TestResponseCacheLRU(t *testing.T) {
+	c := NewResponseCache(2, time.Minute)
+	calls := 0
+	c.do("a", "m1", fillWith("a", &calls))
+	c.do("b", "m2", fillWith("b", &calls))
+	c.do("a", "m1", fillWith("a", &calls))
+	assert.Equal(t, 2, calls)
+	c.do("c", "m2", fillWith("c", &calls))
+	assert.Equal(t, 2, c.Len())
+	// "b" was least recently used, so it was evicted.
+	c.do("b", "m2", fillWith("b", &calls))
+	assert.Equal(t, 4, calls)
+	c.do("a", "m1", fillWith("a", &calls))
+	assert.Equal(t, 5, calls)
+}
+
+func TestResponseCacheExpiry(t *testing.T) {
+	now := time.Now()
+	c := NewResponseCache(0, 0)
+	c.now = func() time.Time { return now }
+	c.SetMethodTTL("m", time.Second)
+	calls := 0
+	c.do("a", "m", fillWith("a", &calls))
+	c.do("a", "m", fillWith("a", &calls))
+	assert.Equal(t, 1, calls)
+	now = now.Add(2 * time.Second)
+	c.do("a", "m", fillWith("a", &calls))
+	assert.Equal(t, 2, calls)
+	// No TTL configured for this method.
+	c.do("b", "other", fillWith("b", &calls))
+	assert.Equal(t, 1, c.Len())
+}
+
+func TestResponseCachePurge(t *testing.T) {
+	c := NewResponseCache(0, time.Minute)
+	calls := 0
+	c.do("a", "m1", fillWith("a", &calls))
+	c.do("b", "m2", fillWith("b", &calls))
+	c.PurgeMethod("m1")
+	assert.Equal(t, 1, c.Len())
+	c.Purge()
+	assert.Equal(t, 0, c.Len())
+}
+
+func TestResponseCacheSingleFlight(t *testing.T) {
+	c := NewResponseCache(0, time.Minute)
+	release := make(chan struct{})
+	var mu sync.Mutex
+	calls := 0
+	fill := func(w http.ResponseWriter) error {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		fmt.Fprint(w, "body")
+		return nil
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			entry, err := c.do("a", "m", fill)
+			assert.NoError(t, err)
+			assert.Equal(t, "body", entry.body)
+		}()
+	}
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	assert.Equal(t, 1, calls)
+}
+
+func TestResponseCacheFillPanic(t *testing.T) {
+	c := NewResponseCache(0, time.Minute)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	go func() {
+		defer func() { recover() }()
+		c.do("a", "m", func(w http.ResponseWriter) error {
+			close(started)
+			<-release
+			panic("fill failed")
+		})
+	}()
+	<-started
+
+	waited := make(chan error)
+	go func() {
+		_, err := c.do("a", "m", func(w http.ResponseWriter) error { return nil })
+		waited <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	close(release)
+	select {
+	case err := <-waited:
+		assert.Error(t, err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Waiter blocked after fill panicked")
+	}
+
+	// The key can be filled again.
+	entry, err := c.do("a", "m", func(w http.ResponseWriter) error {
+		fmt.Fprint(w, "body")
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "body", entry.body)
+}
+
+func TestServeCachedResponse(t *testing.T) {
+	config := &endpoints.ApiDescriptor{
+		Name:    "guestbook_api",
+		Version: "v1",
+		Methods: map[string]*endpoints.ApiMethod{
+			"guestbook.get": &endpoints.ApiMethod{
+				HttpMethod: "GET",
+				Path:       "greetings/{gid}",
+				RosyMethod: "MyApi.greetings_get",
+			},
+		},
+	}
+	server := newEndpointsServer()
+	server.SetResponseCache(NewResponseCache(10, time.Minute))
+	ts := prepareTestServer(t, config)
+	server.url = ts.URL
+	defer ts.Close()
+
+	calls := 0
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set(headerRequestId, r.Header.Get(headerRequestId))
+		fmt.Fprintf(w, `{"calls": %d}`, calls)
+	}))
+	defer ts2.Close()
+	server.SetSpiUrlBuilder(SpiUrlBuilderFunc(func(ed *EndpointsServer, spiRequest *ApiRequest) string {
+		return ts2.URL + fmt.Sprintf(spiRootFormat, spiRequest.URL.Path)
+	}))
+
+	get := func(path string, header http.Header) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		server.ServeHTTP(w, buildRequest(path, "", header))
+		return w
+	}
+	w1 := get("/_ah/api/guestbook_api/v1/greetings/1",
+		http.Header{headerRequestId: []string{"first"}})
+	w2 := get("/_ah/api/guestbook_api/v1/greetings/1",
+		http.Header{headerRequestId: []string{"second"}})
+	assert.Equal(t, 1, calls)
+	assert.Equal(t, w1.Body.String(), w2.Body.String())
+
+	// Each caller gets its own request id, not the one the backend echoed
+	// to the caller that filled the entry.
+	assert.Equal(t, "first", w1.Header().Get(headerRequestId))
+	assert.Equal(t, "second", w2.Header().Get(headerRequestId))
+
+	// Conditional requests are answered from the cache.
+	w3 := get("/_ah/api/guestbook_api/v1/greetings/1",
+		http.Header{"If-None-Match": []string{w1.Header().Get("ETag")}})
+	assert.Equal(t, 304, w3.Code)
+	assert.Equal(t, 1, calls)
+
+	// Different parameters and callers don't share entries.
+	get("/_ah/api/guestbook_api/v1/greetings/2", nil)
+	get("/_ah/api/guestbook_api/v1/greetings/1",
+		http.Header{"Authorization": []string{"Bearer x"}})
+	assert.Equal(t, 3, calls)
+}
@@ -0,0 +1,298 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"github.com/rwl/go-endpoints/endpoints"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Retrying of failed SPI calls.
+//
+// Calls that fail with a connection error or a 502, 503 or 504 response
+// are retried with exponential backoff and jitter. Retries are
+// limited by a retry budget shared by all methods, so that a failing
+// backend isn't sent a multiple of its normal load, and by the deadline
+// of the client's request.
+
+const (
+	defaultRetryInitialBackoff = 50 * time.Millisecond
+	defaultRetryMaxBackoff     = time.Second
+	defaultRetryMultiplier     = 2
+
+	defaultRetryBudgetRatio = 0.2
+	defaultRetryBudgetMin   = 10
+	retryBudgetWindow       = 10 * time.Second
+)
+
+// RetryPolicy configures retrying of failed SPI calls.
+//
+// By default only methods with idempotent HTTP methods (GET, HEAD, PUT,
+// DELETE and OPTIONS) are retried.
+type RetryPolicy struct {
+	// Maximum number of attempts, including the first. Calls aren't
+	// retried if this is less than 2.
+	MaxAttempts int
+
+	// Backoff before the first retry, the limit on the backoff and the
+	// factor it grows by after each retry. The time actually waited is
+	// chosen at random between half the backoff and the whole of it.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+
+	// Safe marks the method as safe to retry even if its HTTP method
+	// isn't idempotent.
+	Safe bool
+}
+
+// Returns true if calls to the given method may be retried.
+func (p *RetryPolicy) allows(methodConfig *endpoints.ApiMethod) bool {
+	if p == nil || p.MaxAttempts < 2 {
+		return false
+	}
+	return p.Safe || isIdempotentMethod(methodConfig)
+}
+
+// Returns the time to wait before the given retry, counting from 1.
+func (p *RetryPolicy) backoff(retry int) time.Duration {
+	initial := p.InitialBackoff
+	if initial <= 0 {
+		initial = defaultRetryInitialBackoff
+	}
+	max := p.MaxBackoff
+	if max <= 0 {
+		max = defaultRetryMaxBackoff
+	}
+	multiplier := p.Multiplier
+	if multiplier < 1 {
+		multiplier = defaultRetryMultiplier
+	}
+	backoff := float64(initial) * math.Pow(multiplier, float64(retry-1))
+	if backoff > float64(max) {
+		backoff = float64(max)
+	}
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(int64(backoff)-half+1))
+}
+
+// Returns true if the HTTP method of an API method is idempotent.
+func isIdempotentMethod(methodConfig *endpoints.ApiMethod) bool {
+	switch strings.ToUpper(methodConfig.HttpMethod) {
+	case "GET", "HEAD", "PUT", "DELETE", "OPTIONS":
+		return true
+	}
+	return false
+}
+
+// Returns true if an SPI call with the given outcome should be retried.
+func isRetryableResponse(resp *http.Response, err error) bool {
+	if _, ok := err.(*circuitOpenError); ok {
+		return false
+	}
+	if err != nil {
+		return true
+	}
+	switch resp.StatusCode {
+	case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// Limits retries to a proportion of the calls made in each window of
+// time, plus a minimum number.
+type retryBudget struct {
+	ratio      float64
+	minRetries int
+
+	windowStart time.Time
+	calls       int
+	retries     int
+	lock        sync.Mutex
+	now         func() time.Time
+}
+
+// Starts a new window if the current one has ended. Must be called with
+// the lock held.
+func (b *retryBudget) roll() {
+	if b.now == nil {
+		b.now = time.Now
+	}
+	if now := b.now(); now.Sub(b.windowStart) >= retryBudgetWindow {
+		b.windowStart = now
+		b.calls = 0
+		b.retries = 0
+	}
+}
+
+// Counts a call made for the first time.
+func (b *retryBudget) call() {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.roll()
+	b.calls++
+}
+
+// Takes a retry from the budget. Returns false if the budget is spent.
+func (b *retryBudget) withdraw() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.roll()
+	ratio, min := b.ratio, b.minRetries
+	if ratio == 0 && min == 0 {
+		ratio, min = defaultRetryBudgetRatio, defaultRetryBudgetMin
+	}
+	if float64(b.retries) >= float64(min)+ratio*float64(b.calls) {
+		return false
+	}
+	b.retries++
+	return true
+}
+
+// Counts of the retries made for each method.
+type retryCounter struct {
+	counts map[string]int64
+	lock   sync.Mutex
+}
+
+func (c *retryCounter) add(methodName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.counts == nil {
+		c.counts = make(map[string]int64)
+	}
+	c.counts[methodName]++
+}
+
+func (c *retryCounter) snapshot() map[string]int64 {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	result := make(map[string]int64, len(c.counts))
+	for name, count := range c.counts {
+		result[name] = count
+	}
+	return result
+}
+
+// SetRetryPolicy sets the policy for retrying failed SPI calls to methods
+// that don't have their own policy. Passing nil disables retries, which is
+// the default.
+func (ed *EndpointsServer) SetRetryPolicy(p *RetryPolicy) {
+	ed.retryLock.Lock()
+	defer ed.retryLock.Unlock()
+	ed.retryPolicy = p
+}
+
+// SetMethodRetryPolicy sets the policy for retrying failed SPI calls to
+// the named method, as used in the API configuration (e.g.
+// "guestbook.get"). Passing nil reverts to the server's policy.
+func (ed *EndpointsServer) SetMethodRetryPolicy(methodName string, p *RetryPolicy) {
+	ed.retryLock.Lock()
+	defer ed.retryLock.Unlock()
+	if ed.methodRetryPolicies == nil {
+		ed.methodRetryPolicies = make(map[string]*RetryPolicy)
+	}
+	if p == nil {
+		delete(ed.methodRetryPolicies, methodName)
+	} else {
+		ed.methodRetryPolicies[methodName] = p
+	}
+}
+
+// SetRetryBudget limits the retries made in each 10 second window to
+// minRetries plus ratio times the number of SPI calls made. The default
+// budget is 10 retries plus 20% of calls.
+func (ed *EndpointsServer) SetRetryBudget(ratio float64, minRetries int) {
+	ed.retryBudget.lock.Lock()
+	defer ed.retryBudget.lock.Unlock()
+	ed.retryBudget.ratio = ratio
+	ed.retryBudget.minRetries = minRetries
+}
+
+// RetryCounts returns the number of retries made for each method.
+func (ed *EndpointsServer) RetryCounts() map[string]int64 {
+	return ed.retryCounter.snapshot()
+}
+
+// Returns the retry policy for the named method, or nil if calls to it
+// aren't retried.
+func (ed *EndpointsServer) methodRetryPolicy(methodName string) *RetryPolicy {
+	ed.retryLock.Lock()
+	defer ed.retryLock.Unlock()
+	if p, ok := ed.methodRetryPolicies[methodName]; ok {
+		return p
+	}
+	return ed.retryPolicy
+}
+
+// Sends a transformed request to the SPI, retrying as allowed by the
+// method's retry policy.
+func (ed *EndpointsServer) postSpiWithRetries(spiRequest *ApiRequest, methodConfig *endpoints.ApiMethod) (*http.Response, error) {
+	policy := ed.methodRetryPolicy(spiRequest.Method)
+	if !policy.allows(methodConfig) {
+		return ed.postSpi(spiRequest, "application/json", spiRequest.Body)
+	}
+	body, err := ioutil.ReadAll(spiRequest.Body)
+	if err != nil {
+		return nil, err
+	}
+	ctx := spiRequest.Context()
+	ed.retryBudget.call()
+	for attempt := 1; ; attempt++ {
+		resp, err := ed.postSpi(spiRequest, "application/json", bytes.NewReader(body))
+		if attempt >= policy.MaxAttempts || !isRetryableResponse(resp, err) {
+			if attempt > 1 {
+				ed.log().Info("SPI call made several attempts", "method", spiRequest.Method,
+					"attempts", attempt)
+			}
+			return resp, err
+		}
+		backoff := policy.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(backoff).After(deadline) {
+			ed.log().Info("Not retrying: request deadline would pass", "method", spiRequest.Method)
+			return resp, err
+		}
+		if !ed.retryBudget.withdraw() {
+			ed.log().Info("Not retrying: retry budget spent", "method", spiRequest.Method)
+			return resp, err
+		}
+		if err != nil {
+			ed.log().Info("Retrying after failed attempt", "method", spiRequest.Method,
+				"attempt", attempt, "error", err)
+		} else {
+			ed.log().Info("Retrying after failed attempt", "method", spiRequest.Method,
+				"attempt", attempt, "status", resp.StatusCode)
+			io.Copy(ioutil.Discard, resp.Body)
+			resp.Body.Close()
+		}
+		ed.retryCounter.add(spiRequest.Method)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil, ctx.Err()
+		}
+	}
+}
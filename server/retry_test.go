@@ -0,0 +1,154 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestRetryBackoff(t *testing.T) {
+	p := &RetryPolicy{InitialBackoff: 10 * time.Millisecond, MaxBackoff: 25 * time.Millisecond}
+	for i := 0; i < 20; i++ {
+		backoff := p.backoff(1)
+		assert.True(t, backoff >= 5*time.Millisecond && backoff <= 10*time.Millisecond)
+		backoff = p.backoff(2)
+		assert.True(t, backoff >= 10*time.Millisecond && backoff <= 20*time.Millisecond)
+		backoff = p.backoff(5)
+		assert.True(t, backoff >= 12*time.Millisecond && backoff <= 25*time.Millisecond)
+	}
+}
+
+func TestRetryPolicyAllows(t *testing.T) {
+	get := &endpoints.ApiMethod{HttpMethod: "GET"}
+	post := &endpoints.ApiMethod{HttpMethod: "POST"}
+	var nilPolicy *RetryPolicy
+	assert.False(t, nilPolicy.allows(get))
+	assert.False(t, (&RetryPolicy{MaxAttempts: 1}).allows(get))
+	assert.True(t, (&RetryPolicy{MaxAttempts: 3}).allows(get))
+	assert.False(t, (&RetryPolicy{MaxAttempts: 3}).allows(post))
+	assert.True(t, (&RetryPolicy{MaxAttempts: 3, Safe: true}).allows(post))
+}
+
+func TestRetryBudget(t *testing.T) {
+	now := time.Unix(1000, 0)
+	b := &retryBudget{ratio: 0.5, minRetries: 1, now: func() time.Time { return now }}
+	b.call()
+	b.call()
+	assert.True(t, b.withdraw())
+	assert.True(t, b.withdraw())
+	assert.False(t, b.withdraw())
+	now = now.Add(retryBudgetWindow)
+	assert.True(t, b.withdraw())
+}
+
+// Starts a backend for a_api whose method calls fail with a 503 the given
+// number of times before succeeding.
+func startFlakyBackend(failures int) (*httptest.Server, *int) {
+	calls := 0
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		if calls <= failures {
+			w.WriteHeader(503)
+			fmt.Fprint(w, `{"error_message": "unavailable"}`)
+			return
+		}
+		fmt.Fprintf(w, `{"body": %q}`, string(body))
+	}))
+	return ts, &calls
+}
+
+func newRetryServer(ts *httptest.Server) *EndpointsServer {
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+	config := buildSourceConfig("a_api")
+	config.Methods["a_api.insert"] = &endpoints.ApiMethod{HttpMethod: "POST", Path: "items", RosyMethod: "MyApi.insert"}
+	server.SetConfigSource(NewStaticConfigSource(config))
+	server.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	return server
+}
+
+func TestRetryIdempotent(t *testing.T) {
+	ts, calls := startFlakyBackend(2)
+	defer ts.Close()
+	server := newRetryServer(ts)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 3, *calls)
+	assert.Equal(t, int64(2), server.RetryCounts()["a_api.get"])
+}
+
+func TestRetryNotIdempotent(t *testing.T) {
+	ts, calls := startFlakyBackend(1)
+	defer ts.Close()
+	server := newRetryServer(ts)
+
+	w := httptest.NewRecorder()
+	req := buildRequest("/_ah/api/a_api/v1/items", `{"a": 1}`, nil)
+	req.Method = "POST"
+	server.ServeHTTP(w, req)
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, 1, *calls)
+
+	// Unless the method is marked safe to retry.
+	server.SetMethodRetryPolicy("a_api.insert", &RetryPolicy{MaxAttempts: 2, Safe: true})
+	*calls = 0
+	w = httptest.NewRecorder()
+	req = buildRequest("/_ah/api/a_api/v1/items", `{"a": 1}`, nil)
+	req.Method = "POST"
+	server.ServeHTTP(w, req)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, 2, *calls)
+	// The request body is sent again.
+	assert.Contains(t, w.Body.String(), `\"a\":1`)
+}
+
+func TestRetryBudgetSpent(t *testing.T) {
+	ts, calls := startFlakyBackend(10)
+	defer ts.Close()
+	server := newRetryServer(ts)
+	server.SetRetryBudget(0, 1)
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 503, w.Code)
+	assert.Equal(t, 2, *calls)
+}
+
+func TestRetryDeadline(t *testing.T) {
+	ts, calls := startFlakyBackend(10)
+	defer ts.Close()
+	server := newRetryServer(ts)
+	server.SetRetryPolicy(&RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Hour, MaxBackoff: time.Hour})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil).WithContext(ctx))
+	assert.Equal(t, 1, *calls)
+	assert.Equal(t, 503, w.Code)
+}
@@ -0,0 +1,256 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// TLS for serving and for calling backends.
+//
+// A CertificateReloader serves a certificate from files and reads them
+// again when they change, so that renewed certificates are used without a
+// restart. SetBackendTLS configures the TLS of the connections to https
+// backends, which may present a client certificate for mutual TLS. The
+// https URLs of backends are only switched to http, for development, when
+// SetConvertHttpsToHttp is enabled.
+
+// How often a CertificateReloader checks its files for changes.
+const certCheckInterval = 10 * time.Second
+
+// CertificateReloader holds a certificate and key read from PEM files,
+// and reads them again when the files change.
+type CertificateReloader struct {
+	certFile, keyFile string
+
+	cert    *tls.Certificate
+	modTime time.Time // Latest modification time of the files read.
+	checked time.Time // When the files were last checked for changes.
+
+	// Interval at which the files are checked for changes.
+	checkInterval time.Duration
+
+	lock sync.Mutex
+	now  func() time.Time
+
+	// Logger of reloads, or nil for the default.
+	logger Logger
+}
+
+// NewCertificateReloader returns a CertificateReloader for the given
+// certificate and key files, or an error if they can't be read.
+func NewCertificateReloader(certFile, keyFile string) (*CertificateReloader, error) {
+	c := &CertificateReloader{
+		certFile:      certFile,
+		keyFile:       keyFile,
+		checkInterval: certCheckInterval,
+		now:           time.Now,
+	}
+	if err := c.Reload(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// SetLogger sets the logger of the reloads of the certificate. Passing nil
+// restores the default, which is slog.Default().
+func (c *CertificateReloader) SetLogger(l Logger) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.logger = l
+}
+
+// Returns the latest modification time of the certificate and key files.
+func (c *CertificateReloader) filesModTime() (time.Time, error) {
+	var latest time.Time
+	for _, name := range []string{c.certFile, c.keyFile} {
+		info, err := os.Stat(name)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// Reload reads the certificate and key files again. If they can't be
+// read, the certificate already held is kept and the error is returned.
+func (c *CertificateReloader) Reload() error {
+	modTime, err := c.filesModTime()
+	if err != nil {
+		return err
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = &cert
+	c.modTime = modTime
+	c.checked = c.now()
+	return nil
+}
+
+// Returns the certificate held, having first reloaded it if the files
+// have changed since they were last read.
+func (c *CertificateReloader) certificate() *tls.Certificate {
+	c.lock.Lock()
+	due := c.now().Sub(c.checked) >= c.checkInterval
+	if due {
+		c.checked = c.now()
+	}
+	modTime := c.modTime
+	logger := loggerOrDefault(c.logger)
+	c.lock.Unlock()
+
+	if due {
+		if latest, err := c.filesModTime(); err == nil && !latest.Equal(modTime) {
+			if err = c.Reload(); err != nil {
+				logger.Warn("Certificate not reloaded", "cert_file", c.certFile, "error", err)
+			} else {
+				logger.Info("Reloaded certificate", "cert_file", c.certFile)
+			}
+		}
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.cert
+}
+
+// GetCertificate returns the certificate for a TLS server, as the
+// GetCertificate function of a tls.Config.
+func (c *CertificateReloader) GetCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return c.certificate(), nil
+}
+
+// GetClientCertificate returns the certificate for a TLS client, as the
+// GetClientCertificate function of a tls.Config.
+func (c *CertificateReloader) GetClientCertificate(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return c.certificate(), nil
+}
+
+// BackendTLSOptions configures the TLS of connections to https backends.
+type BackendTLSOptions struct {
+	// PEM file of the certificate authorities that backend certificates
+	// are verified with. The system's are used if it is empty.
+	CAFile string
+
+	// PEM files of the client certificate and key presented to backends
+	// that require mutual TLS. They are reloaded when they change.
+	CertFile string
+	KeyFile  string
+
+	// Name that backend certificates are verified against, if it isn't
+	// the host of the backend URL. It applies to every backend, so it
+	// should be left empty when several backends with certificates for
+	// different names are fronted.
+	ServerName string
+
+	// Skips verification of backend certificates. For development only.
+	InsecureSkipVerify bool
+
+	// Logger of the reloads of the client certificate, or nil for the
+	// default.
+	Logger Logger
+}
+
+// NewBackendTLSConfig returns the TLS configuration for connections to
+// backends described by the given options, or an error if the files they
+// name can't be read.
+func NewBackendTLSConfig(opts BackendTLSOptions) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         opts.ServerName,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	if opts.CAFile != "" {
+		pem, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificates found in " + opts.CAFile)
+		}
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		if opts.CertFile == "" || opts.KeyFile == "" {
+			return nil, errors.New("Client certificate needs both a cert file and a key file")
+		}
+		reloader, err := NewCertificateReloader(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		reloader.SetLogger(opts.Logger)
+		config.GetClientCertificate = reloader.GetClientCertificate
+	}
+	return config, nil
+}
+
+// SetBackendTLS sets the TLS configuration of the connections to https
+// backends: SPI calls, BackendService.getApiConfigs calls and the health
+// checks of replicas set afterwards with SetReplicas. The default SPI
+// transport is replaced with one that sends requests over HTTP using the
+// configuration. A transport set with SetSpiTransport is kept, and only
+// the health checks use the configuration. Passing nil restores the
+// defaults.
+func (ed *EndpointsServer) SetBackendTLS(config *tls.Config) {
+	var transport *http.Transport
+	var spiTransport SpiTransport
+	if config != nil {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = config
+		spiTransport = NewHttpSpiTransport(&http.Client{Transport: transport})
+	}
+	ed.transportLock.Lock()
+	defer ed.transportLock.Unlock()
+	if ed.transport == nil || ed.transport == ed.backendSpiTransport {
+		ed.transport = spiTransport
+		ed.backendSpiTransport = spiTransport
+	} else if config != nil {
+		ed.log().Warn("Backend TLS not applied to the SPI transport set with SetSpiTransport")
+	}
+	ed.backendTransport = transport
+}
+
+// Returns the transport that the health checks of replicas are made with,
+// or nil for the default.
+func (ed *EndpointsServer) healthCheckTransport() http.RoundTripper {
+	ed.transportLock.Lock()
+	defer ed.transportLock.Unlock()
+	if ed.backendTransport == nil {
+		return nil
+	}
+	return ed.backendTransport
+}
+
+// SetConvertHttpsToHttp sets whether the https backend and root URLs in
+// API configurations are switched to http, as the development server
+// does for backends that report https URLs but serve plain HTTP locally.
+// It is off by default, so that https backends are called over TLS. It
+// must be called before the configurations are loaded.
+func (ed *EndpointsServer) SetConvertHttpsToHttp(enabled bool) {
+	ed.configManager.convertHttps = enabled
+}
@@ -0,0 +1,176 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// Writes a new self-signed certificate and its key to PEM files in dir.
+func writeTestCertificate(t *testing.T, dir, name string) (certFile, keyFile string, cert *x509.Certificate) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth, x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	cert, err = x509.ParseCertificate(der)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile = filepath.Join(dir, name+".pem")
+	keyFile = filepath.Join(dir, name+".key")
+	assert.NoError(t, ioutil.WriteFile(certFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644))
+	assert.NoError(t, ioutil.WriteFile(keyFile,
+		pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile, cert
+}
+
+func TestCertificateReloader(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, first := writeTestCertificate(t, dir, "server")
+
+	reloader, err := NewCertificateReloader(certFile, keyFile)
+	assert.NoError(t, err)
+	now := time.Now()
+	reloader.now = func() time.Time { return now }
+	cert, err := reloader.GetCertificate(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, first.Raw, cert.Certificate[0])
+
+	// A renewed certificate is picked up once the check interval passes.
+	_, _, second := writeTestCertificate(t, dir, "server")
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(certFile, later, later))
+	cert, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, first.Raw, cert.Certificate[0])
+	now = now.Add(certCheckInterval)
+	cert, _ = reloader.GetCertificate(nil)
+	assert.Equal(t, second.Raw, cert.Certificate[0])
+
+	// The certificate held is kept if the files can't be read.
+	assert.NoError(t, ioutil.WriteFile(keyFile, []byte("bad"), 0600))
+	assert.Error(t, reloader.Reload())
+	cert, _ = reloader.GetClientCertificate(nil)
+	assert.Equal(t, second.Raw, cert.Certificate[0])
+
+	_, err = NewCertificateReloader(filepath.Join(dir, "missing.pem"), keyFile)
+	assert.Error(t, err)
+}
+
+func TestBackendMutualTLS(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	clientCertFile, clientKeyFile, clientCert := writeTestCertificate(t, dir, "client")
+
+	ts := httptest.NewUnstartedServer(newSpiHandler())
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: x509.NewCertPool()}
+	ts.TLS.ClientCAs.AddCert(clientCert)
+	ts.StartTLS()
+	defer ts.Close()
+	caFile := filepath.Join(dir, "ca.pem")
+	assert.NoError(t, ioutil.WriteFile(caFile,
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw}), 0644))
+	u, _ := url.Parse(ts.URL)
+
+	// Without the CA and client certificate the backend can't be called.
+	server := NewEndpointsServer(u)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.NotEqual(t, 200, w.Code)
+
+	config, err := NewBackendTLSConfig(BackendTLSOptions{
+		CAFile:   caFile,
+		CertFile: clientCertFile,
+		KeyFile:  clientKeyFile,
+	})
+	assert.NoError(t, err)
+	server = NewEndpointsServer(u)
+	server.SetBackendTLS(config)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Contains(t, w.Body.String(), `{\"id\":\"1\"}`)
+
+	// Switching the backend URL to http breaks the call.
+	server = NewEndpointsServer(u)
+	server.SetBackendTLS(config)
+	server.SetConvertHttpsToHttp(true)
+	w = httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.NotEqual(t, 200, w.Code)
+}
+
+func TestNewBackendTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile, _ := writeTestCertificate(t, dir, "client")
+
+	_, err = NewBackendTLSConfig(BackendTLSOptions{CAFile: keyFile})
+	assert.Error(t, err)
+	_, err = NewBackendTLSConfig(BackendTLSOptions{CertFile: certFile})
+	assert.Error(t, err)
+	config, err := NewBackendTLSConfig(BackendTLSOptions{ServerName: "backend", InsecureSkipVerify: true})
+	assert.NoError(t, err)
+	assert.Equal(t, "backend", config.ServerName)
+	assert.Nil(t, config.GetClientCertificate)
+
+	// Health checks of replicas use the backend TLS.
+	u, _ := url.Parse("https://backend")
+	server := NewEndpointsServer(u)
+	server.SetBackendTLS(config)
+	server.SetReplicas(u, []*url.URL{u}, ReplicaOptions{})
+	transport := server.replicaPool("https://backend").transport.(*http.Transport)
+	assert.Equal(t, config, transport.TLSClientConfig)
+	server.SetBackendTLS(nil)
+	assert.Nil(t, server.healthCheckTransport())
+	assert.Nil(t, server.transport)
+
+	// A transport set with SetSpiTransport is kept.
+	inProcess := NewHandlerSpiTransport(newSpiHandler())
+	server.SetSpiTransport(inProcess)
+	server.SetBackendTLS(config)
+	assert.Equal(t, inProcess, server.spiTransport())
+	assert.NotNil(t, server.healthCheckTransport())
+	server.SetBackendTLS(nil)
+	assert.Equal(t, inProcess, server.spiTransport())
+}
@@ -0,0 +1,254 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Tracing of requests with W3C Trace Context propagation.
+//
+// Each API request has a server span with child spans for routing, the
+// request transform, each SPI call and the response transform. The
+// traceparent and tracestate headers of the client's request are passed
+// on to the SPI, with the SPI call's span as the parent when tracing is
+// enabled, so that the backend's spans join the same trace.
+
+const (
+	headerTraceparent = "Traceparent"
+	headerTracestate  = "Tracestate"
+
+	zeroTraceID = "00000000000000000000000000000000"
+	zeroSpanID  = "0000000000000000"
+)
+
+var traceparentRegexp = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-([0-9a-f]{2})(-.*)?$`)
+
+// SpanKind is the role of a span in a trace, as in OpenTelemetry.
+type SpanKind string
+
+const (
+	SpanKindServer   SpanKind = "server"
+	SpanKindClient   SpanKind = "client"
+	SpanKindInternal SpanKind = "internal"
+)
+
+// Span is a timed operation in serving a request. Its fields follow the
+// OpenTelemetry span model.
+type Span struct {
+	TraceID      string
+	SpanID       string
+	ParentSpanID string `json:",omitempty"`
+	Name         string
+	Kind         SpanKind
+	StartTime    time.Time
+	EndTime      time.Time
+	Attributes   map[string]string `json:",omitempty"`
+	Error        string            `json:",omitempty"`
+}
+
+// Sets an attribute of the span. It is a no-op for a nil span, which is
+// used when the request isn't traced.
+func (s *Span) setAttribute(key, value string) {
+	if s == nil {
+		return
+	}
+	if s.Attributes == nil {
+		s.Attributes = make(map[string]string)
+	}
+	s.Attributes[key] = value
+}
+
+// Ends the span, recording err if it is not nil.
+func (s *Span) end(err error) {
+	if s == nil {
+		return
+	}
+	s.EndTime = time.Now()
+	if err != nil {
+		s.Error = err.Error()
+	}
+}
+
+// SpanExporter exports finished spans. It mirrors the SpanExporter
+// interface of the OpenTelemetry SDK, so that an adapter to any
+// OpenTelemetry exporter is trivial.
+type SpanExporter interface {
+	ExportSpans(ctx context.Context, spans []*Span) error
+	Shutdown(ctx context.Context) error
+}
+
+// Exporter that writes spans to a writer as JSON, one per line.
+type writerSpanExporter struct {
+	w      io.Writer
+	closer io.Closer
+	lock   sync.Mutex
+}
+
+// NewWriterSpanExporter returns a SpanExporter that writes each span to w
+// as a line of JSON, such as to os.Stdout for local testing.
+func NewWriterSpanExporter(w io.Writer) SpanExporter {
+	return &writerSpanExporter{w: w}
+}
+
+// NewFileSpanExporter returns a SpanExporter that appends each span to the
+// named file as a line of JSON. The file is closed by Shutdown.
+func NewFileSpanExporter(name string) (SpanExporter, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &writerSpanExporter{w: f, closer: f}, nil
+}
+
+func (e *writerSpanExporter) ExportSpans(ctx context.Context, spans []*Span) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	enc := json.NewEncoder(e.w)
+	for _, span := range spans {
+		if err := enc.Encode(span); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *writerSpanExporter) Shutdown(ctx context.Context) error {
+	if e.closer != nil {
+		return e.closer.Close()
+	}
+	return nil
+}
+
+// The trace context of a request and the spans recorded for it.
+type requestTrace struct {
+	traceID  string
+	parentID string // Span of the client's request, if any.
+	sampled  bool
+	state    string // Incoming tracestate, passed on unchanged.
+
+	incoming string // Incoming traceparent, if valid.
+
+	exporter SpanExporter // Nil if spans aren't recorded.
+	logger   Logger
+	root     *Span
+	spans    []*Span
+	lock     sync.Mutex
+}
+
+// Returns the trace of a request from the client, continuing the trace
+// given by its traceparent header, if any.
+func (ed *EndpointsServer) newRequestTrace(r *http.Request) *requestTrace {
+	t := &requestTrace{sampled: true}
+	if m := traceparentRegexp.FindStringSubmatch(r.Header.Get(headerTraceparent)); m != nil &&
+		m[1] != "ff" && m[2] != zeroTraceID && m[3] != zeroSpanID && (m[1] != "00" || m[5] == "") {
+		flags, _ := hex.DecodeString(m[4])
+		t.traceID, t.parentID, t.sampled = m[2], m[3], flags[0]&1 == 1
+		t.incoming = r.Header.Get(headerTraceparent)
+		t.state = r.Header.Get(headerTracestate)
+	} else {
+		t.traceID = randomHex(16)
+	}
+	if exporter := ed.spanExporter; exporter != nil && t.sampled {
+		t.exporter = exporter
+		t.logger = ed.log()
+		t.root = t.startSpan("EndpointsServer.ServeHTTP", SpanKindServer)
+		t.root.ParentSpanID = t.parentID
+		t.root.setAttribute("http.method", r.Method)
+		t.root.setAttribute("http.target", r.URL.RequestURI())
+	}
+	return t
+}
+
+// Starts a child of the request's server span. Returns nil if the request
+// isn't traced.
+func (t *requestTrace) startSpan(name string, kind SpanKind) *Span {
+	if t == nil || t.exporter == nil {
+		return nil
+	}
+	span := &Span{
+		TraceID:   t.traceID,
+		SpanID:    randomHex(8),
+		Name:      name,
+		Kind:      kind,
+		StartTime: time.Now(),
+	}
+	if t.root != nil {
+		span.ParentSpanID = t.root.SpanID
+	}
+	t.lock.Lock()
+	t.spans = append(t.spans, span)
+	t.lock.Unlock()
+	return span
+}
+
+// Sets the trace context headers of a request to the SPI made in the given
+// span, which is nil if the request isn't traced.
+func (t *requestTrace) inject(header http.Header, span *Span) {
+	if t == nil {
+		return
+	}
+	switch {
+	case span != nil:
+		header.Set(headerTraceparent, "00-"+t.traceID+"-"+span.SpanID+"-01")
+	case t.incoming != "":
+		header.Set(headerTraceparent, t.incoming)
+	default:
+		return
+	}
+	if t.state != "" {
+		header.Set(headerTracestate, t.state)
+	}
+}
+
+// Ends the server span with the response status and exports the spans.
+func (t *requestTrace) finish(status int) {
+	if t == nil || t.exporter == nil {
+		return
+	}
+	t.root.setAttribute("http.status_code", strconv.Itoa(status))
+	t.root.end(nil)
+	t.lock.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.lock.Unlock()
+	if err := t.exporter.ExportSpans(context.Background(), spans); err != nil {
+		t.logger.Warn("Failed to export spans", "error", err)
+	}
+}
+
+// Returns n random bytes in hex.
+func randomHex(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// SetSpanExporter enables tracing, with spans exported to the given
+// exporter. Passing nil disables it, which is the default; trace context
+// headers are still passed on to the SPI.
+func (ed *EndpointsServer) SetSpanExporter(e SpanExporter) {
+	ed.spanExporter = e
+}
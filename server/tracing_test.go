@@ -0,0 +1,167 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+const testTraceparent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+
+// Starts a backend that records the trace context headers of SPI calls.
+func startTraceBackend() (*httptest.Server, *http.Header) {
+	var header http.Header
+	spi := newSpiHandler()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_ah/spi/MyApi.get" {
+			header = r.Header
+		}
+		spi.ServeHTTP(w, r)
+	}))
+	return ts, &header
+}
+
+// Returns the spans written by a writer exporter.
+func readSpans(t *testing.T, b []byte) []*Span {
+	var spans []*Span
+	scanner := bufio.NewScanner(bytes.NewReader(b))
+	for scanner.Scan() {
+		var span Span
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &span))
+		spans = append(spans, &span)
+	}
+	return spans
+}
+
+func TestTraceContextPassedOnWithoutTracing(t *testing.T) {
+	ts, header := startTraceBackend()
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	server := NewEndpointsServer(u)
+
+	r := buildRequest("/_ah/api/a_api/v1/items/1", "", nil)
+	r.Header.Set("traceparent", testTraceparent)
+	r.Header.Set("tracestate", "vendor=value")
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, testTraceparent, header.Get("traceparent"))
+	assert.Equal(t, "vendor=value", header.Get("tracestate"))
+
+	// Invalid trace context isn't passed on.
+	r = buildRequest("/_ah/api/a_api/v1/items/1", "", nil)
+	r.Header.Set("traceparent", "00-00000000000000000000000000000000-00f067aa0ba902b7-01")
+	r.Header.Set("tracestate", "vendor=value")
+	server.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "", header.Get("traceparent"))
+	assert.Equal(t, "", header.Get("tracestate"))
+}
+
+func TestTraceSpans(t *testing.T) {
+	ts, header := startTraceBackend()
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	var buf bytes.Buffer
+	server := NewEndpointsServer(u)
+	server.SetSpanExporter(NewWriterSpanExporter(&buf))
+
+	r := buildRequest("/_ah/api/a_api/v1/items/1", "", nil)
+	r.Header.Set("traceparent", testTraceparent)
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, r)
+	assert.Equal(t, 200, w.Code)
+
+	spans := readSpans(t, buf.Bytes())
+	names := make([]string, len(spans))
+	byName := make(map[string]*Span)
+	for i, span := range spans {
+		names[i] = span.Name
+		byName[span.Name] = span
+		assert.Equal(t, "4bf92f3577b34da6a3ce929d0e0e4736", span.TraceID)
+		assert.False(t, span.EndTime.Before(span.StartTime))
+	}
+	assert.Equal(t, []string{"EndpointsServer.ServeHTTP", "route",
+		"transform_request", "spi_call", "transform_response"}, names)
+
+	root := byName["EndpointsServer.ServeHTTP"]
+	assert.Equal(t, "00f067aa0ba902b7", root.ParentSpanID)
+	assert.Equal(t, SpanKindServer, root.Kind)
+	assert.Equal(t, "200", root.Attributes["http.status_code"])
+	assert.Equal(t, "a_api.get", byName["route"].Attributes["rpc.method"])
+
+	spiCall := byName["spi_call"]
+	assert.Equal(t, root.SpanID, spiCall.ParentSpanID)
+	assert.Equal(t, SpanKindClient, spiCall.Kind)
+	assert.Equal(t, "MyApi.get", spiCall.Attributes["rpc.method"])
+	assert.Equal(t, ts.URL, spiCall.Attributes["endpoints.backend"])
+
+	// The backend continues the trace from the SPI call's span.
+	assert.Equal(t, "00-4bf92f3577b34da6a3ce929d0e0e4736-"+spiCall.SpanID+"-01",
+		header.Get("traceparent"))
+}
+
+func TestTraceNotSampled(t *testing.T) {
+	ts, header := startTraceBackend()
+	defer ts.Close()
+	u, _ := url.Parse(ts.URL)
+	var buf bytes.Buffer
+	server := NewEndpointsServer(u)
+	server.SetSpanExporter(NewWriterSpanExporter(&buf))
+
+	unsampled := "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-00"
+	r := buildRequest("/_ah/api/a_api/v1/items/1", "", nil)
+	r.Header.Set("traceparent", unsampled)
+	server.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, 0, buf.Len())
+	assert.Equal(t, unsampled, header.Get("traceparent"))
+
+	// Without a traceparent a new trace is started.
+	server.ServeHTTP(httptest.NewRecorder(), buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	spans := readSpans(t, buf.Bytes())
+	assert.Equal(t, 5, len(spans))
+	assert.Equal(t, 32, len(spans[0].TraceID))
+	assert.Equal(t, "", spans[0].ParentSpanID)
+	assert.NotEqual(t, zeroTraceID, spans[0].TraceID)
+}
+
+func TestFileSpanExporter(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spans")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "spans.json")
+
+	exporter, err := NewFileSpanExporter(name)
+	assert.NoError(t, err)
+	span := &Span{TraceID: "t", SpanID: "s", Name: "test", Kind: SpanKindInternal}
+	assert.NoError(t, exporter.ExportSpans(context.Background(), []*Span{span, span}))
+	assert.NoError(t, exporter.Shutdown(context.Background()))
+
+	b, err := ioutil.ReadFile(name)
+	assert.NoError(t, err)
+	spans := readSpans(t, b)
+	assert.Equal(t, 2, len(spans))
+	assert.Equal(t, "test", spans[1].Name)
+}
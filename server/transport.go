@@ -0,0 +1,178 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+)
+
+// SpiTransport sends requests to the SPI: calls to the methods of the
+// user's API and to BackendService.getApiConfigs.
+type SpiTransport interface {
+	// RoundTrip sends a POST request to an SPI method and returns the
+	// response. The request's URL is that of the method on the backend,
+	// such as http://127.0.0.1:8080/_ah/spi/MyApi.get. The caller closes
+	// the response body.
+	RoundTrip(req *http.Request) (*http.Response, error)
+}
+
+// SPI transport that makes HTTP requests with a client.
+type httpSpiTransport struct {
+	client *http.Client
+}
+
+// NewHttpSpiTransport returns an SpiTransport that sends requests over
+// HTTP with the given client, or with http.DefaultClient if client is
+// nil. This is the default transport.
+func NewHttpSpiTransport(client *http.Client) SpiTransport {
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &httpSpiTransport{client: client}
+}
+
+func (t *httpSpiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return t.client.Do(req)
+}
+
+// SPI transport that calls a handler in the same process.
+type handlerSpiTransport struct {
+	handler http.Handler
+
+	// Logger of panics in the handler, or nil for the default. It is that
+	// of the server the transport is set on.
+	logger Logger
+}
+
+// NewHandlerSpiTransport returns an SpiTransport that serves requests by
+// calling the given handler directly, rather than over the network. The
+// handler is typically the mux that a go-endpoints server's handlers are
+// registered with, so that the proxy and the SPI can run in one binary.
+func NewHandlerSpiTransport(handler http.Handler) SpiTransport {
+	return &handlerSpiTransport{handler: handler}
+}
+
+// Calls the handler in a goroutine and returns once it has written the
+// response headers. The response body is streamed from the handler as it
+// writes it.
+func (t *handlerSpiTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.WithContext(req.Context())
+	r.RequestURI = req.URL.RequestURI()
+	if r.Host == "" {
+		r.Host = req.URL.Host
+	}
+	if r.Body == nil {
+		r.Body = http.NoBody
+	}
+
+	body, pipe := io.Pipe()
+	w := &pipeResponseWriter{
+		header: make(http.Header),
+		pipe:   pipe,
+		ready:  make(chan struct{}),
+	}
+	go func() {
+		defer func() {
+			if p := recover(); p != nil {
+				loggerOrDefault(t.logger).Error("SPI handler panicked",
+					"path", req.URL.Path, "panic", fmt.Sprint(p))
+				w.WriteHeader(http.StatusInternalServerError)
+				pipe.CloseWithError(fmt.Errorf("SPI handler panicked: %v", p))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			pipe.Close()
+		}()
+		t.handler.ServeHTTP(w, r)
+	}()
+
+	select {
+	case <-w.ready:
+	case <-req.Context().Done():
+		// Fail the handler's writes so that it doesn't block.
+		body.CloseWithError(req.Context().Err())
+		return nil, req.Context().Err()
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", w.status, http.StatusText(w.status)),
+		StatusCode:    w.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        w.sent,
+		Body:          body,
+		ContentLength: -1,
+		Request:       req,
+	}, nil
+}
+
+// Response writer that passes the response body through a pipe.
+type pipeResponseWriter struct {
+	header http.Header // Headers being written.
+	sent   http.Header // Headers as they were when the status was written.
+	status int
+	pipe   *io.PipeWriter
+	ready  chan struct{} // Closed once the status has been written.
+	once   sync.Once
+}
+
+func (w *pipeResponseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *pipeResponseWriter) WriteHeader(status int) {
+	w.once.Do(func() {
+		w.status = status
+		w.sent = make(http.Header, len(w.header))
+		for k, v := range w.header {
+			w.sent[k] = append([]string(nil), v...)
+		}
+		close(w.ready)
+	})
+}
+
+func (w *pipeResponseWriter) Write(b []byte) (int, error) {
+	w.WriteHeader(http.StatusOK)
+	return w.pipe.Write(b)
+}
+
+// Flush is a no-op, as writes to the pipe aren't buffered.
+func (w *pipeResponseWriter) Flush() {
+	w.WriteHeader(http.StatusOK)
+}
+
+// SetSpiTransport sets the transport that SPI requests are sent with.
+// Passing nil restores the default, which sends them over HTTP.
+func (ed *EndpointsServer) SetSpiTransport(t SpiTransport) {
+	ed.transportLock.Lock()
+	defer ed.transportLock.Unlock()
+	if handlerTransport, ok := t.(*handlerSpiTransport); ok {
+		handlerTransport.logger = ed.logger
+	}
+	ed.transport = t
+}
+
+// Returns the transport that SPI requests are sent with.
+func (ed *EndpointsServer) spiTransport() SpiTransport {
+	ed.transportLock.Lock()
+	defer ed.transportLock.Unlock()
+	if ed.transport == nil {
+		return NewHttpSpiTransport(nil)
+	}
+	return ed.transport
+}
@@ -0,0 +1,102 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Returns a handler serving the API config for a_api, whose methods
+// respond with the request body.
+func newSpiHandler() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/_ah/spi/BackendService.getApiConfigs", func(w http.ResponseWriter, r *http.Request) {
+		configBytes, _ := json.Marshal(buildSourceConfig("a_api"))
+		body, _ := json.Marshal(map[string]interface{}{"items": []string{string(configBytes)}})
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	})
+	mux.HandleFunc("/_ah/spi/MyApi.get", func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprintf(w, `{"body": %q}`, string(body))
+	})
+	return mux
+}
+
+func TestHandlerSpiTransport(t *testing.T) {
+	u, _ := url.Parse("http://in-process")
+	server := NewEndpointsServer(u)
+	server.SetSpiTransport(NewHandlerSpiTransport(newSpiHandler()))
+
+	w := httptest.NewRecorder()
+	server.ServeHTTP(w, buildRequest("/_ah/api/a_api/v1/items/1", "", nil))
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "application/json", w.Header().Get("Content-Type"))
+	assert.Contains(t, w.Body.String(), `{\"id\":\"1\"}`)
+}
+
+func TestHandlerSpiTransportResponse(t *testing.T) {
+	transport := NewHandlerSpiTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_ah/spi/MyApi.get", r.RequestURI)
+		w.Header().Set("X-Test", "before")
+		w.WriteHeader(404)
+		w.Header().Set("X-Test", "after")
+		fmt.Fprint(w, "not found")
+	}))
+	req, _ := http.NewRequest("POST", "http://in-process/_ah/spi/MyApi.get", strings.NewReader("{}"))
+	resp, err := transport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 404, resp.StatusCode)
+		assert.Equal(t, "404 Not Found", resp.Status)
+		assert.Equal(t, "before", resp.Header.Get("X-Test"))
+		body, _ := ioutil.ReadAll(resp.Body)
+		assert.Equal(t, "not found", string(body))
+		resp.Body.Close()
+	}
+
+	// A handler that panics gives a 500.
+	transport = NewHandlerSpiTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	}))
+	req, _ = http.NewRequest("POST", "http://in-process/_ah/spi/MyApi.get", nil)
+	resp, err = transport.RoundTrip(req)
+	if assert.NoError(t, err) {
+		assert.Equal(t, 500, resp.StatusCode)
+		resp.Body.Close()
+	}
+}
+
+func TestHandlerSpiTransportCancel(t *testing.T) {
+	release := make(chan struct{})
+	defer close(release)
+	transport := NewHandlerSpiTransport(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("POST", "http://in-process/_ah/spi/MyApi.get", nil)
+	cancel()
+	_, err := transport.RoundTrip(req.WithContext(ctx))
+	assert.Equal(t, context.Canceled, err)
+}
@@ -0,0 +1,582 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Media upload support for REST methods.
+//
+// Requests to /_ah/api/upload/... are routed like ordinary REST requests,
+// but the request body is treated as media rather than JSON. Three
+// protocols are supported, selected with the uploadType query parameter:
+//
+//	media      The body is the media.
+//	multipart  The body is multipart/related, with JSON metadata in the
+//	           first part and the media in the second.
+//	resumable  The body of the initial request is the JSON metadata. The
+//	           response Location header gives a session URI to which the
+//	           media is PUT, optionally in chunks with Content-Range.
+//
+// The media is streamed to the SPI method as the second part of a
+// multipart/related request, the first part being the usual JSON request.
+
+const uploadPrefix = apiPrefix + "upload/"
+
+const (
+	uploadTypeMedia     = "media"
+	uploadTypeMultipart = "multipart"
+	uploadTypeResumable = "resumable"
+)
+
+// Resumable upload sessions idle for longer than this are abandoned.
+var uploadSessionTimeout = time.Hour
+
+// Most resumable upload sessions open at once. Further sessions are
+// refused with 503 until some finish or expire.
+var maxUploadSessions = 1000
+
+// Parses an upload request. The path is made relative to the upload root,
+// the upload protocol parameters are removed from the query and the
+// returned request has an empty JSON body.
+func newUploadRequest(r *http.Request) (ar *ApiRequest, uploadType, uploadId string, err error) {
+	if !strings.HasPrefix(r.URL.Path, uploadPrefix) {
+		return nil, "", "", fmt.Errorf("Invalid upload path: %s", r.URL.Path)
+	}
+	ar = &ApiRequest{
+		Request:     r,
+		relativeUrl: r.URL.Path,
+	}
+	query := ar.URL.Query()
+	uploadType = query.Get("uploadType")
+	uploadId = query.Get("upload_id")
+	query.Del("uploadType")
+	query.Del("upload_id")
+	ar.URL.Path = ar.URL.Path[len(uploadPrefix):]
+	ar.URL.RawQuery = query.Encode()
+	ar.setMetadata(nil)
+	return ar, uploadType, uploadId, nil
+}
+
+// Sets the JSON metadata of an upload as the body of the request.
+func (ar *ApiRequest) setMetadata(metadata []byte) error {
+	ar.bodyJson = make(map[string]interface{})
+	if len(bytes.TrimSpace(metadata)) > 0 {
+		if err := json.Unmarshal(metadata, &ar.bodyJson); err != nil {
+			return newBadRequestError(fmt.Sprintf("Problem unmarshalling upload metadata: %s", metadata))
+		}
+	}
+	body, _ := json.Marshal(ar.bodyJson)
+	ar.Body = ioutil.NopCloser(bytes.NewBuffer(body))
+	return nil
+}
+
+// Handler for requests to /upload/.*.
+func (ed *EndpointsServer) HandleApiUploadRequest(w http.ResponseWriter, r *http.Request) {
+	var media io.Reader
+	var uploadType, uploadId string
+	parse := func(r *http.Request) (ar *ApiRequest, err error) {
+		// Keep the original body, the request's is replaced by the metadata.
+		media = r.Body
+		ar, uploadType, uploadId, err = newUploadRequest(r)
+		return ar, err
+	}
+	ed.instrument(w, r, parse, func(w http.ResponseWriter, ar *ApiRequest) {
+		ed.serveUpload(w, ar, uploadType, uploadId, media)
+	})
+}
+
+// Serves an upload request. Uploads, and the requests that start
+// resumable upload sessions, pass through the interceptors like other
+// calls. The chunks of a session belong to the call that started it.
+func (ed *EndpointsServer) serveUpload(w http.ResponseWriter, ar *ApiRequest, uploadType, uploadId string, media io.Reader) {
+	var err error
+	mediaType := ar.Header.Get("Content-Type")
+	switch uploadType {
+	case uploadTypeMedia:
+	case uploadTypeMultipart:
+		var metadata []byte
+		metadata, mediaType, media, err = readMultipartUpload(ar.Header.Get("Content-Type"), media)
+		if err == nil {
+			err = ar.setMetadata(metadata)
+		}
+	case uploadTypeResumable:
+		if uploadId != "" {
+			ed.handleUploadChunk(w, ar, uploadId, media)
+			return
+		}
+		var metadata []byte
+		metadata, err = ioutil.ReadAll(media)
+		if err == nil {
+			err = ar.setMetadata(metadata)
+		}
+	default:
+		err = newBadRequestError(fmt.Sprintf("Unsupported uploadType: %s", uploadType))
+	}
+	if err != nil {
+		ed.handleError(w, ar, err)
+		return
+	}
+
+	if !ed.updateApiConfigs(w, ar.Request) {
+		return
+	}
+	methodConfig, params := ed.lookupRestMethod(ar)
+	ar.params = params
+	if methodConfig == nil {
+		corsHandler := newCheckCorsHeaders(ar.Request)
+		sendNotFoundResponse(w, corsHandler)
+		return
+	}
+	spiRequest, err := ed.transformRequest(ar, params, methodConfig)
+	if err != nil {
+		ed.handleError(w, ar, err)
+		return
+	}
+
+	spiRequest.spiHeader = make(http.Header)
+	call := &Call{
+		OrigRequest: ar,
+		MethodName:  ar.Method,
+		Method:      methodConfig,
+		Params:      params,
+		SpiRequest:  spiRequest,
+		SpiHeader:   spiRequest.spiHeader,
+	}
+	if uploadType == uploadTypeResumable {
+		call.dispatch = func(w http.ResponseWriter, call *Call) (string, error) {
+			return ed.startUploadSession(w, call.OrigRequest, call.SpiRequest, call.Method)
+		}
+	} else {
+		call.dispatch = func(w http.ResponseWriter, call *Call) (string, error) {
+			resp, err := ed.postUpload(call.SpiRequest, mediaType, media)
+			if err != nil {
+				return "", err
+			}
+			return ed.responseHandler.HandleSpiResponse(ed, call.OrigRequest, call.SpiRequest,
+				resp, call.Method, w)
+		}
+	}
+	if _, err = ed.intercept(w, call); err != nil {
+		ed.handleError(w, ar, err)
+	}
+}
+
+// Splits a multipart/related upload into its JSON metadata and a reader
+// for the media part, returning the media's content type.
+func readMultipartUpload(contentType string, body io.Reader) ([]byte, string, io.Reader, error) {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		return nil, "", nil, newBadRequestError(
+			fmt.Sprintf("Invalid multipart upload Content-Type: %s", contentType))
+	}
+	mr := multipart.NewReader(body, params["boundary"])
+	metadataPart, err := mr.NextPart()
+	if err != nil {
+		return nil, "", nil, newBadRequestError("Missing upload metadata part")
+	}
+	metadata, err := ioutil.ReadAll(metadataPart)
+	if err != nil {
+		return nil, "", nil, err
+	}
+	mediaPart, err := mr.NextPart()
+	if err != nil {
+		return nil, "", nil, newBadRequestError("Missing upload media part")
+	}
+	return metadata, mediaPart.Header.Get("Content-Type"), mediaPart, nil
+}
+
+// Streams an upload to the SPI as a multipart/related request, with the
+// transformed JSON request as the first part and the media as the second.
+func (ed *EndpointsServer) postUpload(spiRequest *ApiRequest, mediaType string, media io.Reader) (*http.Response, error) {
+	if mediaType == "" {
+		mediaType = "application/octet-stream"
+	}
+	pr, pw := io.Pipe()
+	mw := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeUploadBody(mw, spiRequest.Body, mediaType, media))
+	}()
+	resp, err := ed.postSpi(spiRequest,
+		"multipart/related; boundary="+mw.Boundary(), pr)
+	// Unblock the writer if the request failed before reading the body.
+	pr.Close()
+	return resp, err
+}
+
+func writeUploadBody(mw *multipart.Writer, metadata io.Reader, mediaType string, media io.Reader) error {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", "application/json")
+	part, err := mw.CreatePart(header)
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(part, metadata); err != nil {
+		return err
+	}
+	header = make(textproto.MIMEHeader)
+	header.Set("Content-Type", mediaType)
+	if part, err = mw.CreatePart(header); err != nil {
+		return err
+	}
+	if _, err = io.Copy(part, media); err != nil {
+		return err
+	}
+	return mw.Close()
+}
+
+// State of a resumable upload.
+type uploadSession struct {
+	mu sync.Mutex
+
+	origRequest  *ApiRequest
+	spiRequest   *ApiRequest
+	methodConfig *endpoints.ApiMethod
+	mediaType    string
+
+	total    int64 // Total size of the media, or -1 if not yet known.
+	received int64
+
+	media      *io.PipeWriter // Nil until the first chunk arrives.
+	done       chan struct{}  // Closed once the SPI has responded.
+	resp       *http.Response
+	err        error
+	lastActive time.Time
+
+	timer *time.Timer // Expires the session once it is idle.
+
+	// Cancels the context of the SPI call, which is the session's own
+	// rather than that of the request that started it, as that is
+	// cancelled once the request has been answered.
+	cancel context.CancelFunc
+}
+
+// Ends the session's SPI call, if it has started, with the given error.
+// It must be called with the session's lock held.
+func (s *uploadSession) abort(err error) {
+	if s.media != nil {
+		s.media.CloseWithError(err)
+	}
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
+// Resumable upload sessions by id.
+type uploadSessions struct {
+	mu       sync.Mutex
+	sessions map[string]*uploadSession
+}
+
+func (us *uploadSessions) get(id string) *uploadSession {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return us.sessions[id]
+}
+
+func (us *uploadSessions) remove(id string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if s, ok := us.sessions[id]; ok {
+		s.timer.Stop()
+		delete(us.sessions, id)
+	}
+}
+
+// Adds a session and returns its id. Returns an error if too many
+// sessions are open or no id can be generated.
+func (us *uploadSessions) add(s *uploadSession) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("Can not generate upload session id: %s", err.Error())
+	}
+	id := hex.EncodeToString(b)
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	if us.sessions == nil {
+		us.sessions = make(map[string]*uploadSession)
+	}
+	if len(us.sessions) >= maxUploadSessions {
+		err := newStatusError(http.StatusServiceUnavailable, "Too many upload sessions")
+		return "", &err
+	}
+	s.timer = time.AfterFunc(uploadSessionTimeout, func() {
+		us.expire(id)
+	})
+	us.sessions[id] = s
+	return id, nil
+}
+
+// Abandons a session if it has been idle for uploadSessionTimeout, or
+// else checks it again once it could have been.
+func (us *uploadSessions) expire(id string) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	s, ok := us.sessions[id]
+	if !ok {
+		return
+	}
+	// A session whose lock is held is receiving a chunk.
+	if !s.mu.TryLock() {
+		s.timer.Reset(uploadSessionTimeout)
+		return
+	}
+	defer s.mu.Unlock()
+	if idle := time.Since(s.lastActive); idle < uploadSessionTimeout {
+		s.timer.Reset(uploadSessionTimeout - idle)
+		return
+	}
+	s.abort(fmt.Errorf("Upload session %s expired", id))
+	delete(us.sessions, id)
+}
+
+// Abandons every session, ending the SPI calls of those that have started
+// with the given error. A session receiving a chunk is left for the
+// chunk's handler to end once the chunk has been received.
+func (us *uploadSessions) abortAll(err error) {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	for id, s := range us.sessions {
+		if s.mu.TryLock() {
+			s.abort(err)
+			s.mu.Unlock()
+		} else if s.cancel != nil {
+			s.cancel()
+		}
+		s.timer.Stop()
+		delete(us.sessions, id)
+	}
+}
+
+// Returns the number of open sessions.
+func (us *uploadSessions) count() int {
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	return len(us.sessions)
+}
+
+// Creates a resumable upload session and responds with its URI.
+func (ed *EndpointsServer) startUploadSession(w http.ResponseWriter, ar *ApiRequest, spiRequest *ApiRequest, methodConfig *endpoints.ApiMethod) (string, error) {
+	// The SPI call is made once this request's trace has finished, and
+	// outlives the request.
+	spiRequest.trace = nil
+	s := &uploadSession{
+		origRequest:  ar,
+		spiRequest:   spiRequest,
+		methodConfig: methodConfig,
+		mediaType:    ar.Header.Get("X-Upload-Content-Type"),
+		total:        -1,
+		lastActive:   time.Now(),
+	}
+	if length := ar.Header.Get("X-Upload-Content-Length"); length != "" {
+		total, err := strconv.ParseInt(length, 10, 64)
+		if err != nil || total < 0 {
+			return "", newBadRequestError(
+				fmt.Sprintf("Invalid X-Upload-Content-Length: %s", length))
+		}
+		s.total = total
+	}
+	ctx, cancel := context.WithCancel(context.WithoutCancel(spiRequest.Context()))
+	spiRequest.Request = spiRequest.Request.WithContext(ctx)
+	s.cancel = cancel
+	id, err := ed.uploads.add(s)
+	if err != nil {
+		cancel()
+		return "", err
+	}
+
+	query := ar.URL.Query()
+	query.Set("uploadType", uploadTypeResumable)
+	query.Set("upload_id", id)
+	scheme := "http"
+	if ar.TLS != nil {
+		scheme = "https"
+	}
+	location := url.URL{
+		Scheme:   scheme,
+		Host:     ar.Host,
+		Path:     uploadPrefix + ar.URL.Path,
+		RawQuery: query.Encode(),
+	}
+	newCheckCorsHeaders(ar.Request).updateHeaders(w.Header())
+	w.Header().Set("Location", location.String())
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+	return "", nil
+}
+
+// Parses a Content-Range header of the form "bytes first-last/total",
+// "bytes */total" or "bytes first-last/*". Missing values are -1.
+func parseContentRange(contentRange string) (first, last, total int64, err error) {
+	first, last, total = -1, -1, -1
+	spec := strings.TrimSpace(contentRange)
+	if !strings.HasPrefix(spec, "bytes ") {
+		return first, last, total, fmt.Errorf("Invalid Content-Range: %s", contentRange)
+	}
+	spec = strings.TrimSpace(spec[len("bytes "):])
+	slash := strings.Index(spec, "/")
+	if slash == -1 {
+		return first, last, total, fmt.Errorf("Invalid Content-Range: %s", contentRange)
+	}
+	rangeSpec, totalSpec := spec[:slash], spec[slash+1:]
+	if totalSpec != "*" {
+		if total, err = strconv.ParseInt(totalSpec, 10, 64); err != nil {
+			return first, last, total, fmt.Errorf("Invalid Content-Range: %s", contentRange)
+		}
+	}
+	if rangeSpec != "*" {
+		bounds := strings.SplitN(rangeSpec, "-", 2)
+		if len(bounds) != 2 {
+			return first, last, total, fmt.Errorf("Invalid Content-Range: %s", contentRange)
+		}
+		if first, err = strconv.ParseInt(bounds[0], 10, 64); err != nil {
+			return first, last, total, fmt.Errorf("Invalid Content-Range: %s", contentRange)
+		}
+		if last, err = strconv.ParseInt(bounds[1], 10, 64); err != nil || last < first {
+			return first, last, total, fmt.Errorf("Invalid Content-Range: %s", contentRange)
+		}
+	}
+	return first, last, total, nil
+}
+
+// Writes a 308 response giving the range of bytes received so far.
+func sendResumeIncompleteResponse(w http.ResponseWriter, received int64, corsHandler corsHandler) {
+	if corsHandler != nil {
+		corsHandler.updateHeaders(w.Header())
+	}
+	if received > 0 {
+		w.Header().Set("Range", fmt.Sprintf("bytes=0-%d", received-1))
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(308)
+}
+
+// Handles a PUT of media, or a status query, to a resumable upload session.
+func (ed *EndpointsServer) handleUploadChunk(w http.ResponseWriter, ar *ApiRequest, id string, body io.Reader) {
+	s := ed.uploads.get(id)
+	if s == nil {
+		ed.handleError(w, ar, newUploadNotFoundError(id))
+		return
+	}
+	corsHandler := newCheckCorsHeaders(ar.Request)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastActive = time.Now()
+
+	first, last, total := int64(0), int64(-1), int64(-1)
+	if contentRange := ar.Header.Get("Content-Range"); contentRange != "" {
+		var err error
+		first, last, total, err = parseContentRange(contentRange)
+		if err != nil {
+			ed.handleError(w, ar, newBadRequestError(err.Error()))
+			return
+		}
+	}
+	if total >= 0 {
+		s.total = total
+	}
+	if first == -1 {
+		// A status query.
+		sendResumeIncompleteResponse(w, s.received, corsHandler)
+		return
+	}
+	if first != s.received {
+		// The client must resume from where we left off.
+		sendResumeIncompleteResponse(w, s.received, corsHandler)
+		return
+	}
+
+	if s.media == nil {
+		pr, pw := io.Pipe()
+		s.media = pw
+		s.done = make(chan struct{})
+		go func() {
+			s.resp, s.err = ed.postUpload(s.spiRequest, s.mediaType, pr)
+			pr.Close()
+			close(s.done)
+		}()
+	}
+
+	var chunk io.Reader = body
+	if last >= 0 {
+		chunk = io.LimitReader(body, last-first+1)
+	}
+	n, err := io.Copy(s.media, chunk)
+	s.received += n
+	if err != nil {
+		// The SPI call has failed, report its error.
+		<-s.done
+		ed.uploads.remove(id)
+		defer s.cancel()
+		if s.err == nil {
+			s.err = err
+		}
+		if s.resp != nil {
+			s.resp.Body.Close()
+		}
+		ed.handleError(w, ar, s.err)
+		return
+	}
+
+	if last == -1 && ar.Header.Get("Content-Range") == "" {
+		// The whole media was sent without Content-Range.
+		s.total = s.received
+	}
+	if s.total < 0 || s.received < s.total {
+		if ed.lifecycle.isShuttingDown() {
+			// The session was abandoned while the chunk was received.
+			ed.uploads.remove(id)
+			s.abort(errShuttingDown)
+			err := newStatusError(http.StatusServiceUnavailable, errShuttingDown.Error())
+			ed.handleError(w, ar, &err)
+			return
+		}
+		sendResumeIncompleteResponse(w, s.received, corsHandler)
+		return
+	}
+
+	s.media.Close()
+	<-s.done
+	ed.uploads.remove(id)
+	defer s.cancel()
+	err = s.err
+	if err == nil {
+		_, err = ed.responseHandler.HandleSpiResponse(ed, s.origRequest, s.spiRequest, s.resp,
+			s.methodConfig, w)
+	}
+	if err != nil {
+		ed.handleError(w, ar, err)
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2013 Google Inc. All Rights Reserved.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/rwl/go-endpoints/endpoints"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	first, last, total, err := parseContentRange("bytes 0-99/200")
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{0, 99, 200}, []int64{first, last, total})
+
+	first, last, total, err = parseContentRange("bytes 100-199/*")
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{100, 199, -1}, []int64{first, last, total})
+
+	first, last, total, err = parseContentRange("bytes */200")
+	assert.NoError(t, err)
+	assert.Equal(t, []int64{-1, -1, 200}, []int64{first, last, total})
+
+	_, _, _, err = parseContentRange("bytes 10-5/200")
+	assert.Error(t, err)
+	_, _, _, err = parseContentRange("items 0-1/2")
+	assert.Error(t, err)
+}
+
+// Set up a server with an upload method whose SPI records the metadata
+// and media it receives.
+func prepareUploadServer(t *testing.T, interceptors ...Interceptor) (*http.ServeMux, *map[string]interface{}, *string, func()) {
+	config := &endpoints.ApiDescriptor{
+		Name:    "files_api",
+		Version: "v1",
+		Methods: map[string]*endpoints.ApiMethod{
+			"files.insert": &endpoints.ApiMethod{
+				HttpMethod: "POST",
+				Path:       "files/{fid}",
+				RosyMethod: "FileService.insert",
+			},
+		},
+	}
+	server := newEndpointsServer()
+	ts := prepareTestServer(t, config)
+	server.url = ts.URL
+	for _, i := range interceptors {
+		server.AddInterceptor(i)
+	}
+
+	var metadata map[string]interface{}
+	var media string
+	ts2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_ah/spi/FileService.insert", r.URL.Path)
+		_, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		assert.NoError(t, err)
+		mr := multipart.NewReader(r.Body, params["boundary"])
+		part, err := mr.NextPart()
+		assert.NoError(t, err)
+		assert.Equal(t, "application/json", part.Header.Get("Content-Type"))
+		json.NewDecoder(part).Decode(&metadata)
+		part, err = mr.NextPart()
+		assert.NoError(t, err)
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(part)
+		media = string(body)
+		w.Header().Set("Content-Type", "application/json")
+		fmt.Fprint(w, `{"size": 1}`)
+	}))
+
+	server.SetSpiUrlBuilder(SpiUrlBuilderFunc(func(ed *EndpointsServer, spiRequest *ApiRequest) string {
+		return ts2.URL + fmt.Sprintf(spiRootFormat, spiRequest.URL.Path)
+	}))
+	mux := http.NewServeMux()
+	server.HandleHttp(mux)
+	return mux, &metadata, &media, func() {
+		ts.Close()
+		ts2.Close()
+	}
+}
+
+func serveUpload(mux *http.ServeMux, method, path, contentType, body string, header http.Header) *httptest.ResponseRecorder {
+	req := buildRequest(path, body, header)
+	req.Method = method
+	req.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	return w
+}
+
+func TestMediaUpload(t *testing.T) {
+	mux, metadata, media, cleanup := prepareUploadServer(t)
+	defer cleanup()
+
+	w := serveUpload(mux, "POST", "/_ah/api/upload/files_api/v1/files/1?uploadType=media",
+		"text/plain", "file contents", nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, map[string]interface{}{"fid": "1"}, *metadata)
+	assert.Equal(t, "file contents", *media)
+}
+
+func TestMultipartUpload(t *testing.T) {
+	mux, metadata, media, cleanup := prepareUploadServer(t)
+	defer cleanup()
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	writeUploadBody(mw, bytes.NewBufferString(`{"title": "notes"}`), "text/plain",
+		bytes.NewBufferString("file contents"))
+	w := serveUpload(mux, "POST", "/_ah/api/upload/files_api/v1/files/1?uploadType=multipart",
+		"multipart/related; boundary="+mw.Boundary(), body.String(), nil)
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, map[string]interface{}{"fid": "1", "title": "notes"}, *metadata)
+	assert.Equal(t, "file contents", *media)
+}
+
+func TestResumableUpload(t *testing.T) {
+	mux, metadata, media, cleanup := prepareUploadServer(t)
+	defer cleanup()
+
+	w := serveUpload(mux, "POST", "/_ah/api/upload/files_api/v1/files/1?uploadType=resumable",
+		"application/json", `{"title": "notes"}`,
+		http.Header{"X-Upload-Content-Type": []string{"text/plain"}})
+	assert.Equal(t, 200, w.Code)
+	location, err := url.Parse(w.Header().Get("Location"))
+	assert.NoError(t, err)
+	assert.Equal(t, "/_ah/api/upload/files_api/v1/files/1", location.Path)
+	sessionUri := location.RequestURI()
+
+	w = serveUpload(mux, "PUT", sessionUri, "text/plain", "file ",
+		http.Header{"Content-Range": []string{"bytes 0-4/13"}})
+	assert.Equal(t, 308, w.Code)
+	assert.Equal(t, "bytes=0-4", w.Header().Get("Range"))
+
+	// Out of order chunks are rejected with the current range.
+	w = serveUpload(mux, "PUT", sessionUri, "text/plain", "ents",
+		http.Header{"Content-Range": []string{"bytes 9-12/13"}})
+	assert.Equal(t, 308, w.Code)
+	assert.Equal(t, "bytes=0-4", w.Header().Get("Range"))
+
+	// Status query.
+	w = serveUpload(mux, "PUT", sessionUri, "text/plain", "",
+		http.Header{"Content-Range": []string{"bytes */13"}})
+	assert.Equal(t, 308, w.Code)
+	assert.Equal(t, "bytes=0-4", w.Header().Get("Range"))
+
+	w = serveUpload(mux, "PUT", sessionUri, "text/plain", "contents",
+		http.Header{"Content-Range": []string{"bytes 5-12/13"}})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, map[string]interface{}{"fid": "1", "title": "notes"}, *metadata)
+	assert.Equal(t, "file contents", *media)
+
+	// The session is finished.
+	w = serveUpload(mux, "PUT", sessionUri, "text/plain", "",
+		http.Header{"Content-Range": []string{"bytes */13"}})
+	assert.Equal(t, 404, w.Code)
+}
+
+// Sends a request to a server listening on the network.
+func sendUpload(t *testing.T, method, url, contentType, body string, header http.Header) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.NoError(t, err)
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := http.DefaultClient.Do(req)
+	if !assert.NoError(t, err) {
+		t.FailNow()
+	}
+	resp.Body.Close()
+	return resp
+}
+
+// Chunks are sent in requests of their own, after the request that
+// started the session has been answered and its context cancelled.
+func TestResumableUploadOverNetwork(t *testing.T) {
+	mux, _, media, cleanup := prepareUploadServer(t)
+	defer cleanup()
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	resp := sendUpload(t, "POST", ts.URL+"/_ah/api/upload/files_api/v1/files/1?uploadType=resumable",
+		"application/json", `{"title": "notes"}`,
+		http.Header{"X-Upload-Content-Type": []string{"text/plain"}})
+	assert.Equal(t, 200, resp.StatusCode)
+	location := resp.Header.Get("Location")
+
+	resp = sendUpload(t, "PUT", location, "text/plain", "file ",
+		http.Header{"Content-Range": []string{"bytes 0-4/13"}})
+	assert.Equal(t, 308, resp.StatusCode)
+	resp = sendUpload(t, "PUT", location, "text/plain", "contents",
+		http.Header{"Content-Range": []string{"bytes 5-12/13"}})
+	assert.Equal(t, 200, resp.StatusCode)
+	assert.Equal(t, "file contents", *media)
+}
+
+func TestUnsupportedUploadType(t *testing.T) {
+	mux, _, _, cleanup := prepareUploadServer(t)
+	defer cleanup()
+
+	w := serveUpload(mux, "POST", "/_ah/api/upload/files_api/v1/files/1?uploadType=bogus",
+		"text/plain", "file contents", nil)
+	assert.Equal(t, 400, w.Code)
+}
+
+func TestUploadInterceptors(t *testing.T) {
+	var calls []string
+	interceptor := func(call *Call, next CallHandler) (*CallResponse, error) {
+		calls = append(calls, call.MethodName)
+		if call.OrigRequest.Header.Get("X-Api-Key") != "secret" {
+			return nil, NewRequestError(http.StatusUnauthorized, "API key missing or invalid")
+		}
+		return next(call)
+	}
+	mux, _, media, cleanup := prepareUploadServer(t, interceptor)
+	defer cleanup()
+
+	w := serveUpload(mux, "POST", "/_ah/api/upload/files_api/v1/files/1?uploadType=media",
+		"text/plain", "file contents", nil)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, "", *media)
+	w = serveUpload(mux, "POST", "/_ah/api/upload/files_api/v1/files/1?uploadType=resumable",
+		"application/json", `{"title": "notes"}`, nil)
+	assert.Equal(t, 401, w.Code)
+	assert.Equal(t, "", w.Header().Get("Location"))
+
+	w = serveUpload(mux, "POST", "/_ah/api/upload/files_api/v1/files/1?uploadType=media",
+		"text/plain", "file contents", http.Header{"X-Api-Key": []string{"secret"}})
+	assert.Equal(t, 200, w.Code)
+	assert.Equal(t, "file contents", *media)
+	assert.Equal(t, []string{"files.insert", "files.insert", "files.insert"}, calls)
+}
+
+func TestUploadSessionLimits(t *testing.T) {
+	defer func(max int, timeout time.Duration) {
+		maxUploadSessions, uploadSessionTimeout = max, timeout
+	}(maxUploadSessions, uploadSessionTimeout)
+	maxUploadSessions = 1
+	uploadSessionTimeout = 20 * time.Millisecond
+
+	var sessions uploadSessions
+	pr, pw := io.Pipe()
+	s := &uploadSession{media: pw, lastActive: time.Now()}
+	id, err := sessions.add(s)
+	assert.NoError(t, err)
+	assert.Equal(t, 32, len(id))
+	_, err = sessions.add(&uploadSession{lastActive: time.Now()})
+	if reqErr, ok := err.(requestError); assert.True(t, ok) {
+		assert.Equal(t, 503, reqErr.statusCode())
+	}
+
+	// The idle session expires by itself and its SPI call is ended.
+	_, err = ioutil.ReadAll(pr)
+	assert.Error(t, err)
+	assert.Equal(t, 0, sessions.count())
+	id, err = sessions.add(&uploadSession{lastActive: time.Now()})
+	assert.NoError(t, err)
+	sessions.remove(id)
+}
+
+func TestUploadSessionsAbortAll(t *testing.T) {
+	var sessions uploadSessions
+	pr, pw := io.Pipe()
+	_, err := sessions.add(&uploadSession{media: pw, lastActive: time.Now()})
+	assert.NoError(t, err)
+	_, err = sessions.add(&uploadSession{lastActive: time.Now()})
+	assert.NoError(t, err)
+
+	// Sessions open on shutdown end their SPI calls.
+	sessions.abortAll(errShuttingDown)
+	_, err = ioutil.ReadAll(pr)
+	assert.Equal(t, errShuttingDown, err)
+	assert.Equal(t, 0, sessions.count())
+}
@@ -25,8 +25,8 @@ import (
 	"testing"
 )
 
-// Build an apiRequest for the given path and body.
-func buildApiRequest(url, body string, httpHeaders http.Header) *apiRequest {
+// Build an ApiRequest for the given path and body.
+func buildApiRequest(url, body string, httpHeaders http.Header) *ApiRequest {
 	req := buildRequest(url, body, httpHeaders)
 	apiRequest, err := newApiRequest(req)
 	if err != nil {